@@ -32,17 +32,34 @@ type ImageSpec struct {
 	Password   string `json:"password,omitempty"`
 }
 
+// SecurityContextSpec holds explicit security settings. Unset fields are left
+// to the security profile (or the cluster defaults), set fields always win.
 type SecurityContextSpec struct {
-	FsGroup                  int64            `json:"fsGroup,omitempty"`
-	RunAsUser                int64            `json:"runAsUser,omitempty"`
-	RunAsGroup               int64            `json:"runAsGroup,omitempty"`
-	AllowPrivilegeEscalation bool             `json:"allowPrivilegeEscalation,omitempty"`
-	RunAsNonRoot             bool             `json:"runAsNonRoot,omitempty"`
-	ReadOnlyRootFilesystem   bool             `json:"readOnlyRootFilesystem,omitempty"`
-	Privileged               bool             `json:"privileged,omitempty"`
+	FsGroup                  *int64           `json:"fsGroup,omitempty"`
+	RunAsUser                *int64           `json:"runAsUser,omitempty"`
+	RunAsGroup               *int64           `json:"runAsGroup,omitempty"`
+	AllowPrivilegeEscalation *bool            `json:"allowPrivilegeEscalation,omitempty"`
+	RunAsNonRoot             *bool            `json:"runAsNonRoot,omitempty"`
+	ReadOnlyRootFilesystem   *bool            `json:"readOnlyRootFilesystem,omitempty"`
+	Privileged               *bool            `json:"privileged,omitempty"`
 	Capabilities             CapabilitiesSpec `json:"capabilities,omitempty"`
+
+	SeccompProfile      *corev1.SeccompProfile         `json:"seccompProfile,omitempty"`
+	AppArmorProfile     *corev1.AppArmorProfile        `json:"appArmorProfile,omitempty"`
+	SupplementalGroups  []int64                        `json:"supplementalGroups,omitempty"`
+	FsGroupChangePolicy *corev1.PodFSGroupChangePolicy `json:"fsGroupChangePolicy,omitempty"`
+	// Sysctls are namespaced sysctls applied to the pod.
+	Sysctls []corev1.Sysctl `json:"sysctls,omitempty"`
 }
 
+// Security profiles expanding to a Pod Security Standard compliant security context.
+const (
+	SecurityProfileRestricted = "restricted"
+	SecurityProfileBaseline   = "baseline"
+	SecurityProfilePrivileged = "privileged"
+	SecurityProfileCustom     = "custom"
+)
+
 type CapabilitiesSpec struct {
 	Add  []string `json:"add,omitempty"`
 	Drop []string `json:"drop,omitempty"`
@@ -69,9 +86,104 @@ type EnvVar struct {
 	Value string `json:"value"`
 }
 
+// SecretItem is a single key of the <rollout>-secrets Secret. The value is
+// either given in plaintext, sealed for the operator key with
+// `manager encrypt`, in which case it is only decrypted into the Secret, or
+// read from an external store with valueFrom and resynced periodically, or
+// generated once by the operator.
+// +kubebuilder:validation:XValidation:rule="[has(self.value) && size(self.value) > 0, has(self.encryptedValue), has(self.valueFrom), has(self.generate)].filter(x, x).size() <= 1",message="value, encryptedValue, valueFrom and generate are mutually exclusive"
 type SecretItem struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Name           string             `json:"name"`
+	Value          string             `json:"value,omitempty"`
+	EncryptedValue string             `json:"encryptedValue,omitempty"`
+	ValueFrom      *SecretValueSource `json:"valueFrom,omitempty"`
+	Generate       *SecretGenerator   `json:"generate,omitempty"`
+	// Mount additionally exposes the value as a file, e.g. for TLS keys or
+	// credential files. It stays available as environment variable.
+	Mount *SecretMount `json:"mount,omitempty"`
+}
+
+// Generated secret types. Key pairs add the public key as <name>_PUB,
+// certificates add their private key as <name>_KEY.
+const (
+	SecretGeneratePassword    = "password"
+	SecretGenerateBytes       = "bytes"
+	SecretGenerateUUID        = "uuid"
+	SecretGenerateRSA         = "rsa"
+	SecretGenerateEd25519     = "ed25519"
+	SecretGenerateCertificate = "certificate"
+)
+
+// SecretGenerator has the operator generate the value once. It is kept stable
+// across reconciles and only replaced when it is rotated.
+type SecretGenerator struct {
+	// Type of the value, a password by default.
+	// +kubebuilder:validation:Enum=password;bytes;uuid;rsa;ed25519;certificate
+	// +kubebuilder:default=password
+	Type string `json:"type,omitempty"`
+	// Length of a password in characters or of random bytes (base64 encoded), 32 if unset.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1024
+	Length int `json:"length,omitempty"`
+	// Charset of a password, alphanumeric if unset.
+	// +kubebuilder:validation:Enum=alphanumeric;symbols;numeric;hex
+	Charset string `json:"charset,omitempty"`
+	// Bits of an RSA key, 2048 if unset.
+	// +kubebuilder:validation:Enum=2048;3072;4096
+	Bits int `json:"bits,omitempty"`
+	// CommonName of a certificate, the Rollout name if empty.
+	CommonName string `json:"commonName,omitempty"`
+	// DNSNames of a certificate.
+	DNSNames []string `json:"dnsNames,omitempty"`
+	// ValidityDays of a certificate, 365 if unset.
+	// +kubebuilder:validation:Minimum=1
+	ValidityDays int `json:"validityDays,omitempty"`
+	// RotationInterval regenerates the value once it is older, e.g. "720h".
+	RotationInterval *metav1.Duration `json:"rotationInterval,omitempty"`
+}
+
+// SecretMount places a secret value as a file into the container.
+type SecretMount struct {
+	// MountPath is the directory the file is placed in. Secrets sharing a
+	// mountPath end up in the same directory, which hides existing content.
+	MountPath string `json:"mountPath"`
+	// FileName of the file, the secret name if empty.
+	// +kubebuilder:validation:Pattern=`^[^/]+$`
+	FileName string `json:"fileName,omitempty"`
+	// Mode are the file permission bits, e.g. 0400, 0644 if unset.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=511
+	Mode *int32 `json:"mode,omitempty"`
+}
+
+// SecretValueSource references a value held outside of the Rollout.
+// +kubebuilder:validation:XValidation:rule="has(self.secretKeyRef) != has(self.provider)",message="exactly one of secretKeyRef and provider must be set"
+type SecretValueSource struct {
+	// SecretKeyRef selects a key of a Secret, possibly in another namespace.
+	// Secrets outside of the Rollout namespace must list it in their
+	// one-click.dev/share-with annotation.
+	SecretKeyRef *SecretKeyReference `json:"secretKeyRef,omitempty"`
+	// Provider selects a value from a secret store configured on the operator.
+	Provider *SecretProviderReference `json:"provider,omitempty"`
+}
+
+type SecretKeyReference struct {
+	Name string `json:"name"`
+	// Namespace of the Secret, the Rollout namespace if empty.
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+type SecretProviderReference struct {
+	// Name of the provider.
+	// +kubebuilder:validation:Enum=vault;file
+	Name string `json:"name"`
+	// Path of the secret in the store, e.g. the KV path in Vault. It is
+	// relative to the directory of the Rollout namespace in the store and
+	// must not contain ".." segments.
+	Path string `json:"path"`
+	// Key within the secret, optional if the path holds a single value.
+	Key string `json:"key,omitempty"`
 }
 
 type VolumeSpec struct {
@@ -82,15 +194,55 @@ type VolumeSpec struct {
 }
 
 type InterfaceSpec struct {
-	Name    string      `json:"name"`
-	Port    int32       `json:"port"`
-	Ingress IngressSpec `json:"ingress,omitempty"`
+	Name string `json:"name"`
+	Port int32  `json:"port"`
+	// Protocol of the port, TCP if unset.
+	// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+	// +optional
+	Protocol string      `json:"protocol,omitempty"`
+	Ingress  IngressSpec `json:"ingress,omitempty"`
 }
 
 type IngressSpec struct {
 	IngressClass string            `json:"ingressClass"`
 	Annotations  map[string]string `json:"annotations,omitempty"`
 	Rules        []IngressRule     `json:"rules"`
+	// AutoHost generates the host of rules without one (or a single root rule
+	// if no rules are defined) from the operator's default domain.
+	AutoHost bool `json:"autoHost,omitempty"`
+
+	// The following fields are translated into controller specific annotations
+	// (or Traefik middlewares). Annotations set above always take precedence.
+	BasicAuth           *IngressBasicAuth `json:"basicAuth,omitempty"`
+	AllowedSourceRanges []string          `json:"allowedSourceRanges,omitempty"`
+	RateLimit           *IngressRateLimit `json:"rateLimit,omitempty"`
+	SSLRedirect         *bool             `json:"sslRedirect,omitempty"`
+	MaxBodySize         string            `json:"maxBodySize,omitempty"`
+	CORS                *IngressCORS      `json:"cors,omitempty"`
+	// +kubebuilder:validation:Enum=HTTP;HTTPS;GRPC;WebSocket
+	BackendProtocol string `json:"backendProtocol,omitempty"`
+}
+
+// IngressBasicAuth protects an ingress with HTTP basic authentication. The
+// referenced secret holds one key per user name with the plaintext password as
+// value; the operator hashes them into a controller specific htpasswd secret.
+type IngressBasicAuth struct {
+	SecretName string `json:"secretName"`
+	Realm      string `json:"realm,omitempty"`
+}
+
+type IngressRateLimit struct {
+	RequestsPerSecond int32 `json:"requestsPerSecond"`
+	Burst             int32 `json:"burst,omitempty"`
+}
+
+type IngressCORS struct {
+	AllowOrigins     []string `json:"allowOrigins,omitempty"`
+	AllowMethods     []string `json:"allowMethods,omitempty"`
+	AllowHeaders     []string `json:"allowHeaders,omitempty"`
+	ExposeHeaders    []string `json:"exposeHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAge           int32    `json:"maxAge,omitempty"`
 }
 
 type IngressRule struct {
@@ -100,26 +252,82 @@ type IngressRule struct {
 	TlsSecretName string `json:"tlsSecretName,omitempty"`
 }
 
+// +kubebuilder:validation:XValidation:rule="has(self.image) || (has(self.inheritFromRollout) && has(self.inheritFromRollout.image) && self.inheritFromRollout.image)",message="image is required unless it is inherited from the Rollout"
 type CronJobSpec struct {
-	Name         string               `json:"name"`
-	Suspend      bool                 `json:"suspend"`
-	Image        ImageSpec            `json:"image"`
-	Schedule     string               `json:"schedule"`
-	Command      []string             `json:"command,omitempty"`
-	Args         []string             `json:"args,omitempty"`
+	Name    string `json:"name"`
+	Suspend bool   `json:"suspend"`
+	// Image of the job, optional if inheritFromRollout.image is set.
+	Image    ImageSpec `json:"image,omitempty"`
+	Schedule string    `json:"schedule"`
+	Command  []string  `json:"command,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	// Deprecated: use backoffLimit. Only used as backoff limit if backoffLimit is unset.
 	MaxRetries   int32                `json:"maxRetries,omitempty"`
 	BackoffLimit int32                `json:"backoffLimit,omitempty"`
 	Env          []EnvVar             `json:"env,omitempty"`
 	Resources    ResourceRequirements `json:"resources"`
+	// ConcurrencyPolicy decides whether runs may overlap, Allow if empty.
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	ConcurrencyPolicy string `json:"concurrencyPolicy,omitempty"`
+	// StartingDeadlineSeconds after the scheduled time a missed run is skipped.
+	// +kubebuilder:validation:Minimum=0
+	StartingDeadlineSeconds *int64 `json:"startingDeadlineSeconds,omitempty"`
+	// SuccessfulJobsHistoryLimit is the number of finished jobs kept, 3 if unset.
+	// +kubebuilder:validation:Minimum=0
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// FailedJobsHistoryLimit is the number of failed jobs kept, 1 if unset.
+	// +kubebuilder:validation:Minimum=0
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+	// TimeZone the schedule is interpreted in, e.g. "Europe/Zurich". The
+	// controller manager time zone if unset.
+	// +kubebuilder:validation:MinLength=1
+	TimeZone *string `json:"timeZone,omitempty"`
+	// ActiveDeadlineSeconds a run may take before it is terminated.
+	// +kubebuilder:validation:Minimum=1
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// TTLSecondsAfterFinished after which finished jobs are deleted.
+	// +kubebuilder:validation:Minimum=0
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+	// RestartPolicy of the job pods, Never if empty.
+	// +kubebuilder:validation:Enum=Never;OnFailure
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	// InheritFromRollout runs the job in the context of the Rollout, e.g. for
+	// management commands in the app image.
+	InheritFromRollout *CronJobInheritSpec `json:"inheritFromRollout,omitempty"`
+}
+
+// CronJobInheritSpec selects what a cron job takes over from its Rollout.
+type CronJobInheritSpec struct {
+	// Image uses the Rollout image and tag, following tag bumps, and its pull
+	// credentials instead of the cron job image.
+	Image bool `json:"image,omitempty"`
+	// Env adds the Rollout env, cron job env entries with the same name win.
+	Env bool `json:"env,omitempty"`
+	// Secrets exposes the <rollout>-secrets Secret as environment variables.
+	Secrets bool `json:"secrets,omitempty"`
+	// Volumes are the names of the Rollout volumes to mount at their mountPath.
+	// ReadWriteOnce volumes can only be mounted on the node running the Rollout.
+	Volumes []string `json:"volumes,omitempty"`
+	// ServiceAccount runs the job with the Rollout service account.
+	ServiceAccount bool `json:"serviceAccount,omitempty"`
+	// SecurityContext applies the Rollout security profile and security context.
+	SecurityContext bool `json:"securityContext,omitempty"`
+	// Scheduling applies the Rollout node selector and tolerations.
+	Scheduling bool `json:"scheduling,omitempty"`
 }
 
 // RolloutSpec defines the desired state of Rollout
 type RolloutSpec struct {
-	Args               []string             `json:"args,omitempty"`
-	Command            []string             `json:"command,omitempty"`
-	RolloutStrategy    string               `json:"rolloutStrategy,omitempty"`
-	Image              ImageSpec            `json:"image"`
-	SecurityContext    SecurityContextSpec  `json:"securityContext,omitempty"`
+	Args            []string            `json:"args,omitempty"`
+	Command         []string            `json:"command,omitempty"`
+	RolloutStrategy string              `json:"rolloutStrategy,omitempty"`
+	Image           ImageSpec           `json:"image"`
+	SecurityContext SecurityContextSpec `json:"securityContext,omitempty"`
+	// SecurityProfile expands to a Pod Security Standard compliant pod and
+	// container security context. Defaults to custom, which only applies the
+	// explicitly set securityContext fields.
+	// +kubebuilder:validation:Enum=restricted;baseline;privileged;custom
+	SecurityProfile    string               `json:"securityProfile,omitempty"`
 	HorizontalScale    HorizontalScaleSpec  `json:"horizontalScale"`
 	Resources          ResourceRequirements `json:"resources"`
 	Env                []EnvVar             `json:"env,omitempty"`
@@ -131,6 +339,63 @@ type RolloutSpec struct {
 	NodeSelector       map[string]string    `json:"nodeSelector,omitempty"`
 	Tolerations        []corev1.Toleration  `json:"tolerations,omitempty"`
 	HostAliases        []corev1.HostAlias   `json:"hostAliases,omitempty"`
+	Hooks              *HooksSpec           `json:"hooks,omitempty"`
+	// DeletionPolicy controls what happens to the resources of the Rollout when
+	// it is deleted. Everything is deleted if unset.
+	DeletionPolicy *DeletionPolicySpec `json:"deletionPolicy,omitempty"`
+}
+
+// Deletion policy types.
+const (
+	DeletionPolicyDelete        = "Delete"
+	DeletionPolicyRetainVolumes = "RetainVolumes"
+	DeletionPolicySnapshot      = "Snapshot"
+	DeletionPolicyScaleToZero   = "ScaleToZero"
+)
+
+// +kubebuilder:validation:XValidation:rule="self.type != 'ScaleToZero' || has(self.retentionDays)",message="retentionDays is required for ScaleToZero"
+type DeletionPolicySpec struct {
+	// Type is Delete to delete everything, RetainVolumes to keep the PVCs,
+	// Snapshot to snapshot the PVCs before they are deleted, or ScaleToZero to
+	// scale the Deployment to zero and keep everything for retentionDays.
+	// +kubebuilder:validation:Enum=Delete;RetainVolumes;Snapshot;ScaleToZero
+	// +kubebuilder:default=Delete
+	Type string `json:"type"`
+	// RetentionDays the scaled down objects are kept for with ScaleToZero.
+	// +kubebuilder:validation:Minimum=1
+	RetentionDays *int32 `json:"retentionDays,omitempty"`
+	// VolumeSnapshotClassName used for Snapshot, the cluster default if unset.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// HooksSpec defines jobs run around a change of the pod template. Hooks run
+// with the new pod template, i.e. the new image, env, secrets and volumes.
+type HooksSpec struct {
+	// PreDeploy runs before the Deployment is updated, the update waits for it
+	// to succeed and is blocked if it fails.
+	PreDeploy *HookSpec `json:"preDeploy,omitempty"`
+	// PostDeploy runs once the new pod template is rolled out.
+	PostDeploy *HookSpec `json:"postDeploy,omitempty"`
+}
+
+type HookSpec struct {
+	// Command overrides the Rollout command.
+	Command []string `json:"command,omitempty"`
+	// Args override the Rollout args.
+	Args []string `json:"args,omitempty"`
+	// Env is added to the Rollout env, entries with the same name win.
+	Env []EnvVar `json:"env,omitempty"`
+	// Resources of the hook, the Rollout resources if unset.
+	Resources *ResourceRequirements `json:"resources,omitempty"`
+	// BackoffLimit is the number of retries, none if unset.
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// ActiveDeadlineSeconds the hook may take before it fails.
+	// +kubebuilder:validation:Minimum=1
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// Rollback restores the previous pod template if a post-deploy hook fails.
+	// The new pod template is not deployed again until it changes.
+	Rollback bool `json:"rollback,omitempty"`
 }
 
 type Resources struct {
@@ -143,11 +408,89 @@ type DeploymentResources struct {
 	LimitSum   Resources `json:"limitSum"`
 }
 
+// Deployment health phases.
+const (
+	DeploymentProgressing = "Progressing"
+	DeploymentHealthy     = "Healthy"
+	DeploymentDegraded    = "Degraded"
+	DeploymentFailed      = "Failed"
+	DeploymentSuspended   = "Suspended"
+)
+
 type DeploymentStatus struct {
 	Replicas  int32               `json:"replicas"`
 	PodNames  []string            `json:"podNames"`
 	Resources DeploymentResources `json:"resources"`
-	Status    string              `json:"status"`
+	// Status is the overall health: Progressing, Healthy, Degraded, Failed or
+	// Suspended.
+	Status string `json:"status"`
+	// Reason and Message explain the status.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	UpdatedReplicas   int32 `json:"updatedReplicas,omitempty"`
+	ReadyReplicas     int32 `json:"readyReplicas,omitempty"`
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+
+	// Pods is the per-pod breakdown.
+	Pods []PodStatus `json:"pods,omitempty"`
+}
+
+type PodStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	// Reason the app container is waiting or terminated, e.g. CrashLoopBackOff
+	// or ImagePullBackOff.
+	Reason string `json:"reason,omitempty"`
+	// LastTerminationReason of the app container, e.g. OOMKilled or Error.
+	LastTerminationReason string `json:"lastTerminationReason,omitempty"`
+	Node                  string `json:"node,omitempty"`
+	Image                 string `json:"image,omitempty"`
+}
+
+// Deletion phases, in order.
+const (
+	DeletionScaledToZero      = "ScaledToZero"
+	DeletionRemovingTraffic   = "RemovingTraffic"
+	DeletionStoppingWorkload  = "StoppingWorkload"
+	DeletionSnapshotting      = "SnapshottingVolumes"
+	DeletionRemovingVolumes   = "RemovingVolumes"
+	DeletionRetainingVolumes  = "RetainingVolumes"
+	DeletionRemovingFinalizer = "RemovingFinalizer"
+	// DeletionSnapshotsUnavailable holds the volumes of a Rollout with the
+	// Snapshot policy while the cluster has no VolumeSnapshot API.
+	DeletionSnapshotsUnavailable = "SnapshotsUnavailable"
+)
+
+type DeletionStatus struct {
+	// Phase is the current cleanup step.
+	Phase   string `json:"phase"`
+	Message string `json:"message,omitempty"`
+	// ExpiresAt is when the objects of a Rollout scaled to zero are deleted.
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+// AutoscalerStatus reports the HorizontalPodAutoscaler of the Rollout.
+type AutoscalerStatus struct {
+	Name            string `json:"name"`
+	CurrentReplicas int32  `json:"currentReplicas"`
+	DesiredReplicas int32  `json:"desiredReplicas"`
+	MinReplicas     int32  `json:"minReplicas"`
+	MaxReplicas     int32  `json:"maxReplicas"`
+	// Metrics are the current and target values of the scaling metrics.
+	Metrics       []AutoscalerMetricStatus `json:"metrics,omitempty"`
+	LastScaleTime *metav1.Time             `json:"lastScaleTime,omitempty"`
+}
+
+type AutoscalerMetricStatus struct {
+	// Name of the metric, e.g. cpu or memory.
+	Name string `json:"name"`
+	// Current value, a utilization percentage like "42%" or a quantity.
+	Current string `json:"current,omitempty"`
+	// Target value in the same unit.
+	Target string `json:"target,omitempty"`
 }
 
 type ServiceStatus struct {
@@ -159,6 +502,7 @@ type ServiceStatus struct {
 type IngressStatus struct {
 	Name   string   `json:"name"`
 	Hosts  []string `json:"hosts"`
+	URLs   []string `json:"urls,omitempty"`
 	Status string   `json:"status"`
 }
 
@@ -167,12 +511,79 @@ type VolumeStatus struct {
 	Status string `json:"status"`
 }
 
+// Hook types and phases.
+const (
+	HookPreDeploy  = "PreDeploy"
+	HookPostDeploy = "PostDeploy"
+
+	HookRunning   = "Running"
+	HookSucceeded = "Succeeded"
+	HookFailed    = "Failed"
+)
+
+// HookStatus is a run of a hook for a pod template.
+type HookStatus struct {
+	// Type is PreDeploy or PostDeploy.
+	Type string `json:"type"`
+	// Hash of the pod template the hook ran for.
+	Hash    string `json:"hash"`
+	JobName string `json:"jobName"`
+	Image   string `json:"image,omitempty"`
+	// Phase is Running, Succeeded or Failed.
+	Phase          string       `json:"phase"`
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// CronJobStatus summarizes the runs of a cron job.
+type CronJobStatus struct {
+	// Name is the name of the cron job in the spec.
+	Name string `json:"name"`
+	// LastScheduleTime is when a run was last scheduled.
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// LastSuccessfulTime is when the last successful run completed.
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// LastFailureTime is when the last run failed.
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+	// LastFailureReason is the reason and message of the last failed run.
+	LastFailureReason string `json:"lastFailureReason,omitempty"`
+	// Active is the number of running jobs.
+	Active int32 `json:"active"`
+	// NextScheduleTime is the next scheduled run, unset while suspended.
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+}
+
+// ResourceConflict is an existing resource with the name of a resource of the
+// Rollout that is not controlled by the Rollout.
+type ResourceConflict struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Owner is the controller of the resource as kind/name, empty if it has
+	// none and can be adopted.
+	Owner string `json:"owner,omitempty"`
+}
+
 // RolloutStatus defines the observed state of Rollout
 type RolloutStatus struct {
 	Deployment DeploymentStatus `json:"deployment"`
 	Services   []ServiceStatus  `json:"services,omitempty"`
 	Ingresses  []IngressStatus  `json:"ingresses,omitempty"`
 	Volumes    []VolumeStatus   `json:"volumes,omitempty"`
+	CronJobs   []CronJobStatus  `json:"cronJobs,omitempty"`
+	// Autoscaler is the state of the HorizontalPodAutoscaler.
+	Autoscaler *AutoscalerStatus `json:"autoscaler,omitempty"`
+	// Deletion reports the progress of the cleanup of a deleted Rollout.
+	Deletion *DeletionStatus `json:"deletion,omitempty"`
+	// Hooks is the history of hook runs, newest first.
+	Hooks []HookStatus `json:"hooks,omitempty"`
+	// Conflicts are the existing resources the Rollout would manage but does
+	// not control, they are left untouched.
+	Conflicts []ResourceConflict `json:"conflicts,omitempty"`
+
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.image.repository"
@@ -181,6 +592,7 @@ type RolloutStatus struct {
 //+kubebuilder:printcolumn:name="Deployment Status",type="string",JSONPath=".status.deployment.status"
 //+kubebuilder:printcolumn:name="Service Status",type="string",JSONPath=".status.services[*].status"
 //+kubebuilder:printcolumn:name="Ingress Status",type="string",JSONPath=".status.ingresses[*].status"
+//+kubebuilder:printcolumn:name="URLs",type="string",JSONPath=".status.ingresses[*].urls[*]",priority=1
 //+kubebuilder:printcolumn:name="Volume Status",type="string",JSONPath=".status.volumes[*].status"
 //+kubebuilder:printcolumn:name="Service Account",type="string",JSONPath=".spec.serviceAccountName"
 //+kubebuilder:printcolumn:name="Rollout Strategy",type="string",JSONPath=".spec.rolloutStrategy"
@@ -0,0 +1,104 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RolloutRun phases.
+const (
+	RolloutRunPending   = "Pending"
+	RolloutRunRunning   = "Running"
+	RolloutRunSucceeded = "Succeeded"
+	RolloutRunFailed    = "Failed"
+)
+
+// RolloutRunSpec defines a one-off task run with the image, env, secrets and
+// volumes of a Rollout.
+// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="spec is immutable"
+type RolloutRunSpec struct {
+	// Rollout is the name of the Rollout in the same namespace to run for.
+	Rollout string `json:"rollout"`
+	// Command overrides the Rollout command.
+	Command []string `json:"command,omitempty"`
+	// Args override the Rollout args.
+	Args []string `json:"args,omitempty"`
+	// Env is added to the Rollout env, entries with the same name win.
+	Env []EnvVar `json:"env,omitempty"`
+	// Resources of the run, the Rollout resources if unset.
+	Resources *ResourceRequirements `json:"resources,omitempty"`
+	// BackoffLimit is the number of retries, none if unset.
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// ActiveDeadlineSeconds the run may take before it is terminated.
+	// +kubebuilder:validation:Minimum=1
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// TTLSecondsAfterFinished after which the finished run and its Job are
+	// deleted. Finished runs are kept if unset.
+	// +kubebuilder:validation:Minimum=0
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+}
+
+// RolloutRunStatus defines the observed state of RolloutRun
+type RolloutRunStatus struct {
+	// Phase is Pending, Running, Succeeded or Failed.
+	Phase string `json:"phase,omitempty"`
+	// Image the run was started with.
+	Image string `json:"image,omitempty"`
+	// JobName is the Job executing the run.
+	JobName string `json:"jobName,omitempty"`
+	// PodName is the latest pod of the Job.
+	PodName string `json:"podName,omitempty"`
+	// ExitCode of the container once it terminated.
+	ExitCode *int32 `json:"exitCode,omitempty"`
+	// Reason and Message explain a failed run.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:printcolumn:name="Rollout",type="string",JSONPath=".spec.rollout"
+//+kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+//+kubebuilder:printcolumn:name="Exit Code",type="integer",JSONPath=".status.exitCode"
+//+kubebuilder:printcolumn:name="Pod",type="string",JSONPath=".status.podName",priority=1
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+type RolloutRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RolloutRunSpec   `json:"spec,omitempty"`
+	Status RolloutRunStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RolloutRunList contains a list of RolloutRun
+type RolloutRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RolloutRun `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RolloutRun{}, &RolloutRunList{})
+}
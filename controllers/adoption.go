@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+)
+
+const (
+	// adoptAnnotation set to "true" on a Rollout lets it adopt existing
+	// resources with the names of its resources that have no controller.
+	adoptAnnotation = "one-click.dev/adopt"
+
+	// ConditionResourceConflict is set when resources of the Rollout exist but
+	// are not controlled by it.
+	ConditionResourceConflict = "ResourceConflict"
+)
+
+// claimForRollout reports whether the Rollout may write an existing object.
+// Objects controlled by the Rollout are its own and objects without a
+// controller are adopted if the Rollout has the adopt annotation and adoption
+// is enabled. Any other
+// object is recorded as a conflict and must be left untouched.
+func (r *RolloutReconciler) claimForRollout(f *oneclickiov1alpha1.Rollout, obj metav1.Object, kind string) bool {
+	if metav1.IsControlledBy(obj, f) {
+		return true
+	}
+
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil && f.Annotations[adoptAnnotation] == "true" && r.Config.Get().Features.Adoption {
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Adopted", "Adopted %s %s", kind, obj.GetName())
+		return true
+	}
+
+	conflict := oneclickiov1alpha1.ResourceConflict{Kind: kind, Name: obj.GetName()}
+	if owner != nil {
+		conflict.Owner = owner.Kind + "/" + owner.Name
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "ResourceConflict", "%s %s is controlled by %s", kind, obj.GetName(), conflict.Owner)
+	} else if !r.Config.Get().Features.Adoption {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "ResourceConflict", "%s %s already exists and adoption is disabled", kind, obj.GetName())
+	} else {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "ResourceConflict", "%s %s already exists, annotate the Rollout with %s=true to adopt it", kind, obj.GetName(), adoptAnnotation)
+	}
+	f.Status.Conflicts = append(f.Status.Conflicts, conflict)
+	return false
+}
+
+// hasConflict reports whether a resource of the kind is in conflict.
+func hasConflict(f *oneclickiov1alpha1.Rollout, kind string) bool {
+	for _, conflict := range f.Status.Conflicts {
+		if conflict.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// setConflictCondition records the conflicts of the reconcile in the
+// ResourceConflict condition.
+func setConflictCondition(f *oneclickiov1alpha1.Rollout) {
+	if len(f.Status.Conflicts) == 0 {
+		meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+			Type:               ConditionResourceConflict,
+			Status:             metav1.ConditionFalse,
+			Reason:             "NoConflict",
+			Message:            "All resources are controlled by the Rollout",
+			ObservedGeneration: f.Generation,
+		})
+		return
+	}
+
+	var conflicts []string
+	for _, conflict := range f.Status.Conflicts {
+		if conflict.Owner != "" {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s is controlled by %s", conflict.Kind, conflict.Name, conflict.Owner))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s exists without a controller", conflict.Kind, conflict.Name))
+		}
+	}
+	meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+		Type:               ConditionResourceConflict,
+		Status:             metav1.ConditionTrue,
+		Reason:             "ResourceExists",
+		Message:            strings.Join(conflicts, "; "),
+		ObservedGeneration: f.Generation,
+	})
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+)
+
+// fieldManager owns the fields of the resources the operator applies.
+const fieldManager = "one-click-operator"
+
+// legacyFieldManagers wrote the resources with create and update before the
+// operator used server-side apply. Their fields are handed over to
+// fieldManager, so fields dropped from the desired state get removed.
+var legacyFieldManagers = sets.New("manager")
+
+// appliedState is the desired state last applied to a resource and the
+// resulting resource version.
+type appliedState struct {
+	hash            string
+	resourceVersion string
+}
+
+// applyForRollout server-side applies the full desired state of a resource of
+// the Rollout. Fields owned by others are taken over if the operator sets them,
+// all other fields are left alone. Existing resources not controlled by the
+// Rollout are only applied once adopted. Creations and changes are recorded as
+// events.
+func (r *RolloutReconciler) applyForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout, obj client.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	kind := gvk.Kind
+	obj.SetManagedFields(nil)
+	obj.SetResourceVersion("")
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	desiredHash := hex.EncodeToString(sum[:])
+	cacheKey := appliedKey(gvk, obj)
+	applied := r.appliedFor(f)
+
+	current := obj.DeepCopyObject().(client.Object)
+	err = r.getUncached(ctx, types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}, current)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get %s %s", kind, obj.GetName())
+		return err
+	}
+	exists := err == nil
+	if exists && !r.claimForRollout(f, current, kind) {
+		return nil
+	}
+
+	// Skip the apply if the same desired state was applied to the current
+	// version already. Any change by others bumps the resource version.
+	if exists {
+		if last, ok := applied.Load(cacheKey); ok && last.(appliedState) == (appliedState{hash: desiredHash, resourceVersion: current.GetResourceVersion()}) {
+			return nil
+		}
+
+		// Take over the fields written before server-side apply
+		patch, err := csaupgrade.UpgradeManagedFieldsPatch(current, legacyFieldManagers, fieldManager)
+		if err != nil {
+			return err
+		}
+		if patch != nil {
+			if err := r.Patch(ctx, current, client.RawPatch(types.JSONPatchType, patch)); err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to migrate the field ownership of %s %s", kind, obj.GetName())
+				return err
+			}
+		}
+	}
+
+	if err := r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		if exists {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update %s %s", kind, obj.GetName())
+		} else {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create %s %s", kind, obj.GetName())
+		}
+		return err
+	}
+
+	applied.Store(cacheKey, appliedState{hash: desiredHash, resourceVersion: obj.GetResourceVersion()})
+
+	switch {
+	case !exists:
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created %s %s", kind, obj.GetName())
+	case obj.GetResourceVersion() != current.GetResourceVersion():
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated %s %s", kind, obj.GetName())
+	}
+	return nil
+}
+
+// appliedFor returns the states last applied to the resources of a Rollout.
+func (r *RolloutReconciler) appliedFor(f *oneclickiov1alpha1.Rollout) *sync.Map {
+	applied, _ := r.applied.LoadOrStore(f.UID, &sync.Map{})
+	return applied.(*sync.Map)
+}
+
+// forgetApplied drops the state last applied to a deleted resource of the
+// Rollout, or to all of its resources if obj is nil.
+func (r *RolloutReconciler) forgetApplied(f *oneclickiov1alpha1.Rollout, obj client.Object) {
+	if obj == nil {
+		r.applied.Delete(f.UID)
+		return
+	}
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return
+	}
+	if applied, ok := r.applied.Load(f.UID); ok {
+		applied.(*sync.Map).Delete(appliedKey(gvk, obj))
+	}
+}
+
+func appliedKey(gvk schema.GroupVersionKind, obj client.Object) string {
+	return gvk.String() + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// getUncached gets an object from the cache, or from the API server if the
+// cache does not hold it. Objects the cache is restricted from must still be
+// seen before one of the same name is created, so they are never overwritten.
+func (r *RolloutReconciler) getUncached(ctx context.Context, key types.NamespacedName, obj client.Object) error {
+	err := r.Get(ctx, key, obj)
+	if errors.IsNotFound(err) && r.APIReader != nil {
+		return r.APIReader.Get(ctx, key, obj)
+	}
+	return err
+}
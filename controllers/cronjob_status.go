@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+)
+
+// cronJobStatuses summarizes the CronJobs of the Rollout and the Jobs they ran.
+func (r *RolloutReconciler) cronJobStatuses(ctx context.Context, f *oneclickiov1alpha1.Rollout) ([]oneclickiov1alpha1.CronJobStatus, error) {
+	if len(f.Spec.CronJobs) == 0 {
+		return nil, nil
+	}
+
+	jobList := &batchv1.JobList{}
+	if err := r.List(ctx, jobList, client.InNamespace(f.Namespace), client.MatchingLabels{r.label(deploymentIDLabel): f.Name}); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var statuses []oneclickiov1alpha1.CronJobStatus
+	for _, cronJobSpec := range f.Spec.CronJobs {
+		cronJob := &batchv1.CronJob{}
+		if err := r.Get(ctx, types.NamespacedName{Name: naming.CronJob(f.Name, cronJobSpec.Name), Namespace: f.Namespace}, cronJob); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		status := oneclickiov1alpha1.CronJobStatus{
+			Name:               cronJobSpec.Name,
+			LastScheduleTime:   cronJob.Status.LastScheduleTime,
+			LastSuccessfulTime: cronJob.Status.LastSuccessfulTime,
+			Active:             int32(len(cronJob.Status.Active)),
+		}
+
+		// Manual runs are not reflected in the CronJob status, so look at the Jobs
+		for _, job := range jobList.Items {
+			if !metav1.IsControlledBy(&job, cronJob) {
+				continue
+			}
+			for _, condition := range job.Status.Conditions {
+				if condition.Status != corev1.ConditionTrue {
+					continue
+				}
+				switch condition.Type {
+				case batchv1.JobComplete:
+					if status.LastSuccessfulTime == nil || status.LastSuccessfulTime.Before(&condition.LastTransitionTime) {
+						status.LastSuccessfulTime = condition.LastTransitionTime.DeepCopy()
+					}
+				case batchv1.JobFailed:
+					if status.LastFailureTime == nil || status.LastFailureTime.Before(&condition.LastTransitionTime) {
+						status.LastFailureTime = condition.LastTransitionTime.DeepCopy()
+						status.LastFailureReason = strings.TrimSuffix(condition.Reason+": "+condition.Message, ": ")
+					}
+				}
+			}
+		}
+
+		if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+			next, err := nextScheduleTime(cronJob.Spec.Schedule, cronJob.Spec.TimeZone, now)
+			if err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "InvalidSchedule", "Invalid schedule of CronJob %s: %v", cronJob.Name, err)
+			} else {
+				status.NextScheduleTime = &metav1.Time{Time: next}
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// nextScheduleTime returns the first run of a cron schedule after now, in the
+// given time zone or the local one.
+func nextScheduleTime(schedule string, timeZone *string, now time.Time) (time.Time, error) {
+	location := time.Local
+	if timeZone != nil && *timeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(*timeZone); err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %q: %w", *timeZone, err)
+		}
+	}
+
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(now.In(location)), nil
+}
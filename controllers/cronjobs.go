@@ -3,7 +3,7 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -15,40 +15,71 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
 )
 
-func (r *RolloutReconciler) reconcileCronJobs(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+// reconcileCronJobs applies the CronJobs of the Rollout and removes the ones
+// no longer in the spec. pvcNames are the PVC names by volume.
+func (r *RolloutReconciler) reconcileCronJobs(ctx context.Context, f *oneclickiov1alpha1.Rollout, pvcNames map[string]string) error {
 	log := log.FromContext(ctx)
 
-	labels := map[string]string{
-		"one-click.dev/projectId":    f.Namespace,
-		"one-click.dev/deploymentId": f.Name,
-	}
-
 	// Track the CronJobs defined in the Rollout spec
 	definedCronJobs := make(map[string]oneclickiov1alpha1.CronJobSpec)
 	for _, cronJobSpec := range f.Spec.CronJobs {
-		definedCronJobs[cronJobSpec.Name] = cronJobSpec
+		definedCronJobs[naming.CronJob(f.Name, cronJobSpec.Name)] = cronJobSpec
 
 		// Handle image pull secret if username and password are provided
 		var imagePullSecrets []corev1.LocalObjectReference
-		if cronJobSpec.Image.Username != "" && cronJobSpec.Image.Password != "" {
-			secretName := cronJobSpec.Name + "-imagepullsecret"
-			if err := reconcileImagePullSecret(ctx, r.Client, f, cronJobSpec.Image, secretName, f.Namespace); err != nil {
+		inherit := cronJobSpec.InheritFromRollout
+		if inherit != nil && inherit.Image {
+			// The Deployment reconciles the pull secret of the Rollout image
+			if f.Spec.Image.Username != "" && f.Spec.Image.Password != "" {
+				imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{Name: naming.ImagePullSecret(f.Name)})
+			}
+		} else if cronJobSpec.Image.Username != "" && cronJobSpec.Image.Password != "" {
+			secretName := naming.CronJobImagePullSecret(f.Name, cronJobSpec.Name)
+			if err := r.reconcileImagePullSecret(ctx, f, cronJobSpec.Image, secretName); err != nil {
 				return err
 			}
 			imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{Name: secretName})
 		}
 
+		backoffLimit := cronJobSpec.BackoffLimit
+		if backoffLimit == 0 {
+			// honour the deprecated maxRetries
+			backoffLimit = cronJobSpec.MaxRetries
+		}
+		concurrencyPolicy := batchv1.AllowConcurrent
+		if cronJobSpec.ConcurrencyPolicy != "" {
+			concurrencyPolicy = batchv1.ConcurrencyPolicy(cronJobSpec.ConcurrencyPolicy)
+		}
+		// Rollouts stored before the time zone was validated may set an empty
+		// one, which the CronJob API rejects
+		timeZone := cronJobSpec.TimeZone
+		if timeZone != nil && *timeZone == "" {
+			timeZone = nil
+		}
+		restartPolicy := corev1.RestartPolicyNever
+		if cronJobSpec.RestartPolicy != "" {
+			restartPolicy = corev1.RestartPolicy(cronJobSpec.RestartPolicy)
+		}
+
+		labels := r.rolloutLabels(f)
+		labels[r.label(cronJobLabel)] = cronJobSpec.Name
 		cronJob := &batchv1.CronJob{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      cronJobSpec.Name,
+				Name:      naming.CronJob(f.Name, cronJobSpec.Name),
 				Namespace: f.Namespace,
 				Labels:    labels,
 			},
 			Spec: batchv1.CronJobSpec{
-				Suspend:  &cronJobSpec.Suspend,
-				Schedule: cronJobSpec.Schedule,
+				Suspend:                    &cronJobSpec.Suspend,
+				Schedule:                   cronJobSpec.Schedule,
+				TimeZone:                   timeZone,
+				ConcurrencyPolicy:          concurrencyPolicy,
+				StartingDeadlineSeconds:    cronJobSpec.StartingDeadlineSeconds,
+				SuccessfulJobsHistoryLimit: cronJobSpec.SuccessfulJobsHistoryLimit,
+				FailedJobsHistoryLimit:     cronJobSpec.FailedJobsHistoryLimit,
 				JobTemplate: batchv1.JobTemplateSpec{
 					ObjectMeta: metav1.ObjectMeta{
 						Labels: labels,
@@ -56,7 +87,11 @@ func (r *RolloutReconciler) reconcileCronJobs(ctx context.Context, f *oneclickio
 					Spec: batchv1.JobSpec{
 						Template: corev1.PodTemplateSpec{
 							ObjectMeta: metav1.ObjectMeta{
-								Labels: labels,
+								// Not the projectId label, the Service must not select cron job pods
+								Labels: map[string]string{
+									r.label(deploymentIDLabel): f.Name,
+									r.label(cronJobLabel):      cronJobSpec.Name,
+								},
 							},
 							Spec: corev1.PodSpec{
 								Containers: []corev1.Container{
@@ -69,71 +104,240 @@ func (r *RolloutReconciler) reconcileCronJobs(ctx context.Context, f *oneclickio
 										Resources: createResourceRequirements(cronJobSpec.Resources),
 									},
 								},
-								RestartPolicy:    corev1.RestartPolicyNever,
+								RestartPolicy:    restartPolicy,
 								ImagePullSecrets: imagePullSecrets,
 							},
 						},
-						BackoffLimit: &cronJobSpec.BackoffLimit,
+						BackoffLimit:            &backoffLimit,
+						ActiveDeadlineSeconds:   cronJobSpec.ActiveDeadlineSeconds,
+						TTLSecondsAfterFinished: cronJobSpec.TTLSecondsAfterFinished,
 					},
 				},
 			},
 		}
 
+		if inherit != nil {
+			inheritFromRollout(f, inherit, &cronJob.Spec.JobTemplate.Spec.Template.Spec, pvcNames)
+		}
+
 		// Set Rollout instance as the owner and controller
 		if err := ctrl.SetControllerReference(f, cronJob, r.Scheme); err != nil {
 			return err
 		}
 
-		// Check if this CronJob already exists
-		found := &batchv1.CronJob{}
-		err := r.Get(ctx, types.NamespacedName{Name: cronJob.Name, Namespace: cronJob.Namespace}, found)
-		if err != nil && errors.IsNotFound(err) {
-			log.Info("Creating a new CronJob", "CronJob.Namespace", cronJob.Namespace, "CronJob.Name", cronJob.Name)
-			err = r.Create(ctx, cronJob)
-			if err != nil {
-				return err
-			}
-		} else if err != nil {
+		if err := r.applyForRollout(ctx, f, cronJob); err != nil {
 			return err
-		} else {
-			// Update existing CronJob if needed
-			if needsUpdateCronJob(found, cronJob) {
-				found.Spec = cronJob.Spec
-				log.Info("Updating existing CronJob", "CronJob.Namespace", cronJob.Namespace, "CronJob.Name", cronJob.Name)
-				err = r.Update(ctx, found)
-				if err != nil {
-					return err
-				}
-			}
 		}
 	}
 
 	// List all CronJobs in the namespace to find any that are not defined in the Rollout spec
 	var existingCronJobs batchv1.CronJobList
-	if err := r.List(ctx, &existingCronJobs, client.InNamespace(f.Namespace), client.MatchingFields{"metadata.ownerReferences.uid": string(f.UID)}); err != nil {
+	if err := r.List(ctx, &existingCronJobs, client.InNamespace(f.Namespace), client.MatchingFields{ownerUIDIndexKey: string(f.UID)}); err != nil {
 		return err
 	}
 
 	for _, existingCronJob := range existingCronJobs.Items {
 		if _, exists := definedCronJobs[existingCronJob.Name]; !exists {
+			// A CronJob of the former name is replaced once its jobs finished
+			if _, renamed := specCronJob(f, existingCronJob.Name); renamed && len(existingCronJob.Status.Active) > 0 {
+				continue
+			}
 			// CronJob is not defined in the Rollout spec, so delete it
 			log.Info("Deleting CronJob not defined in Rollout spec", "CronJob.Namespace", existingCronJob.Namespace, "CronJob.Name", existingCronJob.Name)
 			if err := r.Delete(ctx, &existingCronJob); err != nil {
 				return err
 			}
+			r.forgetApplied(f, &existingCronJob)
 		}
 	}
 
+	return r.removeLegacyImagePullSecrets(ctx, f)
+}
+
+// specCronJob returns the cron job of the spec with the given name.
+func specCronJob(f *oneclickiov1alpha1.Rollout, name string) (oneclickiov1alpha1.CronJobSpec, bool) {
+	for _, cronJobSpec := range f.Spec.CronJobs {
+		if cronJobSpec.Name == name {
+			return cronJobSpec, true
+		}
+	}
+	return oneclickiov1alpha1.CronJobSpec{}, false
+}
+
+// runCronJobAnnotation on a Rollout runs the named cron job of the spec once,
+// right away.
+const runCronJobAnnotation = "one-click.dev/run-cronjob"
+
+// manualJobAnnotation holds the name of the Job a run-cronjob request creates.
+// It is recorded before the Job is created, so a retry after a failed create
+// or annotation removal reuses the name instead of running the job twice.
+const manualJobAnnotation = "one-click.dev/run-cronjob-job"
+
+// triggerCronJob handles the run-cronjob annotation: it creates a one-off Job
+// from the CronJob template, like `kubectl create job --from`, and removes the
+// annotation again.
+func (r *RolloutReconciler) triggerCronJob(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	name, ok := f.Annotations[runCronJobAnnotation]
+	if !ok {
+		return nil
+	}
+
+	// The CronJob name works as well
+	cronJobName := name
+	if _, ok := specCronJob(f, name); ok {
+		cronJobName = naming.CronJob(f.Name, name)
+	}
+
+	cronJob := &batchv1.CronJob{}
+	err := r.Get(ctx, types.NamespacedName{Name: cronJobName, Namespace: f.Namespace}, cronJob)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get CronJob %s", name)
+		return err
+	}
+
+	if err != nil || !metav1.IsControlledBy(cronJob, f) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "UnknownCronJob", "Cannot run unknown cron job %q", name)
+	} else {
+		jobName := f.Annotations[manualJobAnnotation]
+		if jobName == "" {
+			jobName = naming.ManualJob(cronJob.Name, time.Now().Unix())
+			err := r.patchAnnotations(ctx, f, func(annotations map[string]string) {
+				annotations[manualJobAnnotation] = jobName
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		annotations := map[string]string{"cronjob.kubernetes.io/instantiate": "manual"}
+		for key, value := range cronJob.Spec.JobTemplate.Annotations {
+			annotations[key] = value
+		}
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        jobName,
+				Namespace:   f.Namespace,
+				Labels:      cronJob.Spec.JobTemplate.Labels,
+				Annotations: annotations,
+			},
+			Spec: *cronJob.Spec.JobTemplate.Spec.DeepCopy(),
+		}
+		if err := ctrl.SetControllerReference(cronJob, job, r.Scheme); err != nil {
+			return err
+		}
+		// An existing Job is left from an earlier attempt at this request
+		err := r.Create(ctx, job)
+		switch {
+		case errors.IsAlreadyExists(err):
+		case err != nil:
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Job %s", jobName)
+			return err
+		default:
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "CronJobTriggered", "Created Job %s from CronJob %s", jobName, cronJob.Name)
+		}
+	}
+
+	// Remove the annotations, so the job runs only once
+	return r.patchAnnotations(ctx, f, func(annotations map[string]string) {
+		delete(annotations, runCronJobAnnotation)
+		delete(annotations, manualJobAnnotation)
+	})
+}
+
+// patchAnnotations changes the annotations of the Rollout. The patch is sent
+// from a copy, so the rest of f, such as the status built up by this
+// reconcile, isn't replaced by the server's version.
+func (r *RolloutReconciler) patchAnnotations(ctx context.Context, f *oneclickiov1alpha1.Rollout, change func(map[string]string)) error {
+	obj := f.DeepCopy()
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	change(obj.Annotations)
+	if err := r.Patch(ctx, obj, client.MergeFrom(f)); err != nil {
+		return err
+	}
+	f.Annotations = obj.Annotations
 	return nil
 }
 
-// Helper function to check if the CronJob needs to be updated
-func needsUpdateCronJob(current *batchv1.CronJob, desired *batchv1.CronJob) bool {
-	if !reflect.DeepEqual(current.Spec, desired.Spec) {
-		return true
+// inheritFromRollout applies the selected parts of the Rollout to the pod spec
+// of a cron job. pvcNames are the PVC names by volume.
+func inheritFromRollout(f *oneclickiov1alpha1.Rollout, inherit *oneclickiov1alpha1.CronJobInheritSpec, podSpec *corev1.PodSpec, pvcNames map[string]string) {
+	container := &podSpec.Containers[0]
+
+	if inherit.Image {
+		container.Image = fmt.Sprintf("%s/%s:%s", f.Spec.Image.Registry, f.Spec.Image.Repository, f.Spec.Image.Tag)
+	}
+
+	if inherit.Env {
+		env := getEnvVars(f.Spec.Env)
+		for _, cronJobEnv := range container.Env {
+			replaced := false
+			for i := range env {
+				if env[i].Name == cronJobEnv.Name {
+					env[i] = cronJobEnv
+					replaced = true
+				}
+			}
+			if !replaced {
+				env = append(env, cronJobEnv)
+			}
+		}
+		container.Env = env
+	}
+
+	if inherit.Secrets && len(f.Spec.Secrets) > 0 {
+		container.EnvFrom = []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: naming.Secret(f.Name),
+				},
+			},
+		}}
 	}
-	if !reflect.DeepEqual(current.ObjectMeta.Labels, desired.ObjectMeta.Labels) {
-		return true
+
+	for _, name := range inherit.Volumes {
+		for _, v := range f.Spec.Volumes {
+			if v.Name != name {
+				continue
+			}
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name: naming.Volume(v.Name),
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: pvcNames[v.Name],
+					},
+				},
+			})
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      naming.Volume(v.Name),
+				MountPath: v.MountPath,
+			})
+		}
+	}
+
+	if inherit.ServiceAccount {
+		podSpec.ServiceAccountName = f.Spec.ServiceAccountName
+	}
+
+	if inherit.SecurityContext {
+		podSpec.SecurityContext, container.SecurityContext = securityContextsForRollout(f)
+		if needsTmpVolume(f) {
+			podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+				Name: tmpVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			})
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      tmpVolumeName,
+				MountPath: "/tmp",
+			})
+		}
+	}
+
+	if inherit.Scheduling {
+		podSpec.NodeSelector = f.Spec.NodeSelector
+		podSpec.Tolerations = getTolerations(f.Spec.Tolerations)
 	}
-	return false
 }
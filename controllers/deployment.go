@@ -3,93 +3,87 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"reflect"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
 )
 
-func (r *RolloutReconciler) reconcileDeployment(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+// reconcileDeployment applies the Deployment. secretsChecksum is the checksum
+// of the current secret values, annotated on the pod template, pvcNames are the
+// PVC names by volume. A new pod
+// template waits for the pre-deploy hook and triggers the post-deploy hook once
+// it is rolled out.
+func (r *RolloutReconciler) reconcileDeployment(ctx context.Context, f *oneclickiov1alpha1.Rollout, secretsChecksum string, pvcNames map[string]string) error {
 	log := log.FromContext(ctx)
-	deploymentName := f.Name
-	namespace := f.Namespace
 
-	result := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		currentDeployment := &appsv1.Deployment{}
-		err := r.Get(ctx, types.NamespacedName{Name: deploymentName, Namespace: namespace}, currentDeployment)
-		if err != nil {
-			if errors.IsNotFound(err) {
-				// Deployment not found, create a new one
-				desiredDeployment := r.deploymentForRollout(ctx, f)
-				r.Recorder.Eventf(f, corev1.EventTypeNormal, "Creating", "Creating Deployment %s", deploymentName)
-				return r.Create(ctx, desiredDeployment)
-			}
-			// Other error while fetching the Deployment
-			return err
-		}
+	// Don't run pods with a ServiceAccount or volumes the Rollout does not control
+	if (f.Spec.ServiceAccountName != "" && hasConflict(f, "ServiceAccount")) || hasConflict(f, "PersistentVolumeClaim") {
+		log.Info("Not applying the Deployment, its ServiceAccount or volumes are in conflict")
+		return nil
+	}
+
+	desiredDeployment := r.deploymentForRollout(ctx, f, secretsChecksum, pvcNames)
+	template := desiredDeployment.Spec.Template.DeepCopy()
+	hash := template.Annotations[podTemplateHashAnnotation]
 
-		// Deployment found, check if it needs updating
-		desiredDeployment := r.deploymentForRollout(ctx, f)
-		if needsUpdate(currentDeployment, f) {
-			// ignore the replicas field because it is managed by the HorizontalPodAutoscaler
-			desiredDeployment.Spec.Replicas = currentDeployment.Spec.Replicas
-			// Update the Deployment to align it with the Rollout spec
-			currentDeployment.Spec = desiredDeployment.Spec
-			updateErr := r.Update(ctx, currentDeployment)
-			if updateErr != nil {
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update Deployment %s", deploymentName)
-				return updateErr
-			}
-			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated Deployment %s", deploymentName)
+	// Hold back a new pod template until the pre-deploy hook succeeded
+	currentDeployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, currentDeployment)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if errors.IsNotFound(err) || currentDeployment.Spec.Template.Annotations[podTemplateHashAnnotation] != hash {
+		blocked, err := r.preDeployHookBlocks(ctx, f, template, hash)
+		if err != nil || blocked {
+			return err
 		}
-		return nil
-	})
+	}
 
-	if result != nil {
-		log.Error(result, "Failed to reconcile Deployment", "Deployment.Namespace", namespace, "Deployment.Name", deploymentName)
+	// The replicas are left out, they are managed by the HorizontalPodAutoscaler
+	if err := r.applyForRollout(ctx, f, desiredDeployment); err != nil {
+		log.Error(err, "Failed to reconcile Deployment", "Deployment.Namespace", f.Namespace, "Deployment.Name", f.Name)
+		return err
 	}
 
-	return result
+	return r.reconcilePostDeployHook(ctx, f, template, hash)
 }
 
-func (r *RolloutReconciler) deploymentForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout) *appsv1.Deployment {
-	labels := map[string]string{
-		"one-click.dev/projectId":    f.Namespace,
-		"one-click.dev/deploymentId": f.Name,
-	}
+func (r *RolloutReconciler) deploymentForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout, secretsChecksum string, pvcNames map[string]string) *appsv1.Deployment {
+	labels := r.rolloutLabels(f)
 
 	// Handle image pull secret if username and password are provided
 	var imagePullSecrets []corev1.LocalObjectReference
 	if f.Spec.Image.Username != "" && f.Spec.Image.Password != "" {
-		secretName := f.Name + "-imagepullsecret"
-		if err := reconcileImagePullSecret(ctx, r.Client, f, f.Spec.Image, secretName, f.Namespace); err != nil {
+		secretName := naming.ImagePullSecret(f.Name)
+		if err := r.reconcileImagePullSecret(ctx, f, f.Spec.Image, secretName); err != nil {
 			r.Recorder.Eventf(f, corev1.EventTypeWarning, "ImagePullSecretFailed", "Failed to reconcile Image Pull Secret %s", secretName)
 		} else {
 			imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{Name: secretName})
 		}
 	}
 
-	// Determine the rollout strategy
+	// Determine the rollout strategy. The rolling update parameters are set
+	// explicitly, so they are owned by the operator and removed on a switch to
+	// recreate, which does not allow them.
 	strategy := appsv1.DeploymentStrategy{
-		Type: appsv1.RollingUpdateDeploymentStrategyType,
+		Type: appsv1.RecreateDeploymentStrategyType,
 	}
-
-	if f.Spec.RolloutStrategy != "" {
-		switch f.Spec.RolloutStrategy {
-		case "recreate":
-			strategy.Type = appsv1.RecreateDeploymentStrategyType
-		case "rollingUpdate":
-			strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
-		default:
-			strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
+	if f.Spec.RolloutStrategy != "recreate" {
+		strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
+		strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{
+			MaxUnavailable: ptr.To(intstr.FromString("25%")),
+			MaxSurge:       ptr.To(intstr.FromString("25%")),
 		}
 	}
 
@@ -111,6 +105,7 @@ func (r *RolloutReconciler) deploymentForRollout(ctx context.Context, f *oneclic
 					Containers: []corev1.Container{{
 						Name:      f.Name,
 						Image:     fmt.Sprintf("%s/%s:%s", f.Spec.Image.Registry, f.Spec.Image.Repository, f.Spec.Image.Tag),
+						Ports:     containerPortsForRollout(f),
 						Resources: createResourceRequirements(f.Spec.Resources),
 						Env:       getEnvVars(f.Spec.Env),
 					}},
@@ -135,43 +130,18 @@ func (r *RolloutReconciler) deploymentForRollout(ctx context.Context, f *oneclic
 		dep.Spec.Template.Spec.Containers[0].Command = f.Spec.Command
 	}
 
-	// if security context is defined, add it to the pod security context
-	if !reflect.DeepEqual(f.Spec.SecurityContext, oneclickiov1alpha1.SecurityContextSpec{}) {
-		dep.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{
-			FSGroup:    &f.Spec.SecurityContext.FsGroup,
-			RunAsUser:  &f.Spec.SecurityContext.RunAsUser,
-			RunAsGroup: &f.Spec.SecurityContext.RunAsGroup,
-		}
-
-		capabilities := make([]corev1.Capability, len(f.Spec.SecurityContext.Capabilities.Add))
-		for i, cap := range f.Spec.SecurityContext.Capabilities.Add {
-			capabilities[i] = corev1.Capability(cap)
-		}
+	// Expand the security profile and explicit security settings
+	podSecurityContext, containerSecurityContext := securityContextsForRollout(f)
+	dep.Spec.Template.Spec.SecurityContext = podSecurityContext
+	dep.Spec.Template.Spec.Containers[0].SecurityContext = containerSecurityContext
 
-		dropCapabilities := make([]corev1.Capability, len(f.Spec.SecurityContext.Capabilities.Drop))
-		for i, cap := range f.Spec.SecurityContext.Capabilities.Drop {
-			dropCapabilities[i] = corev1.Capability(cap)
-		}
-
-		dep.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
-			Privileged:               &f.Spec.SecurityContext.Privileged,
-			ReadOnlyRootFilesystem:   &f.Spec.SecurityContext.ReadOnlyRootFilesystem,
-			RunAsNonRoot:             &f.Spec.SecurityContext.RunAsNonRoot,
-			AllowPrivilegeEscalation: &f.Spec.SecurityContext.AllowPrivilegeEscalation,
-			Capabilities: &corev1.Capabilities{
-				Add:  capabilities,
-				Drop: dropCapabilities,
-			},
-		}
-	}
-
-	// if secrets are defined, add the secret f.Name + "-secrets" as envFrom
+	// if secrets are defined, add the <rollout>-secrets Secret as envFrom
 	if len(f.Spec.Secrets) > 0 {
 		dep.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
 			{
 				SecretRef: &corev1.SecretEnvSource{
 					LocalObjectReference: corev1.LocalObjectReference{
-						Name: f.Name + "-secrets",
+						Name: naming.Secret(f.Name),
 					},
 				},
 			},
@@ -179,171 +149,57 @@ func (r *RolloutReconciler) deploymentForRollout(ctx context.Context, f *oneclic
 	}
 
 	// Update volumes and volume mounts
-	if len(f.Spec.Volumes) > 0 {
-		var volumes []corev1.Volume
-		var volumeMounts []corev1.VolumeMount
-		for _, v := range f.Spec.Volumes {
-			volumes = append(volumes, corev1.Volume{
-				Name: v.Name + "-" + f.Name,
-				VolumeSource: corev1.VolumeSource{
-					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-						ClaimName: v.Name + "-" + f.Name,
-					},
-				},
-			})
-			volumeMounts = append(volumeMounts, corev1.VolumeMount{
-				Name:      v.Name + "-" + f.Name,
-				MountPath: v.MountPath,
-			})
+	volumes, volumeMounts := volumesForRollout(f, pvcNames)
+	dep.Spec.Template.Spec.Volumes = volumes
+	dep.Spec.Template.Spec.Containers[0].VolumeMounts = volumeMounts
+
+	// Add secret checksum to pod template annotations to trigger redeployment when secrets change
+	if secretsChecksum != "" {
+		dep.Spec.Template.Annotations = map[string]string{
+			secretsChecksumAnnotation: secretsChecksum,
 		}
-		dep.Spec.Template.Spec.Volumes = volumes
-		dep.Spec.Template.Spec.Containers[0].VolumeMounts = volumeMounts
-	} else {
-		// Handle no volumes case
-		dep.Spec.Template.Spec.Volumes = nil
-		dep.Spec.Template.Spec.Containers[0].VolumeMounts = nil
 	}
 
-	// Add secret checksum to pod template annotations to trigger redeployment when secrets change
-	checksum := calculateSecretsChecksum(f.Spec.Secrets)
+	// Identify the pod template the deploy hooks run for
+	hash := podTemplateHash(dep.Spec.Template)
 	if dep.Spec.Template.Annotations == nil {
 		dep.Spec.Template.Annotations = make(map[string]string)
 	}
-	dep.Spec.Template.Annotations["one-click.dev/secrets-checksum"] = checksum
+	dep.Spec.Template.Annotations[podTemplateHashAnnotation] = hash
 
 	ctrl.SetControllerReference(f, dep, r.Scheme)
 	return dep
 }
 
-func needsUpdate(current *appsv1.Deployment, f *oneclickiov1alpha1.Rollout) bool {
-	// Check security context
-	if !reflect.DeepEqual(current.Spec.Template.Spec.SecurityContext, &corev1.PodSecurityContext{
-		FSGroup:    &f.Spec.SecurityContext.FsGroup,
-		RunAsUser:  &f.Spec.SecurityContext.RunAsUser,
-		RunAsGroup: &f.Spec.SecurityContext.RunAsGroup,
-	}) {
-		return true
-	}
-
-	// Check container security context
-	capabilities := make([]corev1.Capability, len(f.Spec.SecurityContext.Capabilities.Add))
-	for i, cap := range f.Spec.SecurityContext.Capabilities.Add {
-		capabilities[i] = corev1.Capability(cap)
-	}
-
-	dropCapabilities := make([]corev1.Capability, len(f.Spec.SecurityContext.Capabilities.Drop))
-	for i, cap := range f.Spec.SecurityContext.Capabilities.Drop {
-		dropCapabilities[i] = corev1.Capability(cap)
-	}
-
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Containers[0].SecurityContext, &corev1.SecurityContext{
-		Privileged:               &f.Spec.SecurityContext.Privileged,
-		ReadOnlyRootFilesystem:   &f.Spec.SecurityContext.ReadOnlyRootFilesystem,
-		RunAsNonRoot:             &f.Spec.SecurityContext.RunAsNonRoot,
-		AllowPrivilegeEscalation: &f.Spec.SecurityContext.AllowPrivilegeEscalation,
-		Capabilities: &corev1.Capabilities{
-			Add:  capabilities,
-			Drop: dropCapabilities,
-		},
-	}) {
-		return true
-	}
-
-	// Check container image
-	desiredImage := fmt.Sprintf("%s/%s:%s", f.Spec.Image.Registry, f.Spec.Image.Repository, f.Spec.Image.Tag)
-	if len(current.Spec.Template.Spec.Containers) == 0 || current.Spec.Template.Spec.Containers[0].Image != desiredImage {
-		return true
-	}
-
-	// Check secrets
-	if len(f.Spec.Secrets) > 0 {
-		if len(current.Spec.Template.Spec.Containers[0].EnvFrom) == 0 {
-			return true
-		}
-
-		if current.Spec.Template.Spec.Containers[0].EnvFrom[0].SecretRef.LocalObjectReference.Name != f.Name+"-secrets" {
-			return true
-		}
-	} else {
-		if len(current.Spec.Template.Spec.Containers[0].EnvFrom) > 0 {
-			return true
-		}
-	}
-
-	// Check environment variables
-	desiredEnvVars := getEnvVars(f.Spec.Env)
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Containers[0].Env, desiredEnvVars) {
-		return true
-	}
-
-	// Check resource requests and limits
-	desiredResources := createResourceRequirements(f.Spec.Resources)
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Containers[0].Resources, desiredResources) {
-		return true
-	}
-
-	// Check ports
-	if !portsMatch(current.Spec.Template.Spec.Containers[0].Ports, f.Spec.Interfaces) {
-		return true
-	}
-
-	// Check volumes
-	if !volumesMatch(current.Spec.Template.Spec.Volumes, f.Spec.Volumes, f) {
-		return true
-	}
-
-	// Check service account name
-	if current.Spec.Template.Spec.ServiceAccountName != f.Spec.ServiceAccountName {
-		return true
-	}
-
-	// Check command
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Containers[0].Command, f.Spec.Command) {
-		return true
-	}
-
-	// Check args
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Containers[0].Args, f.Spec.Args) {
-		return true
-	}
-
-	// Check rollout strategy
-	strategy := appsv1.DeploymentStrategy{
-		Type: appsv1.RollingUpdateDeploymentStrategyType,
-	}
-	if f.Spec.RolloutStrategy != "" {
-		switch f.Spec.RolloutStrategy {
-		case "recreate":
-			strategy.Type = appsv1.RecreateDeploymentStrategyType
-		case "rollingUpdate":
-			strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
-		default:
-			strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
-		}
-	}
-
-	if !reflect.DeepEqual(current.Spec.Strategy, strategy) {
-		return true
-	}
-
-	// Check node selector
-	if !reflect.DeepEqual(current.Spec.Template.Spec.NodeSelector, f.Spec.NodeSelector) {
-		return true
+// containerPortsForRollout declares a named port for every interface, the
+// Services target them by name.
+func containerPortsForRollout(f *oneclickiov1alpha1.Rollout) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, intf := range f.Spec.Interfaces {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          containerPortName(intf),
+			ContainerPort: intf.Port,
+			Protocol:      interfaceProtocol(intf),
+		})
 	}
+	return ports
+}
 
-	// Check tolerations
-	if !reflect.DeepEqual(current.Spec.Template.Spec.Tolerations, getTolerations(f.Spec.Tolerations)) {
-		return true
+// containerPortName is the interface name, or port-<port> if the name is no
+// valid port name, e.g. longer than 15 characters.
+func containerPortName(intf oneclickiov1alpha1.InterfaceSpec) string {
+	if len(validation.IsValidPortName(intf.Name)) == 0 {
+		return intf.Name
 	}
+	return fmt.Sprintf("port-%d", intf.Port)
+}
 
-	// Check host aliases
-	if !reflect.DeepEqual(current.Spec.Template.Spec.HostAliases, f.Spec.HostAliases) {
-		return true
+// interfaceProtocol returns the protocol of an interface, TCP if unset.
+func interfaceProtocol(intf oneclickiov1alpha1.InterfaceSpec) corev1.Protocol {
+	if intf.Protocol == "" {
+		return corev1.ProtocolTCP
 	}
-
-	// Add more checks as necessary, e.g., labels, annotations, specific configuration, etc.
-
-	return false
+	return corev1.Protocol(intf.Protocol)
 }
 
 func getTolerations(tolerations []corev1.Toleration) []corev1.Toleration {
@@ -360,48 +216,44 @@ func getTolerations(tolerations []corev1.Toleration) []corev1.Toleration {
 	return result
 }
 
-func volumesMatch(currentVolumes []corev1.Volume, desiredVolumes []oneclickiov1alpha1.VolumeSpec, f *oneclickiov1alpha1.Rollout) bool {
-	if len(currentVolumes) != len(desiredVolumes) {
-		return false
-	}
-
-	desiredVolumeMap := make(map[string]oneclickiov1alpha1.VolumeSpec)
-	for _, v := range desiredVolumes {
-		desiredVolumeMap[v.Name+"-"+f.Name] = v
-	}
-
-	for _, currentVolume := range currentVolumes {
-		volSpec, exists := desiredVolumeMap[currentVolume.Name+"-"+f.Name]
-		if !exists {
-			// Volume is present in Deployment but not in Rollout spec
-			return false
-		}
-
-		// Check PVC name
-		if currentVolume.VolumeSource.PersistentVolumeClaim.ClaimName != volSpec.Name+"-"+f.Name {
-			return false
-		}
-		// Additional checks can be added here, such as PVC size, storage class, etc.
-	}
-
-	return true
-}
-
-func portsMatch(currentPorts []corev1.ContainerPort, interfaces []oneclickiov1alpha1.InterfaceSpec) bool {
-	if len(currentPorts) != len(interfaces) {
-		return false
+// volumesForRollout returns the PVC backed volumes of the Rollout, with the
+// PVC names by volume, the secret
+// volumes of mounted secrets and, for a read-only root filesystem, the emptyDir
+// providing a writable /tmp.
+func volumesForRollout(f *oneclickiov1alpha1.Rollout, pvcNames map[string]string) ([]corev1.Volume, []corev1.VolumeMount) {
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	for _, v := range f.Spec.Volumes {
+		volumes = append(volumes, corev1.Volume{
+			Name: naming.Volume(v.Name),
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: pvcNames[v.Name],
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      naming.Volume(v.Name),
+			MountPath: v.MountPath,
+		})
 	}
 
-	for i, intf := range interfaces {
-		if currentPorts[i].ContainerPort != intf.Port {
-			return false
-		}
+	secretVolumes, secretVolumeMounts := secretVolumesForRollout(f)
+	volumes = append(volumes, secretVolumes...)
+	volumeMounts = append(volumeMounts, secretVolumeMounts...)
 
-		// check for name
-		if currentPorts[i].Name != intf.Name {
-			return false
-		}
+	if needsTmpVolume(f) {
+		volumes = append(volumes, corev1.Volume{
+			Name: tmpVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      tmpVolumeName,
+			MountPath: "/tmp",
+		})
 	}
 
-	return true
+	return volumes, volumeMounts
 }
@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+)
+
+const (
+	// cleanupFinalizer holds a deleted Rollout until its resources are cleaned
+	// up according to its deletion policy.
+	cleanupFinalizer = "one-click.dev/cleanup"
+
+	// retainedFromLabel names the label marking PVCs kept after their Rollout
+	// was deleted.
+	retainedFromLabel = "retained-from"
+
+	// deletionRequeueAfter is how often the cleanup checks whether the pods are
+	// gone and the snapshots are ready.
+	deletionRequeueAfter = 5 * time.Second
+	// snapshotsUnavailableRequeueAfter is how often the cleanup checks whether
+	// the VolumeSnapshot API was installed.
+	snapshotsUnavailableRequeueAfter = 5 * time.Minute
+)
+
+// deletionPhaseRanks orders the deletion phases. Steps repeated while the
+// cleanup waits don't move the status back to an earlier phase.
+var deletionPhaseRanks = map[string]int{
+	oneclickiov1alpha1.DeletionScaledToZero:         0,
+	oneclickiov1alpha1.DeletionRemovingTraffic:      1,
+	oneclickiov1alpha1.DeletionStoppingWorkload:     2,
+	oneclickiov1alpha1.DeletionSnapshotting:         3,
+	oneclickiov1alpha1.DeletionSnapshotsUnavailable: 3,
+	oneclickiov1alpha1.DeletionRetainingVolumes:     3,
+	oneclickiov1alpha1.DeletionRemovingVolumes:      4,
+	oneclickiov1alpha1.DeletionRemovingFinalizer:    5,
+}
+
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+// finalizeRollout cleans up a deleted Rollout in order: the traffic is removed
+// first, then the workload is stopped and finally the volumes are snapshotted,
+// retained or deleted. The remaining objects are garbage collected once the
+// finalizer is removed.
+func (r *RolloutReconciler) finalizeRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(f, cleanupFinalizer) {
+		r.forgetApplied(f, nil)
+		return ctrl.Result{}, nil
+	}
+
+	policy := oneclickiov1alpha1.DeletionPolicyDelete
+	if f.Spec.DeletionPolicy != nil && f.Spec.DeletionPolicy.Type != "" {
+		policy = f.Spec.DeletionPolicy.Type
+	}
+
+	// Keep the scaled down objects until the retention expires
+	if policy == oneclickiov1alpha1.DeletionPolicyScaleToZero && f.Spec.DeletionPolicy.RetentionDays != nil {
+		expiresAt := metav1.NewTime(f.DeletionTimestamp.Add(time.Duration(*f.Spec.DeletionPolicy.RetentionDays) * 24 * time.Hour))
+		if remaining := time.Until(expiresAt.Time); remaining > 0 {
+			if err := r.scaleToZero(ctx, f); err != nil {
+				return ctrl.Result{}, err
+			}
+			message := fmt.Sprintf("Scaled to zero, the resources are deleted at %s", expiresAt.UTC().Format(time.RFC3339))
+			if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionScaledToZero, message, &expiresAt); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: remaining}, nil
+		}
+	}
+
+	// Remove the traffic before the workload goes away
+	if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionRemovingTraffic, "Deleting the Ingresses and Services", nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	labels := client.MatchingLabels{r.label(projectIDLabel): f.Namespace, r.label(deploymentIDLabel): f.Name}
+	if err := r.deleteAllForRollout(ctx, f, &networkingv1.Ingress{}, labels); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.deleteAllForRollout(ctx, f, &corev1.Service{}, labels); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Stop the workload and wait for its pods, so the volumes are released
+	if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionStoppingWorkload, "Deleting the Deployment, HPA and CronJobs", nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, obj := range []client.Object{
+		&autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: f.Name, Namespace: f.Namespace}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: f.Name, Namespace: f.Namespace}},
+	} {
+		if err := r.deleteForRollout(ctx, f, obj); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if err := r.deleteAllForRollout(ctx, f, &batchv1.CronJob{}, labels); err != nil {
+		return ctrl.Result{}, err
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(f.Namespace), labels); err != nil {
+		return ctrl.Result{}, err
+	}
+	if len(pods.Items) > 0 {
+		return ctrl.Result{RequeueAfter: deletionRequeueAfter}, nil
+	}
+
+	// Snapshot, retain or delete the volumes
+	pvcs, err := r.pvcsForRollout(ctx, f)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	switch policy {
+	case oneclickiov1alpha1.DeletionPolicyRetainVolumes:
+		if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionRetainingVolumes, "Releasing the PVCs from the Rollout", nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		for i := range pvcs {
+			if err := r.retainPVC(ctx, f, &pvcs[i]); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	case oneclickiov1alpha1.DeletionPolicySnapshot:
+		ready, err := r.snapshotPVCs(ctx, f, pvcs)
+		if meta.IsNoMatchError(err) {
+			// Keep the volumes until the snapshot API is installed or the policy changes
+			if f.Status.Deletion == nil || f.Status.Deletion.Phase != oneclickiov1alpha1.DeletionSnapshotsUnavailable {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "SnapshotsUnavailable", "The cluster has no VolumeSnapshot API, the PVCs are kept until it is installed or the deletion policy changes")
+			}
+			message := "The VolumeSnapshot API is not installed, keeping the PVCs"
+			if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionSnapshotsUnavailable, message, nil); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: snapshotsUnavailableRequeueAfter}, nil
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionSnapshotting, "Waiting for the VolumeSnapshots to be ready", nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		if !ready {
+			return ctrl.Result{RequeueAfter: deletionRequeueAfter}, nil
+		}
+		fallthrough
+	default:
+		if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionRemovingVolumes, "Deleting the PVCs", nil); err != nil {
+			return ctrl.Result{}, err
+		}
+		for i := range pvcs {
+			if err := r.deleteForRollout(ctx, f, &pvcs[i]); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Let the garbage collector delete the remaining Secrets, ServiceAccount
+	// and Jobs with the Rollout
+	if err := r.setDeletionStatus(ctx, f, oneclickiov1alpha1.DeletionRemovingFinalizer, "Deleting the remaining resources", nil); err != nil {
+		return ctrl.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(f, cleanupFinalizer)
+	if err := r.Update(ctx, f); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	r.forgetApplied(f, nil)
+	return ctrl.Result{}, nil
+}
+
+// setDeletionStatus records the cleanup step in the status and as an event,
+// once per step. Steps before the recorded one are not recorded again.
+func (r *RolloutReconciler) setDeletionStatus(ctx context.Context, f *oneclickiov1alpha1.Rollout, phase, message string, expiresAt *metav1.Time) error {
+	status := &oneclickiov1alpha1.DeletionStatus{Phase: phase, Message: message, ExpiresAt: expiresAt}
+	if equality.Semantic.DeepEqual(f.Status.Deletion, status) {
+		return nil
+	}
+	if f.Status.Deletion != nil && deletionPhaseRanks[f.Status.Deletion.Phase] > deletionPhaseRanks[phase] {
+		return nil
+	}
+	original := f.DeepCopy()
+	f.Status.Deletion = status
+	if err := r.Status().Patch(ctx, f, client.MergeFrom(original)); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleting", "%s: %s", phase, message)
+	return nil
+}
+
+// deleteForRollout deletes an object of the Rollout unless it is gone or
+// already being deleted.
+func (r *RolloutReconciler) deleteForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout, obj client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !obj.GetDeletionTimestamp().IsZero() || !metav1.IsControlledBy(obj, f) {
+		return nil
+	}
+	kind := fmt.Sprintf("%T", obj)
+	if gvk, err := r.GroupVersionKindFor(obj); err == nil {
+		kind = gvk.Kind
+	}
+	if err := r.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete %s %s", kind, obj.GetName())
+		return err
+	}
+	r.forgetApplied(f, obj)
+	r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted %s %s", kind, obj.GetName())
+	return nil
+}
+
+// deleteAllForRollout deletes the objects of a kind with the Rollout labels.
+func (r *RolloutReconciler) deleteAllForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout, obj client.Object, labels client.MatchingLabels) error {
+	gvk, err := r.GroupVersionKindFor(obj)
+	if err != nil {
+		return err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := r.List(ctx, list, client.InNamespace(f.Namespace), labels); err != nil {
+		return err
+	}
+	for i := range list.Items {
+		if err := r.deleteForRollout(ctx, f, &list.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pvcsForRollout lists the PVCs owned by the Rollout.
+func (r *RolloutReconciler) pvcsForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout) ([]corev1.PersistentVolumeClaim, error) {
+	pvcList := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcList, client.InNamespace(f.Namespace)); err != nil {
+		return nil, err
+	}
+	var pvcs []corev1.PersistentVolumeClaim
+	for _, pvc := range pvcList.Items {
+		if metav1.IsControlledBy(&pvc, f) {
+			pvcs = append(pvcs, pvc)
+		}
+	}
+	return pvcs, nil
+}
+
+// retainPVC removes the Rollout owner reference from a PVC, so it is not
+// garbage collected, and labels it with the Rollout it was retained from.
+func (r *RolloutReconciler) retainPVC(ctx context.Context, f *oneclickiov1alpha1.Rollout, pvc *corev1.PersistentVolumeClaim) error {
+	original := pvc.DeepCopy()
+	var ownerRefs []metav1.OwnerReference
+	for _, ref := range pvc.OwnerReferences {
+		if ref.UID != f.UID {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	pvc.OwnerReferences = ownerRefs
+	if pvc.Labels == nil {
+		pvc.Labels = make(map[string]string)
+	}
+	pvc.Labels[r.label(retainedFromLabel)] = f.Name
+	if err := r.Patch(ctx, pvc, client.MergeFrom(original)); err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to retain PVC %s", pvc.Name)
+		return err
+	}
+	r.Recorder.Eventf(f, corev1.EventTypeNormal, "Retained", "Retained PVC %s", pvc.Name)
+	return nil
+}
+
+// snapshotPVCs creates a VolumeSnapshot of every PVC and reports whether all
+// of them are ready. The snapshots are not owned by the Rollout, so they
+// outlive it.
+func (r *RolloutReconciler) snapshotPVCs(ctx context.Context, f *oneclickiov1alpha1.Rollout, pvcs []corev1.PersistentVolumeClaim) (bool, error) {
+	ready := true
+	for _, pvc := range pvcs {
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		name := naming.VolumeSnapshot(pvc.Name, f.DeletionTimestamp.UTC().Format("20060102150405"))
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: f.Namespace}, snapshot)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+		if errors.IsNotFound(err) {
+			snapshot.SetName(name)
+			snapshot.SetNamespace(f.Namespace)
+			snapshot.SetLabels(r.rolloutLabels(f))
+			spec := map[string]interface{}{
+				"source": map[string]interface{}{"persistentVolumeClaimName": pvc.Name},
+			}
+			if className := f.Spec.DeletionPolicy.VolumeSnapshotClassName; className != "" {
+				spec["volumeSnapshotClassName"] = className
+			}
+			snapshot.Object["spec"] = spec
+			if err := r.Create(ctx, snapshot); err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create VolumeSnapshot %s", name)
+				return false, err
+			}
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created VolumeSnapshot %s", name)
+			ready = false
+			continue
+		}
+
+		if isReady, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !isReady {
+			if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "SnapshotFailed", "VolumeSnapshot %s failed: %s", name, message)
+			}
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// scaleToZero removes the HPA, scales the Deployment to zero and suspends the
+// CronJobs, keeping all other objects.
+func (r *RolloutReconciler) scaleToZero(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: f.Name, Namespace: f.Namespace}}
+	if err := r.deleteForRollout(ctx, f, hpa); err != nil {
+		return err
+	}
+
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && (deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0) {
+		patch := client.RawPatch(types.MergePatchType, []byte(`{"spec":{"replicas":0}}`))
+		if err := r.Patch(ctx, deployment, patch, client.FieldOwner(fieldManager)); err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to scale Deployment %s to zero", deployment.Name)
+			return err
+		}
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "ScaledToZero", "Scaled Deployment %s to zero", deployment.Name)
+	}
+
+	cronJobs := &batchv1.CronJobList{}
+	if err := r.List(ctx, cronJobs, client.InNamespace(f.Namespace), client.MatchingFields{ownerUIDIndexKey: string(f.UID)}); err != nil {
+		return err
+	}
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+			continue
+		}
+		patch := client.RawPatch(types.MergePatchType, []byte(`{"spec":{"suspend":true}}`))
+		if err := r.Patch(ctx, cronJob, patch, client.FieldOwner(fieldManager)); err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to suspend CronJob %s", cronJob.Name)
+			return err
+		}
+	}
+	return nil
+}
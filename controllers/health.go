@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+)
+
+// failingReasons are container states that do not resolve without a change to
+// the Rollout or the cluster.
+var failingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+	"OOMKilled":                  true,
+}
+
+// podStatuses summarizes the pods of the Deployment.
+func podStatuses(pods []corev1.Pod) []oneclickiov1alpha1.PodStatus {
+	statuses := make([]oneclickiov1alpha1.PodStatus, 0, len(pods))
+	for _, pod := range pods {
+		status := oneclickiov1alpha1.PodStatus{
+			Name:  pod.Name,
+			Phase: string(pod.Status.Phase),
+			Ready: len(pod.Status.ContainerStatuses) > 0,
+			Node:  pod.Spec.NodeName,
+		}
+		if len(pod.Spec.Containers) > 0 {
+			status.Image = pod.Spec.Containers[0].Image
+		}
+		if pod.DeletionTimestamp != nil {
+			status.Phase = "Terminating"
+		}
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			status.Ready = status.Ready && containerStatus.Ready
+			status.Restarts += containerStatus.RestartCount
+			if waiting := containerStatus.State.Waiting; waiting != nil && waiting.Reason != "" && status.Reason == "" {
+				status.Reason = waiting.Reason
+			}
+			if terminated := containerStatus.State.Terminated; terminated != nil && terminated.Reason != "" && status.Reason == "" {
+				status.Reason = terminated.Reason
+			}
+			if terminated := containerStatus.LastTerminationState.Terminated; terminated != nil && status.LastTerminationReason == "" {
+				status.LastTerminationReason = terminated.Reason
+			}
+		}
+		// Unschedulable pods have no container statuses to explain them
+		if status.Reason == "" {
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+					status.Reason = condition.Reason
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// deploymentPods lists the pods of the ReplicaSets of a Deployment. Hook, run
+// and cron job pods share labels with the Deployment pods and may match its
+// selector, but are owned by Jobs.
+func (r *RolloutReconciler) deploymentPods(ctx context.Context, dep *appsv1.Deployment) ([]corev1.Pod, error) {
+	selector := client.MatchingLabels(dep.Spec.Selector.MatchLabels)
+	replicaSets := &appsv1.ReplicaSetList{}
+	if err := r.List(ctx, replicaSets, client.InNamespace(dep.Namespace), selector); err != nil {
+		return nil, err
+	}
+	owned := map[types.UID]bool{}
+	for i := range replicaSets.Items {
+		if metav1.IsControlledBy(&replicaSets.Items[i], dep) {
+			owned[replicaSets.Items[i].UID] = true
+		}
+	}
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(dep.Namespace), selector); err != nil {
+		return nil, err
+	}
+	pods := make([]corev1.Pod, 0, len(podList.Items))
+	for _, pod := range podList.Items {
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owned[owner.UID] {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// deploymentHealth derives the overall phase of a Deployment from its
+// conditions, replica counts and the container states of its pods.
+func deploymentHealth(dep *appsv1.Deployment, pods []oneclickiov1alpha1.PodStatus) (phase, reason, message string) {
+	desired := int32(1)
+	if dep.Spec.Replicas != nil {
+		desired = *dep.Spec.Replicas
+	}
+
+	if dep.Spec.Paused {
+		return oneclickiov1alpha1.DeploymentSuspended, "Paused", "The Deployment is paused"
+	}
+	if desired == 0 {
+		return oneclickiov1alpha1.DeploymentSuspended, "ScaledToZero", "The Deployment is scaled to zero"
+	}
+
+	for _, condition := range dep.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return oneclickiov1alpha1.DeploymentFailed, condition.Reason, condition.Message
+		}
+		if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue {
+			return oneclickiov1alpha1.DeploymentFailed, condition.Reason, condition.Message
+		}
+	}
+
+	// Pods that won't recover on their own fail the Deployment if nothing is
+	// available, and degrade it otherwise
+	for _, pod := range pods {
+		failing := failingReasons[pod.Reason]
+		if !failing && pod.Restarts > 0 && !pod.Ready && failingReasons[pod.LastTerminationReason] {
+			failing = true
+			pod.Reason = pod.LastTerminationReason
+		}
+		if !failing {
+			continue
+		}
+		message = fmt.Sprintf("Pod %s is %s", pod.Name, pod.Reason)
+		if dep.Status.AvailableReplicas == 0 {
+			return oneclickiov1alpha1.DeploymentFailed, pod.Reason, message
+		}
+		return oneclickiov1alpha1.DeploymentDegraded, pod.Reason, message
+	}
+
+	if dep.Status.ObservedGeneration < dep.Generation || dep.Status.UpdatedReplicas < desired || dep.Status.Replicas > dep.Status.UpdatedReplicas {
+		return oneclickiov1alpha1.DeploymentProgressing, "RollingOut",
+			fmt.Sprintf("%d of %d replicas updated, %d available", dep.Status.UpdatedReplicas, desired, dep.Status.AvailableReplicas)
+	}
+
+	for _, condition := range dep.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable && condition.Status == corev1.ConditionFalse {
+			return oneclickiov1alpha1.DeploymentDegraded, condition.Reason, condition.Message
+		}
+	}
+	if dep.Status.AvailableReplicas < desired {
+		return oneclickiov1alpha1.DeploymentDegraded, "ReplicasUnavailable",
+			fmt.Sprintf("%d of %d replicas available", dep.Status.AvailableReplicas, desired)
+	}
+
+	return oneclickiov1alpha1.DeploymentHealthy, "", ""
+}
+
+// rolloutForPod maps a pod of the Deployment to its Rollout by the
+// deploymentId label.
+func (r *RolloutReconciler) rolloutForPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()[r.label(deploymentIDLabel)]
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: obj.GetNamespace()}}}
+}
+
+// podHealthChanged passes pod updates that change what the status reports,
+// ignoring the frequent updates that don't, e.g. of condition timestamps.
+var podHealthChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPod, ok := e.ObjectOld.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		newPod, ok := e.ObjectNew.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		return !reflect.DeepEqual(podStatuses([]corev1.Pod{*oldPod}), podStatuses([]corev1.Pod{*newPod}))
+	},
+}
@@ -6,12 +6,8 @@ import (
 	"encoding/json"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/util/retry"
-	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
@@ -41,7 +37,7 @@ func createResourceRequirements(resources oneclickiov1alpha1.ResourceRequirement
 	}
 }
 
-func reconcileImagePullSecret(ctx context.Context, client client.Client, instance *oneclickiov1alpha1.Rollout, imageSpec oneclickiov1alpha1.ImageSpec, secretName string, namespace string) error {
+func (r *RolloutReconciler) reconcileImagePullSecret(ctx context.Context, instance *oneclickiov1alpha1.Rollout, imageSpec oneclickiov1alpha1.ImageSpec, secretName string) error {
 	auth := base64.StdEncoding.EncodeToString([]byte(imageSpec.Username + ":" + imageSpec.Password))
 	dockerConfigEntry := map[string]interface{}{
 		"username": imageSpec.Username,
@@ -65,31 +61,17 @@ func reconcileImagePullSecret(ctx context.Context, client client.Client, instanc
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      secretName,
-			Namespace: namespace,
+			Namespace: instance.Namespace,
+			Labels:    r.rolloutLabels(instance),
 		},
 		Type: corev1.SecretTypeDockerConfigJson,
 		Data: secretData,
 	}
 
 	// Set the owner reference
-	if err := controllerutil.SetControllerReference(instance, secret, client.Scheme()); err != nil {
+	if err := controllerutil.SetControllerReference(instance, secret, r.Scheme); err != nil {
 		return err
 	}
 
-	// Check if secret already exists, if not, create it
-	foundSecret := &corev1.Secret{}
-	err = client.Get(ctx, types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, foundSecret)
-	if err != nil && errors.IsNotFound(err) {
-		// Secret not found, create it
-		return client.Create(ctx, secret)
-	} else if err != nil {
-		// Error occurred while checking for secret
-		return err
-	}
-
-	// Secret found, update it
-	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		foundSecret.Data = secretData
-		return client.Update(ctx, foundSecret)
-	})
+	return r.applyForRollout(ctx, instance, secret)
 }
@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+)
+
+const (
+	// ConditionHooksSucceeded reports the outcome of the hooks of the current
+	// pod template.
+	ConditionHooksSucceeded = "HooksSucceeded"
+
+	// podTemplateHashAnnotation identifies the pod template hooks ran for.
+	podTemplateHashAnnotation = "one-click.dev/pod-template-hash"
+	// hookForLabel names the label marking hook jobs and pods with their
+	// Rollout. Hook pods do not carry the Rollout labels, so the Service never
+	// selects them.
+	hookForLabel = "hook-for"
+
+	// maxHookHistory is the number of hook runs kept in the status.
+	maxHookHistory = 10
+)
+
+// podTemplateHash returns a short hash identifying a pod template.
+func podTemplateHash(template corev1.PodTemplateSpec) string {
+	data, _ := json.Marshal(template)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// preDeployHookBlocks runs the pre-deploy hook for a new pod template and
+// reports whether the Deployment update has to wait. A running hook blocks
+// until it finished, a failed one until the pod template changes.
+func (r *RolloutReconciler) preDeployHookBlocks(ctx context.Context, f *oneclickiov1alpha1.Rollout, template *corev1.PodTemplateSpec, hash string) (bool, error) {
+	if f.Spec.Hooks == nil {
+		return false, nil
+	}
+
+	// A rolled back pod template stays rolled back
+	if post := f.Spec.Hooks.PostDeploy; post != nil && post.Rollback {
+		if run := hookRun(f, oneclickiov1alpha1.HookPostDeploy, hash); run != nil && run.Phase == oneclickiov1alpha1.HookFailed {
+			return true, nil
+		}
+	}
+
+	hook := f.Spec.Hooks.PreDeploy
+	if hook == nil {
+		return false, nil
+	}
+
+	phase, err := r.runHook(ctx, f, oneclickiov1alpha1.HookPreDeploy, hook, template, hash)
+	if err != nil {
+		return true, err
+	}
+	switch phase {
+	case oneclickiov1alpha1.HookSucceeded:
+		if f.Spec.Hooks.PostDeploy == nil {
+			setHooksCondition(f, metav1.ConditionTrue, "Succeeded", "The pre-deploy hook succeeded")
+		}
+		return false, nil
+	case oneclickiov1alpha1.HookFailed:
+		setHooksCondition(f, metav1.ConditionFalse, "PreDeployFailed", "The pre-deploy hook failed, the Deployment is not updated")
+	default:
+		setHooksCondition(f, metav1.ConditionUnknown, "PreDeployRunning", "Waiting for the pre-deploy hook")
+	}
+	return true, nil
+}
+
+// reconcilePostDeployHook runs the post-deploy hook once the pod template is
+// rolled out and rolls back to the previous pod template if it fails.
+func (r *RolloutReconciler) reconcilePostDeployHook(ctx context.Context, f *oneclickiov1alpha1.Rollout, template *corev1.PodTemplateSpec, hash string) error {
+	if f.Spec.Hooks == nil || f.Spec.Hooks.PostDeploy == nil {
+		return nil
+	}
+	hook := f.Spec.Hooks.PostDeploy
+
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	// Wait until the pod template is fully rolled out
+	if deployment.Spec.Template.Annotations[podTemplateHashAnnotation] != hash || !deploymentRolledOut(deployment) {
+		return nil
+	}
+
+	// runHook updates the recorded run in place, keep the phase it had before
+	var previousPhase string
+	if run := hookRun(f, oneclickiov1alpha1.HookPostDeploy, hash); run != nil {
+		previousPhase = run.Phase
+	}
+	phase, err := r.runHook(ctx, f, oneclickiov1alpha1.HookPostDeploy, hook, template, hash)
+	if err != nil {
+		return err
+	}
+	switch phase {
+	case oneclickiov1alpha1.HookSucceeded:
+		setHooksCondition(f, metav1.ConditionTrue, "Succeeded", "The deploy hooks succeeded")
+	case oneclickiov1alpha1.HookFailed:
+		// The failure was handled when it was first recorded
+		if previousPhase == oneclickiov1alpha1.HookFailed {
+			return nil
+		}
+		if !hook.Rollback {
+			setHooksCondition(f, metav1.ConditionFalse, "PostDeployFailed", "The post-deploy hook failed")
+			return nil
+		}
+		revision, err := r.rollbackDeployment(ctx, f, deployment, hash)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			setHooksCondition(f, metav1.ConditionFalse, "PostDeployFailed", "The post-deploy hook failed, there is no previous revision to roll back to")
+		} else {
+			setHooksCondition(f, metav1.ConditionFalse, "PostDeployFailed", fmt.Sprintf("The post-deploy hook failed, rolled back to revision %d", revision))
+		}
+	default:
+		setHooksCondition(f, metav1.ConditionUnknown, "PostDeployRunning", "Waiting for the post-deploy hook")
+	}
+	return nil
+}
+
+// runHook starts the hook job for a pod template unless it exists, records it
+// in the hook history and returns its phase.
+func (r *RolloutReconciler) runHook(ctx context.Context, f *oneclickiov1alpha1.Rollout, hookType string, hook *oneclickiov1alpha1.HookSpec, template *corev1.PodTemplateSpec, hash string) (string, error) {
+	// Finished runs are not repeated, even if their Job is gone
+	run := hookRun(f, hookType, hash)
+	if run != nil && run.Phase != oneclickiov1alpha1.HookRunning {
+		return run.Phase, nil
+	}
+
+	desired, err := r.jobForHook(f, hookType, hook, template, hash)
+	if err != nil {
+		return "", err
+	}
+
+	job := &batchv1.Job{}
+	err = r.getUncached(ctx, types.NamespacedName{Name: desired.Name, Namespace: f.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		if err := r.Create(ctx, desired); err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create hook Job %s", desired.Name)
+			return "", err
+		}
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "HookStarted", "Started %s hook Job %s", hookType, desired.Name)
+		job = desired
+	} else if err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get hook Job %s", desired.Name)
+		return "", err
+	}
+
+	status := oneclickiov1alpha1.HookStatus{
+		Type:      hookType,
+		Hash:      hash,
+		JobName:   job.Name,
+		Image:     job.Spec.Template.Spec.Containers[0].Image,
+		Phase:     oneclickiov1alpha1.HookRunning,
+		StartTime: job.Status.StartTime,
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			status.Phase = oneclickiov1alpha1.HookSucceeded
+			status.CompletionTime = condition.LastTransitionTime.DeepCopy()
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "HookSucceeded", "%s hook Job %s succeeded", hookType, job.Name)
+		case batchv1.JobFailed:
+			status.Phase = oneclickiov1alpha1.HookFailed
+			status.Message = strings.TrimSuffix(condition.Reason+": "+condition.Message, ": ")
+			status.CompletionTime = condition.LastTransitionTime.DeepCopy()
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "HookFailed", "%s hook Job %s failed: %s", hookType, job.Name, status.Message)
+		}
+	}
+
+	recordHookRun(f, status)
+	return status.Phase, r.pruneHookJobs(ctx, f)
+}
+
+// jobForHook builds a hook Job from the new pod template, running the hook
+// command instead of the app.
+func (r *RolloutReconciler) jobForHook(f *oneclickiov1alpha1.Rollout, hookType string, hook *oneclickiov1alpha1.HookSpec, template *corev1.PodTemplateSpec, hash string) (*batchv1.Job, error) {
+	kind := "pre"
+	if hookType == oneclickiov1alpha1.HookPostDeploy {
+		kind = "post"
+	}
+	name := naming.HookJob(f.Name, kind, hash)
+
+	podSpec := template.Spec.DeepCopy()
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+	container := &podSpec.Containers[0]
+	container.Name = strings.ToLower(hookType)
+	container.Ports = nil
+	container.LivenessProbe = nil
+	container.ReadinessProbe = nil
+	container.StartupProbe = nil
+	container.Lifecycle = nil
+	if len(hook.Command) > 0 {
+		container.Command = hook.Command
+	}
+	if len(hook.Args) > 0 {
+		container.Args = hook.Args
+	}
+	if hook.Resources != nil {
+		container.Resources = createResourceRequirements(*hook.Resources)
+	}
+	for _, hookEnv := range getEnvVars(hook.Env) {
+		replaced := false
+		for i := range container.Env {
+			if container.Env[i].Name == hookEnv.Name {
+				container.Env[i] = hookEnv
+				replaced = true
+			}
+		}
+		if !replaced {
+			container.Env = append(container.Env, hookEnv)
+		}
+	}
+
+	backoffLimit := int32(0)
+	if hook.BackoffLimit != nil {
+		backoffLimit = *hook.BackoffLimit
+	}
+
+	labels := map[string]string{r.label(hookForLabel): f.Name}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: f.Namespace,
+			Labels: map[string]string{
+				r.label(projectIDLabel):    f.Namespace,
+				r.label(deploymentIDLabel): f.Name,
+				r.label(hookForLabel):      f.Name,
+				r.label(hookLabel):         hookType,
+			},
+			Annotations: map[string]string{podTemplateHashAnnotation: hash},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: hook.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: *podSpec,
+			},
+		},
+	}
+
+	if err := ctrl.SetControllerReference(f, job, r.Scheme); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// rollbackDeployment restores the newest pod template of the Deployment other
+// than the failed one, like `kubectl rollout undo`. It returns the revision
+// rolled back to, zero if there is no previous revision.
+func (r *RolloutReconciler) rollbackDeployment(ctx context.Context, f *oneclickiov1alpha1.Rollout, deployment *appsv1.Deployment, failedHash string) (int64, error) {
+	replicaSets := &appsv1.ReplicaSetList{}
+	if err := r.List(ctx, replicaSets, client.InNamespace(f.Namespace), client.MatchingLabels(deployment.Spec.Selector.MatchLabels)); err != nil {
+		return 0, err
+	}
+
+	var previous *appsv1.ReplicaSet
+	var previousRevision int64
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if !metav1.IsControlledBy(rs, deployment) || rs.Spec.Template.Annotations[podTemplateHashAnnotation] == failedHash {
+			continue
+		}
+		revision, err := strconv.ParseInt(rs.Annotations["deployment.kubernetes.io/revision"], 10, 64)
+		if err == nil && revision > previousRevision {
+			previous, previousRevision = rs, revision
+		}
+	}
+	if previous == nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "RollbackFailed", "No previous revision of Deployment %s to roll back to", deployment.Name)
+		return 0, nil
+	}
+
+	// Patch as the operator, so the next apply owns the restored fields again
+	template := previous.Spec.Template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	patch := client.MergeFromWithOptions(deployment.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	deployment.Spec.Template = *template
+	if err := r.Patch(ctx, deployment, patch, client.FieldOwner(fieldManager)); err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to roll back Deployment %s", deployment.Name)
+		return 0, err
+	}
+	r.Recorder.Eventf(f, corev1.EventTypeWarning, "RolledBack", "Rolled back Deployment %s to revision %d after the post-deploy hook failed", deployment.Name, previousRevision)
+	return previousRevision, nil
+}
+
+// pruneHookJobs deletes the hook Jobs that dropped out of the hook history.
+func (r *RolloutReconciler) pruneHookJobs(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(f.Namespace), client.MatchingLabels{r.label(hookForLabel): f.Name}); err != nil {
+		return err
+	}
+
+	kept := map[string]bool{}
+	for _, run := range f.Status.Hooks {
+		kept[run.JobName] = true
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if kept[job.Name] || !metav1.IsControlledBy(job, f) {
+			continue
+		}
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete hook Job %s", job.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// hookRun returns the recorded run of a hook for a pod template.
+func hookRun(f *oneclickiov1alpha1.Rollout, hookType, hash string) *oneclickiov1alpha1.HookStatus {
+	for i := range f.Status.Hooks {
+		if f.Status.Hooks[i].Type == hookType && f.Status.Hooks[i].Hash == hash {
+			return &f.Status.Hooks[i]
+		}
+	}
+	return nil
+}
+
+// recordHookRun updates or prepends a run in the hook history.
+func recordHookRun(f *oneclickiov1alpha1.Rollout, status oneclickiov1alpha1.HookStatus) {
+	if run := hookRun(f, status.Type, status.Hash); run != nil {
+		*run = status
+		return
+	}
+	f.Status.Hooks = append([]oneclickiov1alpha1.HookStatus{status}, f.Status.Hooks...)
+	if len(f.Status.Hooks) > maxHookHistory {
+		f.Status.Hooks = f.Status.Hooks[:maxHookHistory]
+	}
+}
+
+func setHooksCondition(f *oneclickiov1alpha1.Rollout, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+		Type:               ConditionHooksSucceeded,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: f.Generation,
+	})
+}
+
+// deploymentRolledOut reports whether all replicas run the current pod template.
+func deploymentRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.AvailableReplicas == replicas &&
+		deployment.Status.Replicas == replicas
+}
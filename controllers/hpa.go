@@ -2,15 +2,15 @@ package controllers
 
 import (
 	"context"
-	"reflect"
+	"fmt"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
@@ -22,71 +22,18 @@ func (r *RolloutReconciler) reconcileHPA(ctx context.Context, f *oneclickiov1alp
 		return err
 	}
 
-	// Try to fetch the existing HPA
-	foundHpa := &autoscalingv2.HorizontalPodAutoscaler{}
-	err = r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, foundHpa)
-	if err != nil && errors.IsNotFound(err) {
-		// If the HPA is not found, create a new one
-		err = r.Create(ctx, desiredHpa)
-		if err != nil {
-			// Handle creation error
-			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create HPA %s", f.Name)
-			return err
-		}
-		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created HPA %s", f.Name)
-	} else if err != nil {
-		// Handle other errors
-		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get HPA %s", f.Name)
-		return err
-	} else {
-		// If the HPA exists, check if it needs to be updated
-		if needsHpaUpdate(foundHpa, f) {
-			updateHpa(foundHpa, f)
-			err = r.Update(ctx, foundHpa)
-			if err != nil {
-				// Handle update error
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update HPA %s", foundHpa.Name)
-				return err
-			}
-			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated HPA %s", foundHpa.Name)
-		}
-	}
-
-	return nil
+	return r.applyForRollout(ctx, f, desiredHpa)
 }
 
 func (r *RolloutReconciler) hpaForRollout(f *oneclickiov1alpha1.Rollout) (*autoscalingv2.HorizontalPodAutoscaler, error) {
-	// construct Behavior default values
-	ScaleUpBehavior := &autoscalingv2.HorizontalPodAutoscalerBehavior{
-		ScaleUp: &autoscalingv2.HPAScalingRules{
-			StabilizationWindowSeconds: ptr.To(int32(0)),
-			Policies: []autoscalingv2.HPAScalingPolicy{
-				{
-					Type:          autoscalingv2.PercentScalingPolicy,
-					Value:         100,
-					PeriodSeconds: 15,
-				},
-			},
-		},
-		ScaleDown: &autoscalingv2.HPAScalingRules{
-			StabilizationWindowSeconds: ptr.To(int32(300)),
-			Policies: []autoscalingv2.HPAScalingPolicy{
-				{
-					Type:          autoscalingv2.PercentScalingPolicy,
-					Value:         100,
-					PeriodSeconds: 60,
-				},
-			},
-		},
-	}
-
 	hpa := &autoscalingv2.HorizontalPodAutoscaler{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      f.Name,
 			Namespace: f.Namespace,
+			Labels:    r.rolloutLabels(f),
 		},
 		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
-			Behavior: ScaleUpBehavior,
+			Behavior: r.Config.Get().Defaults.HPABehavior.DeepCopy(),
 			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
 				APIVersion: "apps/v1",
 				Kind:       "Deployment",
@@ -114,17 +61,54 @@ func (r *RolloutReconciler) hpaForRollout(f *oneclickiov1alpha1.Rollout) (*autos
 	return hpa, nil
 }
 
-func needsHpaUpdate(current *autoscalingv2.HorizontalPodAutoscaler, f *oneclickiov1alpha1.Rollout) bool {
-	return !reflect.DeepEqual(current.Spec, f.Spec)
-}
+// autoscalerStatus reports the replicas and metric values of the HPA, nil if
+// it does not exist yet.
+func (r *RolloutReconciler) autoscalerStatus(ctx context.Context, f *oneclickiov1alpha1.Rollout) (*oneclickiov1alpha1.AutoscalerStatus, error) {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, hpa); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
 
-func updateHpa(hpa *autoscalingv2.HorizontalPodAutoscaler, f *oneclickiov1alpha1.Rollout) {
-	// Update MinReplicas
-	hpa.Spec.MinReplicas = &f.Spec.HorizontalScale.MinReplicas
+	status := &oneclickiov1alpha1.AutoscalerStatus{
+		Name:            hpa.Name,
+		CurrentReplicas: hpa.Status.CurrentReplicas,
+		DesiredReplicas: hpa.Status.DesiredReplicas,
+		MaxReplicas:     hpa.Spec.MaxReplicas,
+		LastScaleTime:   hpa.Status.LastScaleTime,
+	}
+	if hpa.Spec.MinReplicas != nil {
+		status.MinReplicas = *hpa.Spec.MinReplicas
+	}
 
-	// Update MaxReplicas
-	hpa.Spec.MaxReplicas = f.Spec.HorizontalScale.MaxReplicas
+	for _, metric := range hpa.Spec.Metrics {
+		if metric.Type != autoscalingv2.ResourceMetricSourceType || metric.Resource == nil {
+			continue
+		}
+		metricStatus := oneclickiov1alpha1.AutoscalerMetricStatus{
+			Name:   string(metric.Resource.Name),
+			Target: formatMetricValue(metric.Resource.Target.AverageUtilization, metric.Resource.Target.AverageValue),
+		}
+		for _, current := range hpa.Status.CurrentMetrics {
+			if current.Type == autoscalingv2.ResourceMetricSourceType && current.Resource != nil && current.Resource.Name == metric.Resource.Name {
+				metricStatus.Current = formatMetricValue(current.Resource.Current.AverageUtilization, current.Resource.Current.AverageValue)
+			}
+		}
+		status.Metrics = append(status.Metrics, metricStatus)
+	}
 
-	// Update TargetCPUUtilizationPercentage
-	hpa.Spec.Metrics[0].Resource.Target.AverageUtilization = &f.Spec.HorizontalScale.TargetCPUUtilizationPercentage
+	return status, nil
+}
+
+// formatMetricValue formats a utilization as percentage, or else the value.
+func formatMetricValue(utilization *int32, value *resource.Quantity) string {
+	if utilization != nil {
+		return fmt.Sprintf("%d%%", *utilization)
+	}
+	if value != nil {
+		return value.String()
+	}
+	return ""
 }
@@ -2,14 +2,14 @@ package controllers
 
 import (
 	"context"
-	"reflect"
+	"strings"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -18,70 +18,57 @@ import (
 func (r *RolloutReconciler) reconcileIngress(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
 	log := log.FromContext(ctx)
 
-	// Track the ingresses that should exist based on the Rollout spec
-	expectedIngresses := make(map[string]bool)
-	for _, intf := range f.Spec.Interfaces {
-		// Process each interface
-		if intf.Ingress.IngressClass != "" || len(intf.Ingress.Rules) > 0 {
-			expectedIngresses[intf.Name+"-"+f.Name+"-ingress"] = true
-			ingress := r.ingressForRollout(f, intf)
+	// Reconcile the objects backing the typed ingress features first, so the
+	// ingress never references a missing secret or middleware
+	if err := r.reconcileBasicAuthSecrets(ctx, f); err != nil {
+		return err
+	}
+	if err := r.reconcileTraefikMiddlewares(ctx, f); err != nil {
+		return err
+	}
 
-			foundIngress := &networkingv1.Ingress{}
-			err := r.Get(ctx, types.NamespacedName{Name: ingress.Name, Namespace: f.Namespace}, foundIngress)
-			if err != nil && errors.IsNotFound(err) {
-				err = r.Create(ctx, ingress)
-				if err != nil {
-					// Handle creation error
-					r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Ingress %s", ingress.Name)
-					return err
-				}
-				r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created Ingress %s", ingress.Name)
-			} else if err != nil {
-				// Handle other errors
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Ingress %s", ingress.Name)
-				return err
-			} else {
-				// If the Ingress exists, check if it needs to be updated
-				updateNeeded := false
+	// Fill in the generated hosts of interfaces with autoHost enabled
+	interfaces, err := r.resolveAutoHosts(ctx, f)
+	if err != nil {
+		return err
+	}
 
-				if intf.Ingress.IngressClass != "" {
-					if foundIngress.Spec.IngressClassName == nil || *foundIngress.Spec.IngressClassName != intf.Ingress.IngressClass {
-						foundIngress.Spec.IngressClassName = &intf.Ingress.IngressClass
-						updateNeeded = true
-					}
-				}
+	// Drop the rules for hosts/paths an older Rollout already claims
+	interfaces, err = r.removeConflictingRules(ctx, f, interfaces)
+	if err != nil {
+		return err
+	}
 
-				// Check for rules and TLS changes
-				desiredRules := getIngressRules(f, intf)
-				desiredTLS := getIngressTLS(f, intf)
-				if !reflect.DeepEqual(foundIngress.Spec.Rules, desiredRules) || !reflect.DeepEqual(foundIngress.Spec.TLS, desiredTLS) {
-					foundIngress.Spec.Rules = desiredRules
-					foundIngress.Spec.TLS = desiredTLS
-					updateNeeded = true
-				}
+	// Track the ingresses that should exist based on the Rollout spec
+	expectedIngresses := make(map[string]bool)
+	for _, intf := range interfaces {
+		// Process each interface, an ingress without any (unconflicted) rule is invalid
+		if hasIngress(intf) && len(intf.Ingress.Rules) > 0 {
+			expectedIngresses[ingressName(f, intf)] = true
+			ingress := r.ingressForRollout(f, intf)
 
-				// Check for changes in Annotations
-				if !reflect.DeepEqual(foundIngress.Annotations, intf.Ingress.Annotations) {
-					foundIngress.Annotations = intf.Ingress.Annotations
-					updateNeeded = true
-				}
+			if _, unsupported := r.ingressFeatureAnnotations(f, intf); len(unsupported) > 0 {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UnsupportedIngressFeature", "Ingress %s: %s not supported by the %s ingress controller", ingress.Name, strings.Join(unsupported, ", "), r.ingressControllerFlavour())
+			}
+			if _, ok := maxBodySizeBytes(intf.Ingress.MaxBodySize); !ok && intf.Ingress.MaxBodySize != "" {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "InvalidIngressFeature", "Ingress %s: invalid maxBodySize %q", ingress.Name, intf.Ingress.MaxBodySize)
+			}
 
-				// Update the Ingress if necessary
-				if updateNeeded {
-					err = r.Update(ctx, foundIngress)
-					if err != nil {
-						r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update Ingress %s", foundIngress.Name)
-						return err
-					}
-					r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated Ingress %s", foundIngress.Name)
-				}
+			if err := r.copyLegacyTLSSecret(ctx, f, intf); err != nil {
+				return err
+			}
+			if err := r.removeLegacyIngress(ctx, f, intf); err != nil {
+				return err
+			}
+			if err := r.applyForRollout(ctx, f, ingress); err != nil {
+				return err
 			}
 		} else {
 			// No Ingress configuration for this interface, delete the Ingress if it exists
-			if _, exists := expectedIngresses[intf.Name+"-"+f.Name+"-ingress"]; exists {
+			if _, exists := expectedIngresses[ingressName(f, intf)]; exists {
 				ingress := &networkingv1.Ingress{
 					ObjectMeta: metav1.ObjectMeta{
-						Name:      intf.Name + "-" + f.Name + "-ingress",
+						Name:      ingressName(f, intf),
 						Namespace: f.Namespace,
 					},
 				}
@@ -90,6 +77,7 @@ func (r *RolloutReconciler) reconcileIngress(ctx context.Context, f *oneclickiov
 					r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Ingress %s", ingress.Name)
 					return err
 				}
+				r.forgetApplied(f, ingress)
 				r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Ingress %s", ingress.Name)
 			}
 		}
@@ -98,7 +86,7 @@ func (r *RolloutReconciler) reconcileIngress(ctx context.Context, f *oneclickiov
 	// Delete ingresses that are no longer specified
 	ingressList := &networkingv1.IngressList{}
 	listOpts := []client.ListOption{client.InNamespace(f.Namespace)}
-	err := r.List(ctx, ingressList, listOpts...)
+	err = r.List(ctx, ingressList, listOpts...)
 	if err != nil {
 		log.Error(err, "Failed to list Ingresses", "Rollout.Namespace", f.Namespace)
 		return err
@@ -107,12 +95,13 @@ func (r *RolloutReconciler) reconcileIngress(ctx context.Context, f *oneclickiov
 	for _, ingress := range ingressList.Items {
 		if _, exists := expectedIngresses[ingress.Name]; !exists {
 			// Ingress is no longer needed, delete it
-			if ingress.Labels["one-click.dev/projectId"] == f.Namespace && ingress.Labels["one-click.dev/deploymentId"] == f.Name {
+			if metav1.IsControlledBy(&ingress, f) {
 				err = r.Delete(ctx, &ingress)
 				if err != nil {
 					r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Ingress %s", ingress.Name)
 					return err
 				}
+				r.forgetApplied(f, &ingress)
 				r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Ingress %s", ingress.Name)
 			}
 		}
@@ -123,13 +112,10 @@ func (r *RolloutReconciler) reconcileIngress(ctx context.Context, f *oneclickiov
 
 func (r *RolloutReconciler) ingressForRollout(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) *networkingv1.Ingress {
 	// the name of the namespace is the project name
-	labels := map[string]string{
-		"one-click.dev/projectId":    f.Namespace,
-		"one-click.dev/deploymentId": f.Name,
-	}
+	labels := r.rolloutLabels(f)
 	ingress := &networkingv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        intf.Name + "-" + f.Name + "-ingress", // Create a unique name for the Ingress
+			Name:        ingressName(f, intf), // Create a unique name for the Ingress
 			Namespace:   f.Namespace,
 			Labels:      labels,
 			Annotations: make(map[string]string),
@@ -145,7 +131,13 @@ func (r *RolloutReconciler) ingressForRollout(f *oneclickiov1alpha1.Rollout, int
 		ingress.Spec.IngressClassName = &intf.Ingress.IngressClass
 	}
 
-	// Add annotations if defined
+	// Add the annotations of the typed ingress features for the configured controller
+	featureAnnotations, _ := r.ingressFeatureAnnotations(f, intf)
+	for k, v := range featureAnnotations {
+		ingress.Annotations[k] = v
+	}
+
+	// Add annotations if defined, they take precedence over the generated ones
 	if len(intf.Ingress.Annotations) > 0 {
 		for k, v := range intf.Ingress.Annotations {
 			ingress.Annotations[k] = v
@@ -160,14 +152,11 @@ func (r *RolloutReconciler) ingressForRollout(f *oneclickiov1alpha1.Rollout, int
 				HTTP: &networkingv1.HTTPIngressRuleValue{
 					Paths: []networkingv1.HTTPIngressPath{
 						{
-							Path: rule.Path,
-							PathType: func() *networkingv1.PathType {
-								pt := networkingv1.PathTypeImplementationSpecific // or PathTypeExact or PathTypePrefix
-								return &pt
-							}(),
+							Path:     rule.Path,
+							PathType: ptr.To(r.Config.Get().Defaults.IngressPathType),
 							Backend: networkingv1.IngressBackend{
 								Service: &networkingv1.IngressServiceBackend{
-									Name: intf.Name + "-" + f.Name + "-svc",
+									Name: naming.Service(f.Name, intf.Name),
 									Port: networkingv1.ServiceBackendPort{
 										Number: intf.Port,
 									},
@@ -188,7 +177,7 @@ func (r *RolloutReconciler) ingressForRollout(f *oneclickiov1alpha1.Rollout, int
 			if rule.TlsSecretName == "" {
 				tls = networkingv1.IngressTLS{
 					Hosts:      []string{rule.Host},
-					SecretName: intf.Name + "-" + f.Name + "-tls-secret", // Name of the TLS secret
+					SecretName: naming.TLSSecret(f.Name, intf.Name),
 				}
 			} else {
 				tls = networkingv1.IngressTLS{
@@ -203,63 +192,3 @@ func (r *RolloutReconciler) ingressForRollout(f *oneclickiov1alpha1.Rollout, int
 	ctrl.SetControllerReference(f, ingress, r.Scheme)
 	return ingress
 }
-
-func getIngressRules(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) []networkingv1.IngressRule {
-	var rules []networkingv1.IngressRule
-
-	for _, rule := range intf.Ingress.Rules {
-		ingressRule := networkingv1.IngressRule{
-			Host: rule.Host,
-			IngressRuleValue: networkingv1.IngressRuleValue{
-				HTTP: &networkingv1.HTTPIngressRuleValue{
-					Paths: []networkingv1.HTTPIngressPath{
-						{
-							Path: rule.Path,
-							PathType: func() *networkingv1.PathType {
-								pt := networkingv1.PathTypeImplementationSpecific // or PathTypeExact or PathTypePrefix
-								return &pt
-							}(),
-							Backend: networkingv1.IngressBackend{
-								Service: &networkingv1.IngressServiceBackend{
-									Name: intf.Name + "-" + f.Name + "-svc",
-									Port: networkingv1.ServiceBackendPort{
-										Number: intf.Port,
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		}
-		rules = append(rules, ingressRule)
-	}
-
-	return rules
-}
-
-func getIngressTLS(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) []networkingv1.IngressTLS {
-	var tlsConfigs []networkingv1.IngressTLS
-
-	// Loop over each rule defined in the ingress path
-	for _, rule := range intf.Ingress.Rules {
-		if rule.TLS {
-			var tls networkingv1.IngressTLS
-
-			// Add the TLS secret name if defined
-			if rule.TlsSecretName == "" {
-				tls = networkingv1.IngressTLS{
-					Hosts:      []string{rule.Host},
-					SecretName: intf.Name + "-" + f.Name + "-tls-secret", // Name of the TLS secret
-				}
-			} else {
-				tls = networkingv1.IngressTLS{
-					SecretName: rule.TlsSecretName,
-				}
-			}
-			tlsConfigs = append(tlsConfigs, tls)
-		}
-	}
-
-	return tlsConfigs
-}
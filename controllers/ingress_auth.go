@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// basicAuthSecretIndexKey indexes Rollouts by the user secrets referenced from
+// their ingress basic auth configuration.
+const basicAuthSecretIndexKey = "spec.interfaces.ingress.basicAuth.secretName"
+
+// basicAuthUsersChecksumAnnotation names the annotation holding the checksum of
+// the users Secret the htpasswd Secret was generated from, so unchanged users
+// are not hashed again. It is keyed below the label domain.
+const basicAuthUsersChecksumAnnotation = "users-checksum"
+
+// reconcileBasicAuthSecrets generates the htpasswd secrets for every interface
+// with basic auth enabled and removes the ones that are no longer needed.
+func (r *RolloutReconciler) reconcileBasicAuthSecrets(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	log := log.FromContext(ctx)
+
+	expectedSecrets := make(map[string]bool)
+	for _, intf := range f.Spec.Interfaces {
+		if !hasIngress(intf) || intf.Ingress.BasicAuth == nil {
+			continue
+		}
+		secretName := basicAuthSecretName(f, intf)
+		expectedSecrets[secretName] = true
+
+		// The users Secret is not the operator's, so it may be out of the cache
+		users := &corev1.Secret{}
+		err := r.getUncached(ctx, types.NamespacedName{Name: intf.Ingress.BasicAuth.SecretName, Namespace: f.Namespace}, users)
+		if err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get basic auth users Secret %s", intf.Ingress.BasicAuth.SecretName)
+			return err
+		}
+
+		// Reuse the hashes of the current secret for unchanged passwords
+		var current *corev1.Secret
+		foundSecret := &corev1.Secret{}
+		err = r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: f.Namespace}, foundSecret)
+		if err != nil && !errors.IsNotFound(err) {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Secret %s", secretName)
+			return err
+		}
+		if err == nil {
+			current = foundSecret
+		}
+
+		desiredSecret, err := r.basicAuthSecretForRollout(f, intf, users, current)
+		if err != nil {
+			return err
+		}
+		if err := r.applyForRollout(ctx, f, desiredSecret); err != nil {
+			return err
+		}
+	}
+
+	// Ingresses of former names may still use the Secrets of former names
+	if legacy, err := r.hasLegacyIngresses(ctx, f); err != nil || legacy {
+		return err
+	}
+
+	secretList := &corev1.SecretList{}
+	listOpts := []client.ListOption{
+		client.InNamespace(f.Namespace),
+		client.MatchingLabels{r.label(deploymentIDLabel): f.Name, r.label(basicAuthLabel): "true"},
+	}
+	if err := r.List(ctx, secretList, listOpts...); err != nil {
+		log.Error(err, "Failed to list basic auth Secrets", "Rollout.Namespace", f.Namespace)
+		return err
+	}
+
+	for _, secret := range secretList.Items {
+		if !expectedSecrets[secret.Name] && metav1.IsControlledBy(&secret, f) {
+			if err := r.Delete(ctx, &secret); err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Secret %s", secret.Name)
+				return err
+			}
+			r.forgetApplied(f, &secret)
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Secret %s", secret.Name)
+		}
+	}
+
+	return nil
+}
+
+// basicAuthSecretForRollout builds the htpasswd secret in the layout expected
+// by the configured ingress controller. Hashes of the current secret are reused
+// when the password did not change, so the secret stays stable across
+// reconciles despite bcrypt salting. If the users Secret is unchanged since the
+// current secret was generated, the hashes are reused without the costly
+// comparison.
+func (r *RolloutReconciler) basicAuthSecretForRollout(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec, users *corev1.Secret, current *corev1.Secret) (*corev1.Secret, error) {
+	passwords := make(map[string]string, len(users.Data))
+	for user, password := range users.Data {
+		passwords[user] = string(password)
+	}
+	checksum := calculateSecretsChecksum(passwords)
+
+	existingHashes := map[string]string{}
+	unchanged := false
+	if current != nil {
+		existingHashes = parseBasicAuthSecret(current)
+		unchanged = current.Annotations[r.label(basicAuthUsersChecksumAnnotation)] == checksum
+	}
+
+	hashes := make(map[string]string, len(users.Data))
+	for user, password := range users.Data {
+		hash, ok := existingHashes[user]
+		if ok && (unchanged || bcrypt.CompareHashAndPassword([]byte(hash), password) == nil) {
+			hashes[user] = hash
+			continue
+		}
+		generated, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[user] = string(generated)
+	}
+
+	data := map[string][]byte{}
+	switch r.ingressControllerFlavour() {
+	case IngressControllerHAProxy:
+		// HAProxy expects one key per user holding the encrypted password
+		for user, hash := range hashes {
+			data[user] = []byte(hash)
+		}
+	case IngressControllerTraefik:
+		data["users"] = []byte(htpasswd(hashes))
+	default:
+		data["auth"] = []byte(htpasswd(hashes))
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      basicAuthSecretName(f, intf),
+			Namespace: f.Namespace,
+			Labels: map[string]string{
+				r.label(projectIDLabel):    f.Namespace,
+				r.label(deploymentIDLabel): f.Name,
+				r.label(basicAuthLabel):    "true",
+			},
+			Annotations: map[string]string{r.label(basicAuthUsersChecksumAnnotation): checksum},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	if err := controllerutil.SetControllerReference(f, secret, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// parseBasicAuthSecret returns the user to hash mapping of a generated basic
+// auth secret, regardless of the controller layout it was written in. The
+// layouts are told apart by their values, not their keys, so users named auth
+// or users are read correctly: a bcrypt hash is the value of a single user, any
+// other value is an htpasswd file.
+func parseBasicAuthSecret(secret *corev1.Secret) map[string]string {
+	hashes := map[string]string{}
+	for key, value := range secret.Data {
+		if isBcryptHash(value) {
+			hashes[key] = string(value)
+			continue
+		}
+		for _, line := range strings.Split(string(value), "\n") {
+			if user, hash, ok := strings.Cut(line, ":"); ok {
+				hashes[user] = hash
+			}
+		}
+	}
+	return hashes
+}
+
+// isBcryptHash reports whether a value is a single bcrypt hash.
+func isBcryptHash(value []byte) bool {
+	_, err := bcrypt.Cost(value)
+	return err == nil
+}
+
+func htpasswd(hashes map[string]string) string {
+	users := make([]string, 0, len(hashes))
+	for user := range hashes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var b strings.Builder
+	for _, user := range users {
+		b.WriteString(user + ":" + hashes[user] + "\n")
+	}
+	return b.String()
+}
+
+func basicAuthSecretName(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) string {
+	return naming.BasicAuthSecret(f.Name, intf.Name)
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ingressHostIndexKey indexes operator managed ingresses by their hosts.
+	ingressHostIndexKey = "spec.rules.host"
+	// rolloutHostIndexKey indexes Rollouts by the hosts of their ingress rules,
+	// including generated ones.
+	rolloutHostIndexKey = "spec.interfaces.ingress.rules.host"
+
+	// ConditionHostConflict is set when a host/path of the Rollout is already
+	// claimed by another Rollout.
+	ConditionHostConflict = "HostConflict"
+)
+
+// removeConflictingRules drops every ingress rule whose host and path are
+// already served by an older Rollout and records the outcome in the
+// HostConflict condition.
+func (r *RolloutReconciler) removeConflictingRules(ctx context.Context, f *oneclickiov1alpha1.Rollout, interfaces []oneclickiov1alpha1.InterfaceSpec) ([]oneclickiov1alpha1.InterfaceSpec, error) {
+	var conflicts []string
+
+	result := make([]oneclickiov1alpha1.InterfaceSpec, len(interfaces))
+	for i, intf := range interfaces {
+		result[i] = intf
+		if !hasIngress(intf) {
+			continue
+		}
+
+		var rules []oneclickiov1alpha1.IngressRule
+		for _, rule := range intf.Ingress.Rules {
+			if rule.Host == "" {
+				rules = append(rules, rule)
+				continue
+			}
+
+			owner, err := r.hostPathOwner(ctx, f, rule.Host, rule.Path)
+			if err != nil {
+				return nil, err
+			}
+			if owner != "" {
+				conflicts = append(conflicts, fmt.Sprintf("%s%s is claimed by %s", rule.Host, rule.Path, owner))
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "HostConflict", "Host %s%s of interface %s is already claimed by Rollout %s", rule.Host, rule.Path, intf.Name, owner)
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		result[i].Ingress.Rules = rules
+	}
+
+	if len(conflicts) > 0 {
+		meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+			Type:               ConditionHostConflict,
+			Status:             metav1.ConditionTrue,
+			Reason:             "HostClaimed",
+			Message:            strings.Join(conflicts, "; "),
+			ObservedGeneration: f.Generation,
+		})
+	} else {
+		meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+			Type:               ConditionHostConflict,
+			Status:             metav1.ConditionFalse,
+			Reason:             "NoConflict",
+			Message:            "All ingress hosts are exclusively claimed by this Rollout",
+			ObservedGeneration: f.Generation,
+		})
+	}
+
+	return result, nil
+}
+
+// hostPathOwner returns the Rollout ("namespace/name") that has precedence over
+// f for the given host and path, or an empty string if f may serve it. The
+// Rollout created first wins, ties are broken by namespace and name.
+func (r *RolloutReconciler) hostPathOwner(ctx context.Context, f *oneclickiov1alpha1.Rollout, host, path string) (string, error) {
+	ingressList := &networkingv1.IngressList{}
+	if err := r.List(ctx, ingressList, client.MatchingFields{ingressHostIndexKey: host}); err != nil {
+		return "", err
+	}
+
+	for _, ingress := range ingressList.Items {
+		ownerName := ingress.Labels[r.label(deploymentIDLabel)]
+		if ownerName == "" || (ingress.Namespace == f.Namespace && ownerName == f.Name) {
+			continue
+		}
+		if !ingressServesPath(ingress, host, path) {
+			continue
+		}
+
+		other := &oneclickiov1alpha1.Rollout{}
+		err := r.Get(ctx, types.NamespacedName{Name: ownerName, Namespace: ingress.Namespace}, other)
+		if err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		// an ingress whose Rollout is gone keeps its claim until it is garbage collected
+		if errors.IsNotFound(err) || claimPrecedes(other, f) {
+			return ingress.Namespace + "/" + ownerName, nil
+		}
+	}
+
+	return "", nil
+}
+
+func claimPrecedes(a, b *oneclickiov1alpha1.Rollout) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+}
+
+func ingressServesPath(ingress networkingv1.Ingress, host, path string) bool {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != host || rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Path == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingressHosts is the indexer function for ingressHostIndexKey.
+func (r *RolloutReconciler) ingressHosts(rawObj client.Object) []string {
+	ingress := rawObj.(*networkingv1.Ingress)
+	if ingress.Labels[r.label(deploymentIDLabel)] == "" {
+		return nil
+	}
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != "" {
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	return hosts
+}
+
+// rolloutHosts is the indexer function for rolloutHostIndexKey. Interfaces
+// with autoHost enabled are indexed by their generated host, so a Rollout that
+// had to move to a suffixed host is reconciled again once the host is free.
+func (r *RolloutReconciler) rolloutHosts(rawObj client.Object) []string {
+	rollout := rawObj.(*oneclickiov1alpha1.Rollout)
+	var hosts []string
+	for _, intf := range rollout.Spec.Interfaces {
+		for _, rule := range intf.Ingress.Rules {
+			if rule.Host != "" {
+				hosts = append(hosts, rule.Host)
+			}
+		}
+		if intf.Ingress.AutoHost && r.DefaultDomain != "" {
+			if host, err := r.generateHost(rollout, intf); err == nil {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// rolloutsForIngressHosts maps an ingress to the other Rollouts claiming one of
+// its hosts, so the losing side of a conflict is reconciled again when the
+// winning ingress changes or disappears.
+func (r *RolloutReconciler) rolloutsForIngressHosts(ctx context.Context, obj client.Object) []reconcile.Request {
+	seen := make(map[types.NamespacedName]bool)
+	for _, host := range r.ingressHosts(obj) {
+		rollouts := &oneclickiov1alpha1.RolloutList{}
+		if err := r.List(ctx, rollouts, client.MatchingFields{rolloutHostIndexKey: host}); err != nil {
+			return nil
+		}
+		for _, rollout := range rollouts.Items {
+			if rollout.Namespace == obj.GetNamespace() && rollout.Name == obj.GetLabels()[r.label(deploymentIDLabel)] {
+				continue
+			}
+			seen[types.NamespacedName{Name: rollout.Name, Namespace: rollout.Namespace}] = true
+		}
+	}
+
+	requests := make([]reconcile.Request, 0, len(seen))
+	for name := range seen {
+		requests = append(requests, reconcile.Request{NamespacedName: name})
+	}
+	return requests
+}
@@ -0,0 +1,431 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Ingress controller flavours the typed ingress features can be translated for.
+const (
+	IngressControllerNginx   = "nginx"
+	IngressControllerTraefik = "traefik"
+	IngressControllerHAProxy = "haproxy"
+)
+
+// Backend protocols supported by IngressSpec.BackendProtocol.
+const (
+	backendProtocolHTTP      = "HTTP"
+	backendProtocolHTTPS     = "HTTPS"
+	backendProtocolGRPC      = "GRPC"
+	backendProtocolWebSocket = "WebSocket"
+)
+
+// websocketTimeoutSeconds is the proxy timeout used for websocket backends so
+// idle connections are not cut after the controller default of 60 seconds.
+const websocketTimeoutSeconds = "3600"
+
+// traefikServersSchemeAnnotation selects the protocol Traefik uses towards the
+// backend Service.
+const traefikServersSchemeAnnotation = "traefik.ingress.kubernetes.io/service.serversscheme"
+
+var traefikMiddlewareGVK = schema.GroupVersionKind{Group: "traefik.io", Version: "v1alpha1", Kind: "Middleware"}
+
+// ingressControllerFlavour returns the configured ingress controller flavour,
+// defaulting to ingress-nginx.
+func (r *RolloutReconciler) ingressControllerFlavour() string {
+	if r.IngressController == "" {
+		return IngressControllerNginx
+	}
+	return r.IngressController
+}
+
+// ingressFeatureAnnotations translates the typed ingress features of an
+// interface into annotations for the configured ingress controller. The second
+// return value lists the features the controller cannot express.
+func (r *RolloutReconciler) ingressFeatureAnnotations(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) (map[string]string, []string) {
+	switch r.ingressControllerFlavour() {
+	case IngressControllerTraefik:
+		return r.traefikIngressAnnotations(f, intf)
+	case IngressControllerHAProxy:
+		return haproxyIngressAnnotations(f, intf)
+	default:
+		return r.nginxIngressAnnotations(f, intf)
+	}
+}
+
+func (r *RolloutReconciler) nginxIngressAnnotations(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) (map[string]string, []string) {
+	const prefix = "nginx.ingress.kubernetes.io/"
+	spec := intf.Ingress
+	annotations := map[string]string{}
+	var unsupported []string
+
+	if spec.BasicAuth != nil {
+		annotations[prefix+"auth-type"] = "basic"
+		annotations[prefix+"auth-secret"] = basicAuthSecretName(f, intf)
+		annotations[prefix+"auth-realm"] = basicAuthRealm(spec.BasicAuth)
+	}
+
+	if len(spec.AllowedSourceRanges) > 0 {
+		// ingress-nginx 1.9 renamed the annotation, older versions only know the former name
+		if r.NginxAllowlistAnnotation {
+			annotations[prefix+"allowlist-source-range"] = strings.Join(spec.AllowedSourceRanges, ",")
+		} else {
+			annotations[prefix+"whitelist-source-range"] = strings.Join(spec.AllowedSourceRanges, ",")
+		}
+	}
+
+	if spec.RateLimit != nil && spec.RateLimit.RequestsPerSecond > 0 {
+		annotations[prefix+"limit-rps"] = strconv.Itoa(int(spec.RateLimit.RequestsPerSecond))
+		if spec.RateLimit.Burst > 0 {
+			// ingress-nginx expresses the burst as a multiple of the rate
+			multiplier := (spec.RateLimit.Burst + spec.RateLimit.RequestsPerSecond - 1) / spec.RateLimit.RequestsPerSecond
+			annotations[prefix+"limit-burst-multiplier"] = strconv.Itoa(int(multiplier))
+		}
+	}
+
+	if spec.SSLRedirect != nil {
+		annotations[prefix+"ssl-redirect"] = strconv.FormatBool(*spec.SSLRedirect)
+		annotations[prefix+"force-ssl-redirect"] = strconv.FormatBool(*spec.SSLRedirect)
+	}
+
+	if bytes, ok := maxBodySizeBytes(spec.MaxBodySize); ok {
+		annotations[prefix+"proxy-body-size"] = strconv.FormatInt(bytes, 10)
+	}
+
+	if spec.CORS != nil {
+		annotations[prefix+"enable-cors"] = "true"
+		if len(spec.CORS.AllowOrigins) > 0 {
+			annotations[prefix+"cors-allow-origin"] = strings.Join(spec.CORS.AllowOrigins, ", ")
+		}
+		if len(spec.CORS.AllowMethods) > 0 {
+			annotations[prefix+"cors-allow-methods"] = strings.Join(spec.CORS.AllowMethods, ", ")
+		}
+		if len(spec.CORS.AllowHeaders) > 0 {
+			annotations[prefix+"cors-allow-headers"] = strings.Join(spec.CORS.AllowHeaders, ", ")
+		}
+		if len(spec.CORS.ExposeHeaders) > 0 {
+			annotations[prefix+"cors-expose-headers"] = strings.Join(spec.CORS.ExposeHeaders, ", ")
+		}
+		annotations[prefix+"cors-allow-credentials"] = strconv.FormatBool(spec.CORS.AllowCredentials)
+		if spec.CORS.MaxAge > 0 {
+			annotations[prefix+"cors-max-age"] = strconv.Itoa(int(spec.CORS.MaxAge))
+		}
+	}
+
+	switch spec.BackendProtocol {
+	case backendProtocolHTTP, backendProtocolHTTPS, backendProtocolGRPC:
+		annotations[prefix+"backend-protocol"] = spec.BackendProtocol
+	case backendProtocolWebSocket:
+		annotations[prefix+"proxy-read-timeout"] = websocketTimeoutSeconds
+		annotations[prefix+"proxy-send-timeout"] = websocketTimeoutSeconds
+	}
+
+	return annotations, unsupported
+}
+
+func haproxyIngressAnnotations(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) (map[string]string, []string) {
+	const prefix = "haproxy.org/"
+	spec := intf.Ingress
+	annotations := map[string]string{}
+	var unsupported []string
+
+	if spec.BasicAuth != nil {
+		annotations[prefix+"auth-type"] = "basic-auth"
+		annotations[prefix+"auth-secret"] = basicAuthSecretName(f, intf)
+		annotations[prefix+"auth-realm"] = basicAuthRealm(spec.BasicAuth)
+	}
+
+	if len(spec.AllowedSourceRanges) > 0 {
+		annotations[prefix+"allow-list"] = strings.Join(spec.AllowedSourceRanges, ",")
+	}
+
+	if spec.RateLimit != nil && spec.RateLimit.RequestsPerSecond > 0 {
+		// HAProxy has no burst setting, the period is widened instead
+		requests := spec.RateLimit.RequestsPerSecond
+		if spec.RateLimit.Burst > requests {
+			requests = spec.RateLimit.Burst
+		}
+		period := (requests + spec.RateLimit.RequestsPerSecond - 1) / spec.RateLimit.RequestsPerSecond
+		annotations[prefix+"rate-limit-requests"] = strconv.Itoa(int(requests))
+		annotations[prefix+"rate-limit-period"] = fmt.Sprintf("%ds", period)
+	}
+
+	if spec.SSLRedirect != nil {
+		annotations[prefix+"ssl-redirect"] = strconv.FormatBool(*spec.SSLRedirect)
+	}
+
+	if spec.MaxBodySize != "" {
+		unsupported = append(unsupported, "maxBodySize")
+	}
+
+	if spec.CORS != nil {
+		annotations[prefix+"cors-enable"] = "true"
+		if origin := haproxyCORSOrigin(spec.CORS.AllowOrigins); origin != "" {
+			annotations[prefix+"cors-allow-origin"] = origin
+		}
+		if len(spec.CORS.AllowMethods) > 0 {
+			annotations[prefix+"cors-allow-methods"] = strings.Join(spec.CORS.AllowMethods, ", ")
+		}
+		if len(spec.CORS.AllowHeaders) > 0 {
+			annotations[prefix+"cors-allow-headers"] = strings.Join(spec.CORS.AllowHeaders, ", ")
+		}
+		if len(spec.CORS.ExposeHeaders) > 0 {
+			unsupported = append(unsupported, "cors.exposeHeaders")
+		}
+		annotations[prefix+"cors-allow-credentials"] = strconv.FormatBool(spec.CORS.AllowCredentials)
+		if spec.CORS.MaxAge > 0 {
+			annotations[prefix+"cors-max-age"] = fmt.Sprintf("%ds", spec.CORS.MaxAge)
+		}
+	}
+
+	switch spec.BackendProtocol {
+	case backendProtocolHTTPS:
+		annotations[prefix+"server-ssl"] = "true"
+	case backendProtocolGRPC:
+		annotations[prefix+"server-proto"] = "h2"
+	case backendProtocolWebSocket:
+		annotations[prefix+"timeout-tunnel"] = websocketTimeoutSeconds + "s"
+	}
+
+	return annotations, unsupported
+}
+
+// haproxyCORSOrigin converts a list of allowed origins into the single value
+// (or regular expression) accepted by the HAProxy ingress controller.
+func haproxyCORSOrigin(origins []string) string {
+	switch len(origins) {
+	case 0:
+		return ""
+	case 1:
+		return origins[0]
+	}
+	quoted := make([]string, len(origins))
+	for i, origin := range origins {
+		if origin == "*" {
+			return "*"
+		}
+		quoted[i] = regexp.QuoteMeta(origin)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// traefikIngressAnnotations references the middlewares built by
+// traefikMiddlewaresForInterface. Traefik has no annotations for most of the
+// features, they are implemented as Middleware custom resources instead.
+func (r *RolloutReconciler) traefikIngressAnnotations(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) (map[string]string, []string) {
+	annotations := map[string]string{}
+
+	middlewares := r.traefikMiddlewaresForInterface(f, intf)
+	if len(middlewares) > 0 {
+		refs := make([]string, len(middlewares))
+		for i, mw := range middlewares {
+			refs[i] = fmt.Sprintf("%s-%s@kubernetescrd", f.Namespace, mw.GetName())
+		}
+		annotations["traefik.ingress.kubernetes.io/router.middlewares"] = strings.Join(refs, ",")
+	}
+
+	return annotations, nil
+}
+
+// traefikMiddlewaresForInterface builds one Traefik Middleware per typed
+// ingress feature configured on the interface.
+func (r *RolloutReconciler) traefikMiddlewaresForInterface(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) []*unstructured.Unstructured {
+	spec := intf.Ingress
+	var middlewares []*unstructured.Unstructured
+
+	add := func(suffix, kind string, config map[string]interface{}) {
+		mw := &unstructured.Unstructured{}
+		mw.SetGroupVersionKind(traefikMiddlewareGVK)
+		mw.SetName(naming.Middleware(f.Name, intf.Name, suffix))
+		mw.SetNamespace(f.Namespace)
+		mw.SetLabels(r.rolloutLabels(f))
+		mw.Object["spec"] = map[string]interface{}{kind: config}
+		middlewares = append(middlewares, mw)
+	}
+
+	if spec.SSLRedirect != nil && *spec.SSLRedirect {
+		add("redirect", "redirectScheme", map[string]interface{}{
+			"scheme":    "https",
+			"permanent": true,
+		})
+	}
+
+	if len(spec.AllowedSourceRanges) > 0 {
+		add("allowlist", "ipAllowList", map[string]interface{}{
+			"sourceRange": stringsToInterfaces(spec.AllowedSourceRanges),
+		})
+	}
+
+	if spec.BasicAuth != nil {
+		add("basic-auth", "basicAuth", map[string]interface{}{
+			"secret": basicAuthSecretName(f, intf),
+			"realm":  basicAuthRealm(spec.BasicAuth),
+		})
+	}
+
+	if spec.RateLimit != nil && spec.RateLimit.RequestsPerSecond > 0 {
+		config := map[string]interface{}{
+			"average": int64(spec.RateLimit.RequestsPerSecond),
+			"period":  "1s",
+		}
+		if spec.RateLimit.Burst > 0 {
+			config["burst"] = int64(spec.RateLimit.Burst)
+		}
+		add("ratelimit", "rateLimit", config)
+	}
+
+	if bytes, ok := maxBodySizeBytes(spec.MaxBodySize); ok {
+		add("buffering", "buffering", map[string]interface{}{
+			"maxRequestBodyBytes": bytes,
+		})
+	}
+
+	if spec.CORS != nil {
+		config := map[string]interface{}{
+			"accessControlAllowCredentials": spec.CORS.AllowCredentials,
+			"addVaryHeader":                 true,
+		}
+		if len(spec.CORS.AllowOrigins) > 0 {
+			config["accessControlAllowOriginList"] = stringsToInterfaces(spec.CORS.AllowOrigins)
+		}
+		if len(spec.CORS.AllowMethods) > 0 {
+			config["accessControlAllowMethods"] = stringsToInterfaces(spec.CORS.AllowMethods)
+		}
+		if len(spec.CORS.AllowHeaders) > 0 {
+			config["accessControlAllowHeaders"] = stringsToInterfaces(spec.CORS.AllowHeaders)
+		}
+		if len(spec.CORS.ExposeHeaders) > 0 {
+			config["accessControlExposeHeaders"] = stringsToInterfaces(spec.CORS.ExposeHeaders)
+		}
+		if spec.CORS.MaxAge > 0 {
+			config["accessControlMaxAge"] = int64(spec.CORS.MaxAge)
+		}
+		add("cors", "headers", config)
+	}
+
+	return middlewares
+}
+
+// serviceAnnotationsForInterface returns the annotations the configured ingress
+// controller expects on the backend Service. Only Traefik configures the
+// backend protocol on the Service instead of the Ingress.
+func (r *RolloutReconciler) serviceAnnotationsForInterface(intf oneclickiov1alpha1.InterfaceSpec) map[string]string {
+	if r.ingressControllerFlavour() != IngressControllerTraefik {
+		return nil
+	}
+
+	switch intf.Ingress.BackendProtocol {
+	case backendProtocolHTTPS:
+		return map[string]string{traefikServersSchemeAnnotation: "https"}
+	case backendProtocolGRPC:
+		return map[string]string{traefikServersSchemeAnnotation: "h2c"}
+	}
+	return nil
+}
+
+// reconcileTraefikMiddlewares creates, updates and prunes the Traefik
+// middlewares backing the typed ingress features of all interfaces.
+func (r *RolloutReconciler) reconcileTraefikMiddlewares(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	log := log.FromContext(ctx)
+
+	if r.ingressControllerFlavour() != IngressControllerTraefik {
+		return nil
+	}
+
+	expectedMiddlewares := make(map[string]bool)
+	for _, intf := range f.Spec.Interfaces {
+		if !hasIngress(intf) {
+			continue
+		}
+
+		for _, desired := range r.traefikMiddlewaresForInterface(f, intf) {
+			expectedMiddlewares[desired.GetName()] = true
+
+			if err := ctrl.SetControllerReference(f, desired, r.Scheme); err != nil {
+				return err
+			}
+
+			if err := r.applyForRollout(ctx, f, desired); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Ingresses of former names may still use the middlewares of former names
+	if legacy, err := r.hasLegacyIngresses(ctx, f); err != nil || legacy {
+		return err
+	}
+
+	middlewareList := &unstructured.UnstructuredList{}
+	middlewareList.SetGroupVersionKind(traefikMiddlewareGVK.GroupVersion().WithKind(traefikMiddlewareGVK.Kind + "List"))
+	listOpts := []client.ListOption{
+		client.InNamespace(f.Namespace),
+		client.MatchingLabels{r.label(projectIDLabel): f.Namespace, r.label(deploymentIDLabel): f.Name},
+	}
+	if err := r.List(ctx, middlewareList, listOpts...); err != nil {
+		log.Error(err, "Failed to list Middlewares", "Rollout.Namespace", f.Namespace)
+		return err
+	}
+
+	for _, mw := range middlewareList.Items {
+		if !expectedMiddlewares[mw.GetName()] && metav1.IsControlledBy(&mw, f) {
+			if err := r.Delete(ctx, &mw); err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Middleware %s", mw.GetName())
+				return err
+			}
+			r.forgetApplied(f, &mw)
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Middleware %s", mw.GetName())
+		}
+	}
+
+	return nil
+}
+
+// maxBodySizeBytes parses IngressSpec.MaxBodySize as a Kubernetes quantity.
+func maxBodySizeBytes(size string) (int64, bool) {
+	if size == "" {
+		return 0, false
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, false
+	}
+	return quantity.Value(), true
+}
+
+func basicAuthRealm(auth *oneclickiov1alpha1.IngressBasicAuth) string {
+	if auth.Realm == "" {
+		return "Authentication Required"
+	}
+	return auth.Realm
+}
+
+func hasIngress(intf oneclickiov1alpha1.InterfaceSpec) bool {
+	return intf.Ingress.IngressClass != "" || len(intf.Ingress.Rules) > 0 || intf.Ingress.AutoHost
+}
+
+func ingressName(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) string {
+	return naming.Ingress(f.Name, intf.Name)
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
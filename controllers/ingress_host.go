@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"text/template"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultHostTemplate is used for generated hostnames when no template is configured.
+const DefaultHostTemplate = "{{.Interface}}-{{.Rollout}}-{{.Namespace}}.{{.Domain}}"
+
+// maxHostLabelLength is the maximum length of a single DNS label.
+const maxHostLabelLength = 63
+
+// HostTemplateData is passed to the hostname template.
+type HostTemplateData struct {
+	Interface string
+	Rollout   string
+	Namespace string
+	Domain    string
+}
+
+// resolveAutoHosts returns the interfaces of the Rollout with the generated
+// hostname filled in for every interface with autoHost enabled. A generated
+// hostname already claimed by another Rollout gets a stable hash suffix.
+func (r *RolloutReconciler) resolveAutoHosts(ctx context.Context, f *oneclickiov1alpha1.Rollout) ([]oneclickiov1alpha1.InterfaceSpec, error) {
+	interfaces := make([]oneclickiov1alpha1.InterfaceSpec, len(f.Spec.Interfaces))
+	copy(interfaces, f.Spec.Interfaces)
+
+	var claimed map[string]string
+	var owned map[string]bool
+	for i, intf := range interfaces {
+		if !intf.Ingress.AutoHost {
+			continue
+		}
+		if r.DefaultDomain == "" {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "AutoHostUnavailable", "Interface %s requests an automatic host but the operator has no default domain configured", intf.Name)
+			continue
+		}
+
+		if claimed == nil {
+			var err error
+			if claimed, owned, err = r.claimedIngressHosts(ctx, f); err != nil {
+				return nil, err
+			}
+		}
+
+		host, err := r.generateHost(f, intf)
+		if err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "AutoHostFailed", "Failed to generate host for interface %s: %v", intf.Name, err)
+			return nil, err
+		}
+		// a host this Rollout already serves is kept, the later claimant has to move
+		if owner, exists := claimed[host]; exists && !owned[host] {
+			collidingHost := host
+			host = suffixHost(host, f.Namespace+"/"+f.Name+"/"+intf.Name)
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "HostCollision", "Host %s is already used by %s, using %s instead", collidingHost, owner, host)
+		}
+
+		interfaces[i] = withAutoHost(intf, host)
+	}
+
+	return interfaces, nil
+}
+
+// generateHost renders the configured hostname template for an interface.
+func (r *RolloutReconciler) generateHost(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) (string, error) {
+	tmpl := r.HostTemplate
+	if tmpl == nil {
+		tmpl = template.Must(template.New("host").Parse(DefaultHostTemplate))
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, HostTemplateData{
+		Interface: intf.Name,
+		Rollout:   f.Name,
+		Namespace: f.Namespace,
+		Domain:    r.DefaultDomain,
+	}); err != nil {
+		return "", err
+	}
+
+	labels := strings.Split(strings.ToLower(strings.TrimSpace(buf.String())), ".")
+	for i, label := range labels {
+		labels[i] = truncateHostLabel(label)
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// withAutoHost returns a copy of the interface where every rule without a host
+// uses the generated one. An interface without rules gets a single root rule.
+func withAutoHost(intf oneclickiov1alpha1.InterfaceSpec, host string) oneclickiov1alpha1.InterfaceSpec {
+	if len(intf.Ingress.Rules) == 0 {
+		intf.Ingress.Rules = []oneclickiov1alpha1.IngressRule{{Host: host, Path: "/"}}
+		return intf
+	}
+
+	rules := make([]oneclickiov1alpha1.IngressRule, len(intf.Ingress.Rules))
+	for i, rule := range intf.Ingress.Rules {
+		if rule.Host == "" {
+			rule.Host = host
+		}
+		rules[i] = rule
+	}
+	intf.Ingress.Rules = rules
+	return intf
+}
+
+// claimedIngressHosts returns the hosts of all operator managed ingresses that
+// do not belong to the given Rollout, mapped to their owning Rollout, and the
+// hosts the Rollout itself already serves.
+func (r *RolloutReconciler) claimedIngressHosts(ctx context.Context, f *oneclickiov1alpha1.Rollout) (map[string]string, map[string]bool, error) {
+	ingressList := &networkingv1.IngressList{}
+	if err := r.List(ctx, ingressList, client.HasLabels{r.label(deploymentIDLabel)}); err != nil {
+		return nil, nil, err
+	}
+
+	claimed := make(map[string]string)
+	owned := make(map[string]bool)
+	for _, ingress := range ingressList.Items {
+		owner := ingress.Labels[r.label(deploymentIDLabel)]
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Host == "" {
+				continue
+			}
+			if ingress.Namespace == f.Namespace && owner == f.Name {
+				owned[rule.Host] = true
+			} else {
+				claimed[rule.Host] = ingress.Namespace + "/" + owner
+			}
+		}
+	}
+	return claimed, owned, nil
+}
+
+// suffixHost appends a short hash of seed to the first label of host.
+func suffixHost(host, seed string) string {
+	first, rest, _ := strings.Cut(host, ".")
+	sum := sha256.Sum256([]byte(seed))
+	suffix := hex.EncodeToString(sum[:])[:8]
+	if len(first)+1+len(suffix) > maxHostLabelLength {
+		first = strings.TrimRight(first[:maxHostLabelLength-1-len(suffix)], "-")
+	}
+	if rest == "" {
+		return first + "-" + suffix
+	}
+	return first + "-" + suffix + "." + rest
+}
+
+// truncateHostLabel shortens a DNS label to 63 characters, replacing the tail
+// with a hash of the full label so truncated labels stay unique.
+func truncateHostLabel(label string) string {
+	if len(label) <= maxHostLabelLength {
+		return label
+	}
+	sum := sha256.Sum256([]byte(label))
+	suffix := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(label[:maxHostLabelLength-1-len(suffix)], "-") + "-" + suffix
+}
+
+// ingressURLs returns the URLs (with scheme) served by an ingress.
+func ingressURLs(ingress networkingv1.Ingress) []string {
+	var urls []string
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == "" || rule.HTTP == nil {
+			continue
+		}
+		scheme := "http"
+		if ingressHasTLS(ingress, rule.Host) {
+			scheme = "https"
+		}
+		for _, path := range rule.HTTP.Paths {
+			urls = append(urls, scheme+"://"+rule.Host+path.Path)
+		}
+	}
+	return urls
+}
+
+func ingressHasTLS(ingress networkingv1.Ingress, host string) bool {
+	for _, tls := range ingress.Spec.TLS {
+		// a TLS entry without hosts applies to all hosts of the ingress
+		if len(tls.Hosts) == 0 {
+			return true
+		}
+		for _, h := range tls.Hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+)
+
+// Names of the labels the operator sets. They are keyed below the label domain
+// of the install, e.g. one-click.dev/deploymentId. Annotations other than
+// basicAuthUsersChecksumAnnotation and the finalizer always use one-click.dev.
+const (
+	// projectIDLabel holds the namespace of the owning Rollout.
+	projectIDLabel = "projectId"
+	// deploymentIDLabel holds the name of the owning Rollout.
+	deploymentIDLabel = "deploymentId"
+	// rolloutRunLabel marks the jobs and pods of a RolloutRun with the Job name.
+	rolloutRunLabel = "rolloutRun"
+	// cronJobLabel marks the jobs and pods of a cron job with its name.
+	cronJobLabel = "cronjob"
+	// hookLabel holds the type of a hook job.
+	hookLabel = "hook"
+	// basicAuthLabel marks the basic auth Secrets of ingresses.
+	basicAuthLabel = "basic-auth"
+)
+
+// label returns the key of an operator label in the configured label domain.
+func (r *RolloutReconciler) label(name string) string {
+	return r.Config.Get().LabelDomain + "/" + name
+}
+
+// rolloutLabels returns the labels marking the objects of a Rollout.
+func (r *RolloutReconciler) rolloutLabels(f *oneclickiov1alpha1.Rollout) map[string]string {
+	return map[string]string{
+		r.label(projectIDLabel):    f.Namespace,
+		r.label(deploymentIDLabel): f.Name,
+	}
+}
+
+// label returns the key of an operator label in the configured label domain.
+func (r *RolloutRunReconciler) label(name string) string {
+	return r.Config.Get().LabelDomain + "/" + name
+}
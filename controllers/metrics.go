@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Status write results.
+const (
+	statusWritePerformed = "performed"
+	statusWriteSkipped   = "skipped"
+)
+
+// statusWrites counts Rollout status writes, skipped ones left the status
+// unchanged.
+var statusWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "one_click_rollout_status_writes_total",
+		Help: "Number of Rollout status updates by result, skipped if the status did not change.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(statusWrites)
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+)
+
+// legacyNameLabel names the label marking the Services kept under their name
+// from before the naming scheme, as aliases for clients still using it.
+const legacyNameLabel = "legacy-name"
+
+// Resources named before the naming scheme are migrated: the resource of the
+// new name is applied first, then the references switch over and finally the
+// former one is removed. Ingresses for ingress-nginx are the exception, its
+// admission webhook rejects a second Ingress with the same host and path, so
+// the former one is removed first. Services stay as aliases and PVCs keep
+// their names, see pvcNamesForRollout.
+
+// hasLegacyIngresses reports whether an Ingress of a former name is still
+// around. It may reference basic auth Secrets and middlewares of former names,
+// so they are kept until it is gone.
+func (r *RolloutReconciler) hasLegacyIngresses(ctx context.Context, f *oneclickiov1alpha1.Rollout) (bool, error) {
+	for _, intf := range f.Spec.Interfaces {
+		ingress := &networkingv1.Ingress{}
+		err := r.Get(ctx, types.NamespacedName{Name: naming.LegacyIngress(f.Name, intf.Name), Namespace: f.Namespace}, ingress)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+		if err == nil && metav1.IsControlledBy(ingress, f) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeLegacyIngress deletes the Ingress of the former name of an interface
+// before the one of the new name is applied, if the ingress controller rejects
+// two Ingresses with the same host and path. The host is not served until the
+// ingress controller picked up the new Ingress.
+func (r *RolloutReconciler) removeLegacyIngress(ctx context.Context, f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) error {
+	if r.ingressControllerFlavour() != IngressControllerNginx {
+		return nil
+	}
+	name := naming.LegacyIngress(f.Name, intf.Name)
+	if name == ingressName(f, intf) {
+		return nil
+	}
+	return r.deleteForRollout(ctx, f, &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: f.Namespace}})
+}
+
+// copyLegacyTLSSecret copies the certificate Secret of the former name to the
+// new one, so the Ingress of the new name serves the certificate right away
+// instead of waiting for a new one to be issued.
+func (r *RolloutReconciler) copyLegacyTLSSecret(ctx context.Context, f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) error {
+	name := naming.TLSSecret(f.Name, intf.Name)
+	// cert-manager doesn't label the certificate Secrets like the operator
+	err := r.getUncached(ctx, types.NamespacedName{Name: name, Namespace: f.Namespace}, &corev1.Secret{})
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	legacy := &corev1.Secret{}
+	if err := r.getUncached(ctx, types.NamespacedName{Name: naming.LegacyTLSSecret(f.Name, intf.Name), Namespace: f.Namespace}, legacy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	// Leave out the cert-manager annotations, they tie the Secret to the
+	// Certificate of the former name
+	annotations := map[string]string{}
+	for key, value := range legacy.Annotations {
+		if !strings.HasPrefix(key, "cert-manager.io/") {
+			annotations[key] = value
+		}
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   f.Namespace,
+			Labels:      legacy.Labels,
+			Annotations: annotations,
+		},
+		Type: legacy.Type,
+		Data: legacy.Data,
+	}
+	if err := r.Create(ctx, secret); err != nil && !errors.IsAlreadyExists(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Secret %s", name)
+		return err
+	}
+	r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created Secret %s from Secret %s", name, legacy.Name)
+	return nil
+}
+
+// removeLegacyImagePullSecrets removes the pull secrets of cron job images of
+// the former name once the CronJob of the former name is gone.
+func (r *RolloutReconciler) removeLegacyImagePullSecrets(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+	for _, cronJobSpec := range f.Spec.CronJobs {
+		cronJob := &batchv1.CronJob{}
+		err := r.Get(ctx, types.NamespacedName{Name: cronJobSpec.Name, Namespace: f.Namespace}, cronJob)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && metav1.IsControlledBy(cronJob, f) {
+			continue
+		}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: naming.LegacyCronJobImagePullSecret(cronJobSpec.Name), Namespace: f.Namespace}}
+		if err := r.deleteForRollout(ctx, f, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/config"
+)
+
+// ConditionPolicyViolation is set when the Rollout violates the allowed
+// registries, resource ceilings or feature toggles of the operator config. Such
+// a Rollout is not reconciled until it or the config changes.
+const ConditionPolicyViolation = "PolicyViolation"
+
+// policyViolations lists where the Rollout violates the operator config.
+func policyViolations(f *oneclickiov1alpha1.Rollout, cfg *config.Config) []string {
+	var violations []string
+
+	checkImage := func(field string, image oneclickiov1alpha1.ImageSpec) {
+		if !cfg.Allows(image.Registry, image.Repository) {
+			violations = append(violations, fmt.Sprintf("%s %s/%s is not from an allowed registry", field, image.Registry, image.Repository))
+		}
+	}
+	checkResources := func(field string, resources oneclickiov1alpha1.ResourceRequirements) {
+		violations = append(violations, resourceViolations(field, resources, cfg)...)
+	}
+	disabled := func(feature string) {
+		violations = append(violations, feature+" are disabled")
+	}
+
+	checkImage("image", f.Spec.Image)
+	checkResources("resources", f.Spec.Resources)
+	if ceiling := cfg.ResourceCeilings.MaxReplicas; ceiling > 0 && f.Spec.HorizontalScale.MaxReplicas > ceiling {
+		violations = append(violations, fmt.Sprintf("horizontalScale.maxReplicas %d exceeds the ceiling of %d", f.Spec.HorizontalScale.MaxReplicas, ceiling))
+	}
+	for _, v := range f.Spec.Volumes {
+		violations = append(violations, quantityViolations("volume "+v.Name+" size", v.Size, cfg.ResourceCeilings.VolumeSize)...)
+	}
+
+	for _, cronJob := range f.Spec.CronJobs {
+		if cronJob.InheritFromRollout == nil || !cronJob.InheritFromRollout.Image {
+			checkImage("cron job "+cronJob.Name+" image", cronJob.Image)
+		}
+		checkResources("cron job "+cronJob.Name+" resources", cronJob.Resources)
+	}
+	if hooks := f.Spec.Hooks; hooks != nil {
+		if hooks.PreDeploy != nil && hooks.PreDeploy.Resources != nil {
+			checkResources("preDeploy hook resources", *hooks.PreDeploy.Resources)
+		}
+		if hooks.PostDeploy != nil && hooks.PostDeploy.Resources != nil {
+			checkResources("postDeploy hook resources", *hooks.PostDeploy.Resources)
+		}
+	}
+
+	if !cfg.Features.Ingress {
+		for _, intf := range f.Spec.Interfaces {
+			if len(intf.Ingress.Rules) > 0 || intf.Ingress.AutoHost {
+				disabled("ingresses")
+				break
+			}
+		}
+	}
+	if !cfg.Features.CronJobs && len(f.Spec.CronJobs) > 0 {
+		disabled("cron jobs")
+	}
+	if !cfg.Features.Hooks && f.Spec.Hooks != nil && (f.Spec.Hooks.PreDeploy != nil || f.Spec.Hooks.PostDeploy != nil) {
+		disabled("hooks")
+	}
+	if !cfg.Features.ExternalSecrets {
+		for _, secretItem := range f.Spec.Secrets {
+			if secretItem.ValueFrom != nil && secretItem.ValueFrom.Provider != nil {
+				disabled("external secrets")
+				break
+			}
+		}
+	}
+
+	return violations
+}
+
+// resourceViolations lists the resources exceeding the ceilings.
+func resourceViolations(field string, resources oneclickiov1alpha1.ResourceRequirements, cfg *config.Config) []string {
+	var violations []string
+	violations = append(violations, quantityViolations(field+".requests.cpu", resources.Requests.CPU, cfg.ResourceCeilings.CPU)...)
+	violations = append(violations, quantityViolations(field+".limits.cpu", resources.Limits.CPU, cfg.ResourceCeilings.CPU)...)
+	violations = append(violations, quantityViolations(field+".requests.memory", resources.Requests.Memory, cfg.ResourceCeilings.Memory)...)
+	violations = append(violations, quantityViolations(field+".limits.memory", resources.Limits.Memory, cfg.ResourceCeilings.Memory)...)
+	return violations
+}
+
+// quantityViolations reports a quantity exceeding the ceiling, if any.
+func quantityViolations(field, value string, ceiling *resource.Quantity) []string {
+	if ceiling == nil || value == "" {
+		return nil
+	}
+	// Invalid quantities are reported when the resources are built
+	if quantity, err := resource.ParseQuantity(value); err == nil && quantity.Cmp(*ceiling) > 0 {
+		return []string{fmt.Sprintf("%s %s exceeds the ceiling of %s", field, value, ceiling.String())}
+	}
+	return nil
+}
+
+// setPolicyCondition records the policy violations in the PolicyViolation
+// condition.
+func setPolicyCondition(f *oneclickiov1alpha1.Rollout, violations []string) {
+	if len(violations) == 0 {
+		meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+			Type:               ConditionPolicyViolation,
+			Status:             metav1.ConditionFalse,
+			Reason:             "Compliant",
+			Message:            "The Rollout complies with the operator config",
+			ObservedGeneration: f.Generation,
+		})
+		return
+	}
+
+	meta.SetStatusCondition(&f.Status.Conditions, metav1.Condition{
+		Type:               ConditionPolicyViolation,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Violated",
+		Message:            strings.Join(violations, "; "),
+		ObservedGeneration: f.Generation,
+	})
+}
@@ -18,6 +18,10 @@ package controllers
 
 import (
 	"context"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv2 "k8s.io/api/autoscaling/v2"
@@ -26,12 +30,23 @@ import (
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/config"
+	"github.com/janlauber/one-click-operator/pkg/scope"
+	"github.com/janlauber/one-click-operator/pkg/secretstore"
 )
 
 // RolloutReconciler reconciles a Rollout object
@@ -39,6 +54,47 @@ type RolloutReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+
+	// IngressController is the ingress controller flavour (nginx, traefik or
+	// haproxy) the typed ingress features are translated for.
+	IngressController string
+	// NginxAllowlistAnnotation sets allowedSourceRanges with the
+	// allowlist-source-range annotation of ingress-nginx 1.9 and later instead
+	// of whitelist-source-range.
+	NginxAllowlistAnnotation bool
+	// DefaultDomain is the base domain for interfaces with autoHost enabled.
+	DefaultDomain string
+	// HostTemplate renders generated hostnames, DefaultHostTemplate if nil.
+	HostTemplate *template.Template
+	// OperatorNamespace holds the sealing key Secret used to decrypt secrets.
+	OperatorNamespace string
+	// AllowUnscopedEncryptedValues decrypts values sealed before they were
+	// bound to a namespace, which any Rollout can use.
+	AllowUnscopedEncryptedValues bool
+	// SecretProviders are the external secret stores by name, as referenced by
+	// secrets[].valueFrom.provider.
+	SecretProviders map[string]secretstore.Provider
+	// SecretPathTemplate maps provider paths of a Rollout to paths of its
+	// namespace in the secret store, secretstore.DefaultPathTemplate if nil.
+	SecretPathTemplate *secretstore.PathTemplate
+	// SecretResyncInterval is how often Rollouts with external secret values are
+	// reconciled to pick up changed values.
+	SecretResyncInterval time.Duration
+	// StatusResyncInterval is how often every Rollout is reconciled to refresh
+	// its status, disabled if zero.
+	StatusResyncInterval time.Duration
+	// Config holds the settings of the config file, the defaults if nil.
+	Config *config.Store
+	// Scope is the set of namespaces reconciled, all if nil.
+	Scope *scope.Scope
+	// APIReader reads objects the cache does not hold, e.g. Secrets of other
+	// namespaces or objects without the deploymentId label if the cache is
+	// restricted to labelled objects.
+	APIReader client.Reader
+
+	// applied remembers the state last applied per resource by Rollout UID, so
+	// unchanged resources are not written again.
+	applied sync.Map
 }
 
 //+kubebuilder:rbac:groups=one-click.dev,resources=rollouts,verbs=get;list;watch;create;update;patch;delete
@@ -47,6 +103,7 @@ type RolloutReconciler struct {
 
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
 
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=services/status,verbs=get;update;patch
@@ -55,6 +112,7 @@ type RolloutReconciler struct {
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses/status,verbs=get;update;patch
 
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;create;patch
 
 //+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
 
@@ -66,11 +124,27 @@ type RolloutReconciler struct {
 
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
 
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
 //+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+//+kubebuilder:rbac:groups=traefik.io,resources=middlewares,verbs=get;list;watch;create;update;patch;delete
+
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create
 
 func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
+	inScope, err := r.Scope.Contains(ctx, r.Client, req.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// Rollouts of other shards are left to the replica managing them
+	if !inScope && !r.Scope.InShard(req.Namespace) {
+		return ctrl.Result{}, nil
+	}
+
 	// Fetch the Rollout instance
 	var rollout oneclickiov1alpha1.Rollout
 	if err := r.Get(ctx, req.NamespacedName, &rollout); err != nil {
@@ -84,6 +158,40 @@ func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
+	// Clean up according to the deletion policy, also after the namespace
+	// left the scope, as no other replica removes the finalizer
+	if !rollout.DeletionTimestamp.IsZero() {
+		return r.finalizeRollout(ctx, &rollout)
+	}
+	// Rollouts out of scope are left as they are
+	if !inScope {
+		return ctrl.Result{}, nil
+	}
+	if controllerutil.AddFinalizer(&rollout, cleanupFinalizer) {
+		if err := r.Update(ctx, &rollout); err != nil {
+			log.Error(err, "Failed to add the cleanup finalizer.")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Leave Rollouts violating the operator config as they are
+	if violations := policyViolations(&rollout, r.Config.Get()); len(violations) > 0 {
+		r.Recorder.Eventf(&rollout, corev1.EventTypeWarning, "PolicyViolation", "%s", strings.Join(violations, "; "))
+		setPolicyCondition(&rollout, violations)
+		if err := r.updateStatus(ctx, &rollout); err != nil {
+			if errors.IsConflict(err) {
+				return ctrl.Result{Requeue: true}, nil
+			}
+			log.Error(err, "Failed to update status.")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	setPolicyCondition(&rollout, nil)
+
+	// Collect the resources in conflict anew
+	rollout.Status.Conflicts = nil
+
 	// Reconcile ServiceAccount
 	if err := r.reconcileServiceAccount(ctx, &rollout); err != nil {
 		log.Error(err, "Failed to reconcile ServiceAccount.")
@@ -91,19 +199,28 @@ func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}
 
 	// Reconcile PVCs only if volumes are defined
-	if err := r.reconcilePVCs(ctx, &rollout); err != nil {
+	pvcNames, err := r.reconcilePVCs(ctx, &rollout)
+	if err != nil {
 		log.Error(err, "Failed to reconcile PVCs.")
 		return ctrl.Result{}, err
 	}
 
+	// Reconcile generated secret values
+	generatedSecrets, rotateAfter, err := r.reconcileGeneratedSecrets(ctx, &rollout)
+	if err != nil {
+		log.Error(err, "Failed to reconcile generated Secrets.")
+		return ctrl.Result{}, err
+	}
+
 	// Reconcile Secrets
-	if err := r.reconcileSecret(ctx, &rollout); err != nil {
+	secretsChecksum, err := r.reconcileSecret(ctx, &rollout, generatedSecrets)
+	if err != nil {
 		log.Error(err, "Failed to reconcile Secrets.")
 		return ctrl.Result{}, err
 	}
 
 	// Reconcile Deployment
-	if err := r.reconcileDeployment(ctx, &rollout); err != nil {
+	if err := r.reconcileDeployment(ctx, &rollout, secretsChecksum, pvcNames); err != nil {
 		log.Error(err, "Failed to reconcile Deployment.")
 		return ctrl.Result{}, err
 	}
@@ -127,12 +244,19 @@ func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}
 
 	// Reconcile CronJobs
-	if err := r.reconcileCronJobs(ctx, &rollout); err != nil {
+	if err := r.reconcileCronJobs(ctx, &rollout, pvcNames); err != nil {
 		log.Error(err, "Failed to reconcile CronJobs.")
 		return ctrl.Result{}, err
 	}
 
+	// Run a cron job on request
+	if err := r.triggerCronJob(ctx, &rollout); err != nil {
+		log.Error(err, "Failed to trigger CronJob.")
+		return ctrl.Result{}, err
+	}
+
 	// Update status
+	setConflictCondition(&rollout)
 	if err := r.updateStatus(ctx, &rollout); err != nil {
 		if errors.IsConflict(err) {
 			log.Info("Conflict while updating status. Retrying.")
@@ -142,24 +266,59 @@ func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	// Resync external secret values, rotate generated ones and refresh the
+	// status, none of which comes with an event on the Rollout
+	requeueAfter := rotateAfter
+	if hasExternalSecrets(&rollout) && r.SecretResyncInterval > 0 && (requeueAfter == 0 || r.SecretResyncInterval < requeueAfter) {
+		requeueAfter = r.SecretResyncInterval
+	}
+	if r.StatusResyncInterval > 0 && (requeueAfter == 0 || r.StatusResyncInterval < requeueAfter) {
+		requeueAfter = r.StatusResyncInterval
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *RolloutReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &batchv1.CronJob{}, "metadata.ownerReferences.uid", func(rawObj client.Object) []string {
-		cronJob := rawObj.(*batchv1.CronJob)
-		ownerRefs := cronJob.GetOwnerReferences()
-		ownerUIDs := make([]string, len(ownerRefs))
-		for i, ownerRef := range ownerRefs {
-			ownerUIDs[i] = string(ownerRef.UID)
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &batchv1.CronJob{}, ownerUIDIndexKey, ownerUIDs); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &oneclickiov1alpha1.Rollout{}, basicAuthSecretIndexKey, func(rawObj client.Object) []string {
+		rollout := rawObj.(*oneclickiov1alpha1.Rollout)
+		var secretNames []string
+		for _, intf := range rollout.Spec.Interfaces {
+			if intf.Ingress.BasicAuth != nil {
+				secretNames = append(secretNames, intf.Ingress.BasicAuth.SecretName)
+			}
 		}
-		return ownerUIDs
+		return secretNames
 	}); err != nil {
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &networkingv1.Ingress{}, ingressHostIndexKey, r.ingressHosts); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &oneclickiov1alpha1.Rollout{}, rolloutHostIndexKey, r.rolloutHosts); err != nil {
+		return err
+	}
+
+	// Reconcile every Rollout when the config changes, coalescing changes that
+	// arrive before the previous one is handled
+	configChanged := make(chan event.GenericEvent, 1)
+	if r.Config != nil {
+		r.Config.Subscribe(func() {
+			select {
+			case configChanged <- event.GenericEvent{Object: &oneclickiov1alpha1.Rollout{}}:
+			default:
+			}
+		})
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&oneclickiov1alpha1.Rollout{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
@@ -169,5 +328,79 @@ func (r *RolloutReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&autoscalingv2.HorizontalPodAutoscaler{}).
 		Owns(&corev1.ServiceAccount{}).
 		Owns(&batchv1.CronJob{}).
-		Complete(r)
+		Owns(&batchv1.Job{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.rolloutsForBasicAuthSecret)).
+		Watches(&networkingv1.Ingress{}, handler.EnqueueRequestsFromMapFunc(r.rolloutsForIngressHosts)).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.rolloutForPod), builder.WithPredicates(podHealthChanged)).
+		WatchesRawSource(source.Channel(configChanged, handler.EnqueueRequestsFromMapFunc(r.allRollouts))).
+		WithEventFilter(predicate.Or(r.Scope.Predicate(mgr.GetClient()), rolloutBeingDeleted))
+
+	// Pick up the Rollouts of namespaces labeled into scope
+	if r.Scope != nil && r.Scope.NamespaceSelector != nil {
+		b = b.Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.rolloutsInNamespace), builder.WithPredicates(predicate.LabelChangedPredicate{}))
+	}
+
+	return b.Complete(r)
+}
+
+// rolloutBeingDeleted passes events of Rollouts waiting for their cleanup,
+// which is still done once their namespace left the scope.
+var rolloutBeingDeleted = predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	_, ok := obj.(*oneclickiov1alpha1.Rollout)
+	return ok && !obj.GetDeletionTimestamp().IsZero() && controllerutil.ContainsFinalizer(obj, cleanupFinalizer)
+})
+
+// ownerUIDIndexKey indexes CronJobs by the UIDs of their owners.
+const ownerUIDIndexKey = "metadata.ownerReferences.uid"
+
+func ownerUIDs(rawObj client.Object) []string {
+	ownerRefs := rawObj.GetOwnerReferences()
+	ownerUIDs := make([]string, len(ownerRefs))
+	for i, ownerRef := range ownerRefs {
+		ownerUIDs[i] = string(ownerRef.UID)
+	}
+	return ownerUIDs
+}
+
+// rolloutsInNamespace maps a Namespace to the Rollouts in it.
+func (r *RolloutReconciler) rolloutsInNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	rollouts := &oneclickiov1alpha1.RolloutList{}
+	if err := r.List(ctx, rollouts, client.InNamespace(obj.GetName())); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(rollouts.Items))
+	for i, rollout := range rollouts.Items {
+		requests[i] = reconcile.Request{NamespacedName: types.NamespacedName{Name: rollout.Name, Namespace: rollout.Namespace}}
+	}
+	return requests
+}
+
+// allRollouts maps a config change to every Rollout.
+func (r *RolloutReconciler) allRollouts(ctx context.Context, _ client.Object) []reconcile.Request {
+	rollouts := &oneclickiov1alpha1.RolloutList{}
+	if err := r.List(ctx, rollouts); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(rollouts.Items))
+	for i, rollout := range rollouts.Items {
+		requests[i] = reconcile.Request{NamespacedName: types.NamespacedName{Name: rollout.Name, Namespace: rollout.Namespace}}
+	}
+	return requests
+}
+
+// rolloutsForBasicAuthSecret maps a basic auth users Secret to the Rollouts
+// referencing it, so password changes are picked up without touching the Rollout.
+func (r *RolloutReconciler) rolloutsForBasicAuthSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	rollouts := &oneclickiov1alpha1.RolloutList{}
+	if err := r.List(ctx, rollouts, client.InNamespace(obj.GetNamespace()), client.MatchingFields{basicAuthSecretIndexKey: obj.GetName()}); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(rollouts.Items))
+	for i, rollout := range rollouts.Items {
+		requests[i] = reconcile.Request{NamespacedName: types.NamespacedName{Name: rollout.Name, Namespace: rollout.Namespace}}
+	}
+	return requests
 }
@@ -0,0 +1,1998 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/config"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	"github.com/janlauber/one-click-operator/pkg/scope"
+	"github.com/janlauber/one-click-operator/pkg/sealing"
+	"github.com/janlauber/one-click-operator/pkg/secretstore"
+)
+
+// writeCounter counts the writes issued through a fake client.
+type writeCounter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *writeCounter) record(verb string, obj client.Object) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, verb+" "+obj.GetObjectKind().GroupVersionKind().Kind+" "+obj.GetName())
+}
+
+func (w *writeCounter) reset() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	writes := w.writes
+	w.writes = nil
+	return writes
+}
+
+// newCountingClient returns a fake client counting every write. The fake
+// client does not support server-side apply, so apply patches are emulated
+// with a create or a full update.
+func newCountingClient(scheme *runtime.Scheme, counter *writeCounter, objs ...client.Object) client.Client {
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&oneclickiov1alpha1.Rollout{}).
+		WithIndex(&batchv1.CronJob{}, ownerUIDIndexKey, ownerUIDs).
+		WithIndex(&oneclickiov1alpha1.Rollout{}, basicAuthSecretIndexKey, func(client.Object) []string { return nil }).
+		WithIndex(&networkingv1.Ingress{}, ingressHostIndexKey, (&RolloutReconciler{}).ingressHosts).
+		WithIndex(&oneclickiov1alpha1.Rollout{}, rolloutHostIndexKey, (&RolloutReconciler{}).rolloutHosts).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				counter.record("create", obj)
+				return c.Create(ctx, obj, opts...)
+			},
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				counter.record("update", obj)
+				return c.Update(ctx, obj, opts...)
+			},
+			Delete: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+				counter.record("delete", obj)
+				return c.Delete(ctx, obj, opts...)
+			},
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				counter.record("patch", obj)
+				if patch.Type() != types.ApplyPatchType {
+					return c.Patch(ctx, obj, patch, opts...)
+				}
+				current := obj.DeepCopyObject().(client.Object)
+				err := c.Get(ctx, client.ObjectKeyFromObject(obj), current)
+				if errors.IsNotFound(err) {
+					return c.Create(ctx, obj)
+				}
+				if err != nil {
+					return err
+				}
+				obj.SetResourceVersion(current.GetResourceVersion())
+				return c.Update(ctx, obj)
+			},
+			SubResourceUpdate: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+				counter.record("update "+subResourceName, obj)
+				return c.SubResource(subResourceName).Update(ctx, obj, opts...)
+			},
+			SubResourcePatch: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) error {
+				counter.record("patch "+subResourceName, obj)
+				return c.SubResource(subResourceName).Patch(ctx, obj, patch, opts...)
+			},
+		}).
+		Build()
+}
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := oneclickiov1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func testRollout() *oneclickiov1alpha1.Rollout {
+	return &oneclickiov1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "project", UID: "rollout-uid"},
+		Spec: oneclickiov1alpha1.RolloutSpec{
+			Image: oneclickiov1alpha1.ImageSpec{Registry: "docker.io", Repository: "nginx", Tag: "1.27"},
+			HorizontalScale: oneclickiov1alpha1.HorizontalScaleSpec{
+				MinReplicas:                    1,
+				MaxReplicas:                    3,
+				TargetCPUUtilizationPercentage: 80,
+			},
+			Resources: oneclickiov1alpha1.ResourceRequirements{
+				Requests: oneclickiov1alpha1.ResourceList{CPU: "100m", Memory: "128Mi"},
+				Limits:   oneclickiov1alpha1.ResourceList{CPU: "500m", Memory: "256Mi"},
+			},
+			Env:     []oneclickiov1alpha1.EnvVar{{Name: "MODE", Value: "production"}},
+			Secrets: []oneclickiov1alpha1.SecretItem{{Name: "TOKEN", Value: "s3cr3t"}},
+			Interfaces: []oneclickiov1alpha1.InterfaceSpec{
+				{
+					Name: "http",
+					Port: 8080,
+					Ingress: oneclickiov1alpha1.IngressSpec{
+						IngressClass: "nginx",
+						Rules:        []oneclickiov1alpha1.IngressRule{{Host: "app.example.com", Path: "/", TLS: true}},
+					},
+				},
+				{Name: "metrics-exporter-port", Port: 9090, Protocol: "TCP"},
+			},
+			CronJobs: []oneclickiov1alpha1.CronJobSpec{{
+				Name:     "cleanup",
+				Schedule: "0 3 * * *",
+				Command:  []string{"./cleanup"},
+				Resources: oneclickiov1alpha1.ResourceRequirements{
+					Requests: oneclickiov1alpha1.ResourceList{CPU: "50m", Memory: "64Mi"},
+					Limits:   oneclickiov1alpha1.ResourceList{CPU: "100m", Memory: "128Mi"},
+				},
+				InheritFromRollout: &oneclickiov1alpha1.CronJobInheritSpec{
+					Image: true,
+					Env:   true,
+				},
+			}},
+		},
+	}
+}
+
+func newTestReconciler(t *testing.T, counter *writeCounter, objs ...client.Object) *RolloutReconciler {
+	scheme := testScheme(t)
+	return &RolloutReconciler{
+		Client:   newCountingClient(scheme, counter, objs...),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(1000),
+	}
+}
+
+func reconcileRollout(t *testing.T, r *RolloutReconciler, f *oneclickiov1alpha1.Rollout) {
+	t.Helper()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: f.Name, Namespace: f.Namespace}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+}
+
+func TestReconcileUnchangedRolloutWritesNothing(t *testing.T) {
+	f := testRollout()
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+
+	reconcileRollout(t, r, f)
+	if writes := counter.reset(); len(writes) == 0 {
+		t.Fatal("expected the first reconcile to create the resources")
+	}
+
+	for i := 0; i < 3; i++ {
+		reconcileRollout(t, r, f)
+		if writes := counter.reset(); len(writes) != 0 {
+			t.Fatalf("reconcile %d of an unchanged Rollout wrote: %v", i+2, writes)
+		}
+	}
+}
+
+func TestUnchangedStatusIsNotWritten(t *testing.T) {
+	f := testRollout()
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+	performed := testutil.ToFloat64(statusWrites.WithLabelValues(statusWritePerformed))
+	skipped := testutil.ToFloat64(statusWrites.WithLabelValues(statusWriteSkipped))
+
+	reconcileRollout(t, r, f)
+	if got := testutil.ToFloat64(statusWrites.WithLabelValues(statusWritePerformed)); got != performed+1 {
+		t.Fatalf("expected the first status to be written, counted %v writes", got-performed)
+	}
+	counter.reset()
+
+	reconcileRollout(t, r, f)
+	for _, write := range counter.reset() {
+		if strings.HasPrefix(write, "patch status") {
+			t.Errorf("expected the unchanged status not to be written, got %s", write)
+		}
+	}
+	if got := testutil.ToFloat64(statusWrites.WithLabelValues(statusWriteSkipped)); got != skipped+1 {
+		t.Errorf("expected the skipped write to be counted, counted %v", got-skipped)
+	}
+	if got := testutil.ToFloat64(statusWrites.WithLabelValues(statusWritePerformed)); got != performed+1 {
+		t.Errorf("expected no further status writes, counted %v", got-performed)
+	}
+}
+
+func TestReconcileRestoresDrift(t *testing.T) {
+	f := testRollout()
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+	ctx := context.Background()
+
+	reconcileRollout(t, r, f)
+
+	// Someone else changes the container ports
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Spec.Containers[0].Ports = nil
+	if err := r.Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	counter.reset()
+
+	reconcileRollout(t, r, f)
+	if writes := counter.reset(); len(writes) != 1 || writes[0] != "patch Deployment app" {
+		t.Fatalf("expected the Deployment to be applied once, got %v", writes)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployment.Spec.Template.Spec.Containers[0].Ports) != 2 {
+		t.Fatalf("expected the container ports to be restored, got %v", deployment.Spec.Template.Spec.Containers[0].Ports)
+	}
+}
+
+func TestContainerPortsAreNamedAndTargetedByServices(t *testing.T) {
+	f := testRollout()
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+	ctx := context.Background()
+
+	reconcileRollout(t, r, f)
+
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	want := []corev1.ContainerPort{
+		{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+		// Too long for a port name
+		{Name: "port-9090", ContainerPort: 9090, Protocol: corev1.ProtocolTCP},
+	}
+	got := deployment.Spec.Template.Spec.Containers[0].Ports
+	if len(got) != len(want) {
+		t.Fatalf("expected ports %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected port %v, got %v", want[i], got[i])
+		}
+	}
+
+	for i, intf := range f.Spec.Interfaces {
+		service := &corev1.Service{}
+		if err := r.Get(ctx, types.NamespacedName{Name: naming.Service(f.Name, intf.Name), Namespace: f.Namespace}, service); err != nil {
+			t.Fatal(err)
+		}
+		if targetPort := service.Spec.Ports[0].TargetPort; targetPort != intstr.FromString(want[i].Name) {
+			t.Errorf("expected Service %s to target port %s, got %v", service.Name, want[i].Name, targetPort)
+		}
+	}
+}
+
+func TestCronJobsInheritFromTheRollout(t *testing.T) {
+	f := testRollout()
+	f.Spec.ServiceAccountName = "app-sa"
+	f.Spec.NodeSelector = map[string]string{"pool": "apps"}
+	f.Spec.Volumes = []oneclickiov1alpha1.VolumeSpec{{Name: "data", MountPath: "/data", Size: "1Gi"}, {Name: "cache", MountPath: "/cache", Size: "1Gi"}}
+	cronJobSpec := &f.Spec.CronJobs[0]
+	cronJobSpec.Image = oneclickiov1alpha1.ImageSpec{Registry: "docker.io", Repository: "busybox", Tag: "1.36"}
+	cronJobSpec.Env = []oneclickiov1alpha1.EnvVar{{Name: "MODE", Value: "maintenance"}, {Name: "DRY_RUN", Value: "true"}}
+	cronJobSpec.InheritFromRollout = &oneclickiov1alpha1.CronJobInheritSpec{
+		Image: true, Env: true, Secrets: true, Volumes: []string{"data"}, ServiceAccount: true, Scheduling: true,
+	}
+	r := newTestReconciler(t, &writeCounter{}, f)
+	reconcileRollout(t, r, f)
+
+	cronJob := &batchv1.CronJob{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: naming.CronJob(f.Name, "cleanup"), Namespace: f.Namespace}, cronJob); err != nil {
+		t.Fatal(err)
+	}
+	template := cronJob.Spec.JobTemplate.Spec.Template
+	container := template.Spec.Containers[0]
+	if container.Image != "docker.io/nginx:1.27" {
+		t.Errorf("expected the Rollout image, got %s", container.Image)
+	}
+	wantEnv := []corev1.EnvVar{{Name: "MODE", Value: "maintenance"}, {Name: "DRY_RUN", Value: "true"}}
+	if !equality.Semantic.DeepEqual(container.Env, wantEnv) {
+		t.Errorf("expected the Rollout env overridden by the cron job env, got %v", container.Env)
+	}
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef.Name != naming.Secret(f.Name) {
+		t.Errorf("expected the Rollout secrets, got %v", container.EnvFrom)
+	}
+	if len(template.Spec.Volumes) != 1 || template.Spec.Volumes[0].PersistentVolumeClaim == nil || len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/data" {
+		t.Errorf("expected only the data volume, got %v and %v", template.Spec.Volumes, container.VolumeMounts)
+	}
+	if template.Spec.ServiceAccountName != "app-sa" || template.Spec.NodeSelector["pool"] != "apps" {
+		t.Errorf("expected the service account and node selector of the Rollout, got %q and %v", template.Spec.ServiceAccountName, template.Spec.NodeSelector)
+	}
+
+	// Cron job pods running the app image must not receive traffic
+	service := &corev1.Service{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: naming.Service(f.Name, "http"), Namespace: f.Namespace}, service); err != nil {
+		t.Fatal(err)
+	}
+	if labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(template.Labels)) {
+		t.Errorf("expected the Service selector %v not to select cron job pods labeled %v", service.Spec.Selector, template.Labels)
+	}
+	if template.Labels["one-click.dev/cronjob"] != "cleanup" || cronJob.Labels["one-click.dev/deploymentId"] != f.Name {
+		t.Errorf("expected the cron job labels, got %v and %v", template.Labels, cronJob.Labels)
+	}
+}
+
+func TestEmptyCronJobTimeZonesAreDropped(t *testing.T) {
+	for timeZone, want := range map[string]*string{"": nil, "Europe/Zurich": ptr.To("Europe/Zurich")} {
+		f := testRollout()
+		f.Spec.CronJobs[0].TimeZone = ptr.To(timeZone)
+		r := newTestReconciler(t, &writeCounter{}, f)
+		reconcileRollout(t, r, f)
+
+		cronJob := &batchv1.CronJob{}
+		if err := r.Get(context.Background(), types.NamespacedName{Name: naming.CronJob(f.Name, "cleanup"), Namespace: f.Namespace}, cronJob); err != nil {
+			t.Fatal(err)
+		}
+		if !equality.Semantic.DeepEqual(cronJob.Spec.TimeZone, want) {
+			t.Errorf("time zone %q: expected %v, got %v", timeZone, want, cronJob.Spec.TimeZone)
+		}
+	}
+}
+
+func TestTriggeredCronJobsKeepTheStatus(t *testing.T) {
+	f := testRollout()
+	f.Annotations = map[string]string{runCronJobAnnotation: "cleanup"}
+	f.Spec.ServiceAccountName = "app-identity"
+	unownedServiceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-identity", Namespace: f.Namespace},
+	}
+	r := newTestReconciler(t, &writeCounter{}, f, unownedServiceAccount)
+	reconcileRollout(t, r, f)
+
+	jobs := &batchv1.JobList{}
+	if n := countObjects(t, r, jobs); n != 1 || jobs.Items[0].Annotations["cronjob.kubernetes.io/instantiate"] != "manual" {
+		t.Fatalf("expected one manual Job, got %v", jobs.Items)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(f), f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Annotations) != 0 {
+		t.Errorf("expected the trigger annotations to be removed, got %v", f.Annotations)
+	}
+	// The conflict was found in the reconcile that ran the job
+	if len(f.Status.Conflicts) != 1 {
+		t.Errorf("expected the ServiceAccount conflict in the status, got %v", f.Status.Conflicts)
+	}
+}
+
+func TestTriggeredCronJobsRunOnceWhenRetried(t *testing.T) {
+	f := testRollout()
+	f.Annotations = map[string]string{runCronJobAnnotation: "cleanup"}
+	r := newTestReconciler(t, &writeCounter{}, f)
+
+	// Fail the removal of the annotations once
+	failed := false
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if _, ok := obj.(*oneclickiov1alpha1.Rollout); ok && !failed {
+				if _, ok := obj.GetAnnotations()[runCronJobAnnotation]; !ok {
+					failed = true
+					return errors.NewServiceUnavailable("patch failed")
+				}
+			}
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	})
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(f)}
+	if _, err := r.Reconcile(context.Background(), req); err == nil {
+		t.Fatal("expected the failed patch to fail the reconcile")
+	}
+	reconcileRollout(t, r, f)
+
+	if n := countObjects(t, r, &batchv1.JobList{}); n != 1 {
+		t.Fatalf("expected the retry to reuse the Job, got %d Jobs", n)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(f), f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Annotations) != 0 {
+		t.Errorf("expected the trigger annotations to be removed, got %v", f.Annotations)
+	}
+}
+
+func TestSecurityProfilesExpandUnderExplicitFields(t *testing.T) {
+	runtimeDefault := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	for name, tc := range map[string]struct {
+		profile       string
+		spec          oneclickiov1alpha1.SecurityContextSpec
+		wantPod       *corev1.PodSecurityContext
+		wantContainer *corev1.SecurityContext
+	}{
+		"nothing configured": {},
+		"privileged profile": {profile: oneclickiov1alpha1.SecurityProfilePrivileged},
+		"restricted profile": {
+			profile: oneclickiov1alpha1.SecurityProfileRestricted,
+			wantPod: &corev1.PodSecurityContext{RunAsNonRoot: ptr.To(true), SeccompProfile: runtimeDefault},
+			wantContainer: &corev1.SecurityContext{
+				RunAsNonRoot: ptr.To(true), Privileged: ptr.To(false), AllowPrivilegeEscalation: ptr.To(false),
+				SeccompProfile: runtimeDefault, Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+			},
+		},
+		"baseline profile": {
+			profile:       oneclickiov1alpha1.SecurityProfileBaseline,
+			wantPod:       &corev1.PodSecurityContext{SeccompProfile: runtimeDefault},
+			wantContainer: &corev1.SecurityContext{Privileged: ptr.To(false), SeccompProfile: runtimeDefault},
+		},
+		"explicit fields override the profile": {
+			profile: oneclickiov1alpha1.SecurityProfileRestricted,
+			spec: oneclickiov1alpha1.SecurityContextSpec{
+				RunAsUser:                ptr.To(int64(1000)),
+				RunAsNonRoot:             ptr.To(false),
+				AllowPrivilegeEscalation: ptr.To(true),
+				ReadOnlyRootFilesystem:   ptr.To(true),
+				Capabilities:             oneclickiov1alpha1.CapabilitiesSpec{Add: []string{"NET_BIND_SERVICE"}, Drop: []string{"ALL"}},
+			},
+			wantPod: &corev1.PodSecurityContext{RunAsUser: ptr.To(int64(1000)), RunAsNonRoot: ptr.To(false), SeccompProfile: runtimeDefault},
+			wantContainer: &corev1.SecurityContext{
+				RunAsNonRoot: ptr.To(false), Privileged: ptr.To(false), AllowPrivilegeEscalation: ptr.To(true),
+				ReadOnlyRootFilesystem: ptr.To(true), SeccompProfile: runtimeDefault,
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_BIND_SERVICE"}, Drop: []corev1.Capability{"ALL"}},
+			},
+		},
+		"custom profile only applies explicit fields": {
+			profile:       oneclickiov1alpha1.SecurityProfileCustom,
+			spec:          oneclickiov1alpha1.SecurityContextSpec{RunAsNonRoot: ptr.To(true)},
+			wantContainer: &corev1.SecurityContext{RunAsNonRoot: ptr.To(true)},
+		},
+	} {
+		f := testRollout()
+		f.Spec.SecurityProfile = tc.profile
+		f.Spec.SecurityContext = tc.spec
+		pod, container := securityContextsForRollout(f)
+		if !equality.Semantic.DeepEqual(pod, tc.wantPod) {
+			t.Errorf("%s: expected pod security context %+v, got %+v", name, tc.wantPod, pod)
+		}
+		if !equality.Semantic.DeepEqual(container, tc.wantContainer) {
+			t.Errorf("%s: expected container security context %+v, got %+v", name, tc.wantContainer, container)
+		}
+	}
+}
+
+func TestPodLevelSecurityFieldsAreSetOnThePod(t *testing.T) {
+	localhost := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: ptr.To("profiles/app.json")}
+	appArmor := &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeRuntimeDefault}
+	f := testRollout()
+	f.Spec.SecurityProfile = oneclickiov1alpha1.SecurityProfileRestricted
+	f.Spec.SecurityContext = oneclickiov1alpha1.SecurityContextSpec{
+		SeccompProfile:      localhost,
+		AppArmorProfile:     appArmor,
+		SupplementalGroups:  []int64{2000, 3000},
+		FsGroupChangePolicy: ptr.To(corev1.FSGroupChangeOnRootMismatch),
+		Sysctls:             []corev1.Sysctl{{Name: "net.ipv4.ip_local_port_range", Value: "1024 65535"}},
+	}
+
+	pod, container := securityContextsForRollout(f)
+	want := &corev1.PodSecurityContext{
+		RunAsNonRoot:        ptr.To(true),
+		SeccompProfile:      localhost,
+		AppArmorProfile:     appArmor,
+		SupplementalGroups:  []int64{2000, 3000},
+		FSGroupChangePolicy: ptr.To(corev1.FSGroupChangeOnRootMismatch),
+		Sysctls:             []corev1.Sysctl{{Name: "net.ipv4.ip_local_port_range", Value: "1024 65535"}},
+	}
+	if !equality.Semantic.DeepEqual(pod, want) {
+		t.Fatalf("expected pod security context %+v, got %+v", want, pod)
+	}
+	// The container inherits the profiles of the pod instead of the ones of the security profile
+	if container.SeccompProfile != nil || container.AppArmorProfile != nil {
+		t.Fatalf("expected the container to inherit the pod profiles, got %+v", container)
+	}
+}
+
+func TestReadOnlyRootFilesystemGetsWritableTmp(t *testing.T) {
+	for name, tc := range map[string]struct {
+		readOnly *bool
+		volumes  []oneclickiov1alpha1.VolumeSpec
+		want     bool
+	}{
+		"writable root filesystem":    {readOnly: ptr.To(false)},
+		"unset":                       {},
+		"read-only root filesystem":   {readOnly: ptr.To(true), want: true},
+		"user volume mounted at /tmp": {readOnly: ptr.To(true), volumes: []oneclickiov1alpha1.VolumeSpec{{Name: "scratch", MountPath: "/tmp", Size: "1Gi"}}},
+	} {
+		f := testRollout()
+		f.Spec.SecurityContext.ReadOnlyRootFilesystem = tc.readOnly
+		f.Spec.Volumes = tc.volumes
+		r := newTestReconciler(t, &writeCounter{}, f)
+		reconcileRollout(t, r, f)
+
+		deployment := &appsv1.Deployment{}
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(f), deployment); err != nil {
+			t.Fatal(err)
+		}
+		var hasVolume, hasMount bool
+		for _, volume := range deployment.Spec.Template.Spec.Volumes {
+			hasVolume = hasVolume || (volume.Name == tmpVolumeName && volume.EmptyDir != nil)
+		}
+		for _, mount := range deployment.Spec.Template.Spec.Containers[0].VolumeMounts {
+			hasMount = hasMount || (mount.Name == tmpVolumeName && mount.MountPath == "/tmp")
+		}
+		if hasVolume != tc.want || hasMount != tc.want {
+			t.Errorf("%s: expected a /tmp emptyDir %v, got volume %v and mount %v", name, tc.want, hasVolume, hasMount)
+		}
+	}
+}
+
+func TestForeignResourcesAreLeftAloneUnlessAdopted(t *testing.T) {
+	f := testRollout()
+	f.Spec.ServiceAccountName = "app-identity"
+	foreignService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      naming.Service(f.Name, "http"),
+			Namespace: f.Namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "StatefulSet",
+				Name:       "db",
+				UID:        "statefulset-uid",
+				Controller: ptr.To(true),
+			}},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 5432}}},
+	}
+	unownedServiceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-identity", Namespace: f.Namespace},
+	}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f, foreignService, unownedServiceAccount)
+	ctx := context.Background()
+	key := types.NamespacedName{Name: f.Name, Namespace: f.Namespace}
+
+	reconcileRollout(t, r, f)
+
+	if err := r.Get(ctx, key, f); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(f.Status.Conditions, ConditionResourceConflict)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the ResourceConflict condition to be true, got %v", condition)
+	}
+	if len(f.Status.Conflicts) != 2 {
+		t.Fatalf("expected the Service and ServiceAccount conflicts, got %v", f.Status.Conflicts)
+	}
+	service := &corev1.Service{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(foreignService), service); err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Ports[0].Port != 5432 || metav1.IsControlledBy(service, f) {
+		t.Fatalf("expected the foreign Service to be left alone, got %v", service)
+	}
+	if err := r.Get(ctx, key, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no Deployment running under a foreign ServiceAccount, got %v", err)
+	}
+
+	// Adopt the ServiceAccount, the Service stays with its controller
+	f.Annotations = map[string]string{adoptAnnotation: "true"}
+	if err := r.Update(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	reconcileRollout(t, r, f)
+
+	if err := r.Get(ctx, key, f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Status.Conflicts) != 1 || f.Status.Conflicts[0].Owner != "StatefulSet/db" {
+		t.Fatalf("expected only the Service conflict, got %v", f.Status.Conflicts)
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(unownedServiceAccount), serviceAccount); err != nil {
+		t.Fatal(err)
+	}
+	if !metav1.IsControlledBy(serviceAccount, f) {
+		t.Fatalf("expected the ServiceAccount to be adopted, got %v", serviceAccount.OwnerReferences)
+	}
+	if err := r.Get(ctx, key, &appsv1.Deployment{}); err != nil {
+		t.Fatalf("expected the Deployment once the ServiceAccount is adopted, got %v", err)
+	}
+}
+
+func TestResourcesOfFormerNamesAreMigrated(t *testing.T) {
+	f := testRollout()
+	f.Spec.Volumes = []oneclickiov1alpha1.VolumeSpec{{Name: "data", MountPath: "/data", Size: "1Gi", StorageClass: "standard"}}
+	owner := []metav1.OwnerReference{*metav1.NewControllerRef(f, oneclickiov1alpha1.GroupVersion.WithKind("Rollout"))}
+	legacyMeta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       f.Namespace,
+			Labels:          map[string]string{"one-click.dev/projectId": f.Namespace, "one-click.dev/deploymentId": f.Name},
+			OwnerReferences: owner,
+		}
+	}
+	legacyObjects := []client.Object{
+		&corev1.Service{ObjectMeta: legacyMeta("http-app-svc"), Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8080}}}},
+		&networkingv1.Ingress{ObjectMeta: legacyMeta("http-app-ingress"), Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{
+			Host: "app.example.com",
+			IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+				Paths: []networkingv1.HTTPIngressPath{{Path: "/"}},
+			}},
+		}}}},
+		&batchv1.CronJob{ObjectMeta: legacyMeta("cleanup"), Spec: batchv1.CronJobSpec{Schedule: "0 3 * * *"}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: legacyMeta("data-app"), Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}},
+		}},
+	}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, append([]client.Object{f}, legacyObjects...)...)
+	ctx := context.Background()
+
+	// Emulate the ingress-nginx admission webhook rejecting duplicate hosts and paths
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if ingress, ok := obj.(*networkingv1.Ingress); ok {
+				if err := rejectDuplicateIngressPaths(ctx, c, ingress); err != nil {
+					return err
+				}
+			}
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	})
+
+	reconcileRollout(t, r, f)
+
+	// Services of former names stay as aliases
+	for _, name := range []string{naming.Service(f.Name, "http"), "http-app-svc"} {
+		service := &corev1.Service{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: f.Namespace}, service); err != nil {
+			t.Fatalf("expected Service %s: %v", name, err)
+		}
+		if service.Spec.Selector["one-click.dev/deploymentId"] != f.Name {
+			t.Errorf("expected Service %s to select the pods, got %v", name, service.Spec.Selector)
+		}
+		if name == "http-app-svc" && service.Labels["one-click.dev/legacy-name"] != "true" {
+			t.Errorf("expected Service %s to be labeled as legacy, got %v", name, service.Labels)
+		}
+	}
+
+	// Ingresses and CronJobs are replaced
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.Ingress(f.Name, "http"), Namespace: f.Namespace}, &networkingv1.Ingress{}); err != nil {
+		t.Fatalf("expected the Ingress of the new name: %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: "http-app-ingress", Namespace: f.Namespace}, &networkingv1.Ingress{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the Ingress of the former name to be removed, got %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.CronJob(f.Name, "cleanup"), Namespace: f.Namespace}, &batchv1.CronJob{}); err != nil {
+		t.Fatalf("expected the CronJob of the new name: %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: "cleanup", Namespace: f.Namespace}, &batchv1.CronJob{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the CronJob of the former name to be removed, got %v", err)
+	}
+
+	// PVCs keep their names
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if claim := deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "data-app" {
+		t.Fatalf("expected the Deployment to mount PVC data-app, got %v", deployment.Spec.Template.Spec.Volumes[0])
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.PersistentVolumeClaim(f.Name, "data"), Namespace: f.Namespace}, &corev1.PersistentVolumeClaim{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no PVC of the new name, got %v", err)
+	}
+}
+
+// rejectDuplicateIngressPaths fails like the ingress-nginx admission webhook if
+// another Ingress serves a host and path of the ingress.
+func TestCopiedTLSSecretsDropTheCertManagerAnnotations(t *testing.T) {
+	f := testRollout()
+	legacy := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      naming.LegacyTLSSecret(f.Name, "http"),
+			Namespace: f.Namespace,
+			Annotations: map[string]string{
+				"cert-manager.io/certificate-name": naming.LegacyTLSSecret(f.Name, "http"),
+				"cert-manager.io/issuer-name":      "letsencrypt",
+				"team":                             "payments",
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")},
+	}
+	r := newTestReconciler(t, &writeCounter{}, f, legacy)
+
+	if err := r.copyLegacyTLSSecret(context.Background(), f, f.Spec.Interfaces[0]); err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: naming.TLSSecret(f.Name, "http"), Namespace: f.Namespace}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(secret.Annotations, map[string]string{"team": "payments"}) {
+		t.Errorf("expected only the annotations not set by cert-manager, got %v", secret.Annotations)
+	}
+	if string(secret.Data["tls.crt"]) != "crt" || secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("expected the certificate to be copied, got %v", secret)
+	}
+}
+
+func rejectDuplicateIngressPaths(ctx context.Context, c client.Client, ingress *networkingv1.Ingress) error {
+	ingresses := &networkingv1.IngressList{}
+	if err := c.List(ctx, ingresses, client.InNamespace(ingress.Namespace)); err != nil {
+		return err
+	}
+	for _, other := range ingresses.Items {
+		if other.Name == ingress.Name {
+			continue
+		}
+		for _, host := range (&RolloutReconciler{}).ingressHosts(&other) {
+			for _, rule := range ingress.Spec.Rules {
+				if rule.Host == host {
+					return fmt.Errorf("admission webhook denied the request: host %q and path is already defined in ingress %s", host, other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestRolloutsViolatingTheConfigAreNotReconciled(t *testing.T) {
+	f := testRollout()
+	cfg, err := config.Parse([]byte("allowedRegistries: [ghcr.io/acme]\nresourceCeilings:\n  memory: 1Gi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+	r.Config = config.NewStore(cfg)
+	ctx := context.Background()
+	key := types.NamespacedName{Name: f.Name, Namespace: f.Namespace}
+
+	reconcileRollout(t, r, f)
+
+	if err := r.Get(ctx, key, f); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(f.Status.Conditions, ConditionPolicyViolation)
+	if condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Fatalf("expected the PolicyViolation condition to be true, got %v", condition)
+	}
+	if err := r.Get(ctx, key, &appsv1.Deployment{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no Deployment of an image from a registry not allowed, got %v", err)
+	}
+
+	// Allow the registry, the defaults of the config apply
+	cfg, err = config.Parse([]byte("allowedRegistries: [docker.io]\ndefaults:\n  ingressPathType: Prefix\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Config.Set(cfg)
+	reconcileRollout(t, r, f)
+
+	if err := r.Get(ctx, key, f); err != nil {
+		t.Fatal(err)
+	}
+	condition = meta.FindStatusCondition(f.Status.Conditions, ConditionPolicyViolation)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Fatalf("expected the PolicyViolation condition to be false, got %v", condition)
+	}
+	if err := r.Get(ctx, key, &appsv1.Deployment{}); err != nil {
+		t.Fatalf("expected the Deployment once the registry is allowed, got %v", err)
+	}
+	ingress := &networkingv1.Ingress{}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.Ingress(f.Name, "http"), Namespace: f.Namespace}, ingress); err != nil {
+		t.Fatal(err)
+	}
+	if pathType := ingress.Spec.Rules[0].HTTP.Paths[0].PathType; pathType == nil || *pathType != networkingv1.PathTypePrefix {
+		t.Fatalf("expected the configured path type, got %v", pathType)
+	}
+}
+
+func TestObjectsAreLabeledInTheConfiguredDomain(t *testing.T) {
+	f := testRollout()
+	cfg, err := config.Parse([]byte("labelDomain: apps.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+	r.Config = config.NewStore(cfg)
+	ctx := context.Background()
+
+	reconcileRollout(t, r, f)
+
+	want := map[string]string{"apps.example.com/projectId": f.Namespace, "apps.example.com/deploymentId": f.Name}
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	service := &corev1.Service{}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.Service(f.Name, "http"), Namespace: f.Namespace}, service); err != nil {
+		t.Fatal(err)
+	}
+	ingress := &networkingv1.Ingress{}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.Ingress(f.Name, "http"), Namespace: f.Namespace}, ingress); err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]map[string]string{
+		"Deployment labels":   deployment.Labels,
+		"Deployment selector": deployment.Spec.Selector.MatchLabels,
+		"Service selector":    service.Spec.Selector,
+		"Ingress labels":      ingress.Labels,
+	} {
+		if len(got) != len(want) || got["apps.example.com/projectId"] != f.Namespace || got["apps.example.com/deploymentId"] != f.Name {
+			t.Errorf("expected %s %v, got %v", name, want, got)
+		}
+	}
+
+	// The objects are found again in the domain
+	counter.reset()
+	reconcileRollout(t, r, f)
+	if writes := counter.reset(); len(writes) != 0 {
+		t.Fatalf("expected no writes for an unchanged Rollout, got %v", writes)
+	}
+}
+
+func TestRolloutsOutOfScopeAreIgnored(t *testing.T) {
+	inScope := testRollout()
+	outOfScope := testRollout()
+	outOfScope.Namespace, outOfScope.UID = "other", "other-uid"
+	projectNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: inScope.Namespace, Labels: map[string]string{"one-click.dev/project": "true"}}}
+	otherNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: outOfScope.Namespace}}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, inScope, outOfScope, projectNamespace, otherNamespace)
+	selector, err := labels.Parse("one-click.dev/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Scope = &scope.Scope{NamespaceSelector: selector}
+	ctx := context.Background()
+
+	reconcileRollout(t, r, inScope)
+	reconcileRollout(t, r, outOfScope)
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(inScope), &appsv1.Deployment{}); err != nil {
+		t.Fatalf("expected the Deployment of the Rollout in scope, got %v", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(outOfScope), &appsv1.Deployment{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no Deployment of the Rollout out of scope, got %v", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(outOfScope), outOfScope); err != nil {
+		t.Fatal(err)
+	}
+	if len(outOfScope.Finalizers) != 0 || len(outOfScope.Status.Conditions) != 0 {
+		t.Fatalf("expected the Rollout out of scope to be left untouched, got %v", outOfScope)
+	}
+	if r.Scope.Predicate(r.Client).Generic(event.GenericEvent{Object: outOfScope}) {
+		t.Fatal("expected events of the Rollout out of scope to be dropped")
+	}
+
+	// Label the namespace into scope
+	otherNamespace.Labels = map[string]string{"one-click.dev/project": "true"}
+	if err := r.Update(ctx, otherNamespace); err != nil {
+		t.Fatal(err)
+	}
+	if requests := r.rolloutsInNamespace(ctx, otherNamespace); len(requests) != 1 || requests[0].Name != outOfScope.Name {
+		t.Fatalf("expected the Rollout of the labeled namespace to be enqueued, got %v", requests)
+	}
+	reconcileRollout(t, r, outOfScope)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(outOfScope), &appsv1.Deployment{}); err != nil {
+		t.Fatalf("expected the Deployment once the namespace is in scope, got %v", err)
+	}
+}
+
+func TestRolloutsDeletedOutOfScopeAreFinalized(t *testing.T) {
+	f := deletingRollout(nil, time.Now())
+	f.Spec.Volumes = nil
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: f.Namespace}}
+	r := newTestReconciler(t, &writeCounter{}, f, namespace)
+	selector, err := labels.Parse("one-click.dev/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Scope = &scope.Scope{NamespaceSelector: selector}
+
+	if !rolloutBeingDeleted.Update(event.UpdateEvent{ObjectOld: f, ObjectNew: f}) {
+		t.Fatal("expected events of the deleted Rollout to pass")
+	}
+	for i := 0; i < 5 && deletionPhase(t, r, f) != "Gone"; i++ {
+		finalizeOnce(t, r, f)
+	}
+	if phase := deletionPhase(t, r, f); phase != "Gone" {
+		t.Fatalf("expected the Rollout out of scope to be finalized, got phase %q", phase)
+	}
+
+	// Rollouts of other shards are left to their replica
+	other := deletingRollout(nil, time.Now())
+	other.Namespace = "other"
+	r = newTestReconciler(t, &writeCounter{}, other)
+	r.Scope = &scope.Scope{Shards: 2, Shard: 1 - scope.ShardOf(other.Namespace, 2)}
+	finalizeOnce(t, r, other)
+	if phase := deletionPhase(t, r, other); phase != "" {
+		t.Fatalf("expected the Rollout of another shard to be left alone, got phase %q", phase)
+	}
+}
+
+func TestBasicAuthHashesAreReusedForUnchangedUsers(t *testing.T) {
+	f := testRollout()
+	intf := f.Spec.Interfaces[0]
+	intf.Ingress.BasicAuth = &oneclickiov1alpha1.IngressBasicAuth{SecretName: "users"}
+	users := &corev1.Secret{Data: map[string][]byte{"alice": []byte("wonderland")}}
+	r := newTestReconciler(t, &writeCounter{})
+
+	first, err := r.basicAuthSecretForRollout(f, intf, users, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unchanged users Secret reuses the hashes as they are, even ones
+	// that would not verify, since they are not compared again
+	current := first.DeepCopy()
+	current.Data["auth"] = []byte("alice:not-a-bcrypt-hash\n")
+	second, err := r.basicAuthSecretForRollout(f, intf, users, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second.Data["auth"]) != "alice:not-a-bcrypt-hash\n" {
+		t.Fatalf("expected the hash to be reused without comparison, got %q", second.Data["auth"])
+	}
+
+	// A changed users Secret is hashed again
+	users.Data["alice"] = []byte("looking-glass")
+	third, err := r.basicAuthSecretForRollout(f, intf, users, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(third.Data["auth"]) == "alice:not-a-bcrypt-hash\n" || third.Annotations["one-click.dev/users-checksum"] == first.Annotations["one-click.dev/users-checksum"] {
+		t.Fatalf("expected a new hash and checksum for the changed password, got %v", third)
+	}
+}
+
+func TestBasicAuthUsersNamedLikeTheLayoutKeys(t *testing.T) {
+	f := testRollout()
+	intf := f.Spec.Interfaces[0]
+	intf.Ingress.BasicAuth = &oneclickiov1alpha1.IngressBasicAuth{SecretName: "users"}
+	users := &corev1.Secret{Data: map[string][]byte{"auth": []byte("one"), "users": []byte("two"), "alice": []byte("three")}}
+
+	for _, flavour := range []string{IngressControllerNginx, IngressControllerTraefik, IngressControllerHAProxy} {
+		r := newTestReconciler(t, &writeCounter{})
+		r.IngressController = flavour
+		secret, err := r.basicAuthSecretForRollout(f, intf, users, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := parseBasicAuthSecret(secret)
+		if len(hashes) != len(users.Data) {
+			t.Fatalf("%s: expected a hash per user, got %v", flavour, hashes)
+		}
+		for user, password := range users.Data {
+			if bcrypt.CompareHashAndPassword([]byte(hashes[user]), password) != nil {
+				t.Errorf("%s: expected the hash of user %s to be read back, got %q", flavour, user, hashes[user])
+			}
+		}
+	}
+}
+
+func TestAllowedSourceRangesFollowTheNginxVersion(t *testing.T) {
+	f := testRollout()
+	intf := f.Spec.Interfaces[0]
+	intf.Ingress.AllowedSourceRanges = []string{"10.0.0.0/8", "192.168.0.0/16"}
+	r := newTestReconciler(t, &writeCounter{})
+
+	annotations, _ := r.ingressFeatureAnnotations(f, intf)
+	if annotations["nginx.ingress.kubernetes.io/whitelist-source-range"] != "10.0.0.0/8,192.168.0.0/16" {
+		t.Fatalf("expected the former annotation by default, got %v", annotations)
+	}
+
+	r.NginxAllowlistAnnotation = true
+	annotations, _ = r.ingressFeatureAnnotations(f, intf)
+	if _, ok := annotations["nginx.ingress.kubernetes.io/whitelist-source-range"]; ok || annotations["nginx.ingress.kubernetes.io/allowlist-source-range"] != "10.0.0.0/8,192.168.0.0/16" {
+		t.Fatalf("expected only the allowlist annotation, got %v", annotations)
+	}
+}
+
+func TestGeneratedHostsAreIndexed(t *testing.T) {
+	f := testRollout()
+	f.Spec.Interfaces[0].Ingress.Rules = nil
+	f.Spec.Interfaces[0].Ingress.AutoHost = true
+	r := &RolloutReconciler{DefaultDomain: "apps.example.com"}
+
+	hosts := r.rolloutHosts(f)
+	if len(hosts) != 1 || hosts[0] != "http-app-project.apps.example.com" {
+		t.Fatalf("expected the generated host to be indexed, got %v", hosts)
+	}
+}
+
+func TestGeneratedHostsFitDNSLabels(t *testing.T) {
+	f := testRollout()
+	f.Name = "App-" + strings.Repeat("a", 70)
+	intf := f.Spec.Interfaces[0]
+	r := &RolloutReconciler{DefaultDomain: "apps.example.com"}
+
+	host, err := r.generateHost(f, intf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, rest, _ := strings.Cut(host, ".")
+	if len(first) != maxHostLabelLength || rest != "apps.example.com" || first != strings.ToLower(first) {
+		t.Fatalf("expected the first label truncated to %d lowercase characters, got %s", maxHostLabelLength, host)
+	}
+	if again, _ := r.generateHost(f, intf); again != host {
+		t.Fatalf("expected a stable host, got %s and %s", host, again)
+	}
+
+	// Names sharing the truncated prefix keep distinct hosts
+	f.Name += "b"
+	if other, _ := r.generateHost(f, intf); other == host {
+		t.Fatalf("expected distinct hosts for distinct names, got %s twice", host)
+	}
+
+	r.HostTemplate = template.Must(template.New("host").Parse("{{.Rollout}}.{{.Namespace}}.{{.Domain}}"))
+	f.Name = "app"
+	if host, err := r.generateHost(f, intf); err != nil || host != "app.project.apps.example.com" {
+		t.Fatalf("expected the host of the template, got %s, %v", host, err)
+	}
+}
+
+func TestGeneratedHostCollisionsAreSuffixed(t *testing.T) {
+	f := testRollout()
+	f.Spec.Interfaces[0].Ingress.Rules = nil
+	f.Spec.Interfaces[0].Ingress.AutoHost = true
+	f.Name = strings.Repeat("a", 50)
+	claimed := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other", Labels: map[string]string{"one-click.dev/deploymentId": f.Name}},
+		Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{
+			{Host: "http-" + strings.Repeat("a", 50) + "-project.apps.example.com"},
+		}},
+	}
+	r := newTestReconciler(t, &writeCounter{}, claimed)
+	r.DefaultDomain = "apps.example.com"
+
+	interfaces, err := r.resolveAutoHosts(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := interfaces[0].Ingress.Rules[0].Host
+	first, rest, _ := strings.Cut(host, ".")
+	if host == claimed.Spec.Rules[0].Host || rest != "apps.example.com" || len(first) > maxHostLabelLength {
+		t.Fatalf("expected a suffixed host within the DNS label limit, got %s", host)
+	}
+	if again, _ := r.resolveAutoHosts(context.Background(), f); again[0].Ingress.Rules[0].Host != host {
+		t.Fatalf("expected a stable suffix, got %s and %s", host, again[0].Ingress.Rules[0].Host)
+	}
+
+	// The Rollout already serving the host keeps it
+	claimed.Namespace = f.Namespace
+	r = newTestReconciler(t, &writeCounter{}, claimed)
+	r.DefaultDomain = "apps.example.com"
+	if interfaces, err := r.resolveAutoHosts(context.Background(), f); err != nil || interfaces[0].Ingress.Rules[0].Host != claimed.Spec.Rules[0].Host {
+		t.Fatalf("expected the served host to be kept, got %v, %v", interfaces, err)
+	}
+}
+
+func TestSecretsMountedIntoOneDirectoryShareAVolume(t *testing.T) {
+	f := testRollout()
+	f.Spec.Secrets = []oneclickiov1alpha1.SecretItem{
+		{Name: "TLS_CRT", Value: "crt", Mount: &oneclickiov1alpha1.SecretMount{MountPath: "/etc/tls", FileName: "tls.crt"}},
+		{Name: "API_TOKEN", Value: "token"},
+		{Name: "TLS_KEY", Value: "key", Mount: &oneclickiov1alpha1.SecretMount{MountPath: "/etc/tls", FileName: "tls.key", Mode: ptr.To(int32(0o400))}},
+		{Name: "config.json", Value: "{}", Mount: &oneclickiov1alpha1.SecretMount{MountPath: "/etc/app"}},
+	}
+
+	volumes, mounts := secretVolumesForRollout(f)
+	if len(volumes) != 2 || len(mounts) != 2 {
+		t.Fatalf("expected a volume per directory, got %v and %v", volumes, mounts)
+	}
+	want := []corev1.KeyToPath{{Key: "TLS_CRT", Path: "tls.crt"}, {Key: "TLS_KEY", Path: "tls.key", Mode: ptr.To(int32(0o400))}}
+	if mounts[0].MountPath != "/etc/tls" || !equality.Semantic.DeepEqual(volumes[0].Secret.Items, want) {
+		t.Fatalf("expected both TLS files in one volume at /etc/tls, got %v at %s", volumes[0].Secret.Items, mounts[0].MountPath)
+	}
+	if items := volumes[1].Secret.Items; len(items) != 1 || items[0].Path != "config.json" || !mounts[1].ReadOnly {
+		t.Fatalf("expected the file to be named after the key and mounted read-only, got %v", volumes[1])
+	}
+
+	// Reordering the entries keeps the volume names
+	names := map[string]string{}
+	for i, mount := range mounts {
+		names[mount.MountPath] = volumes[i].Name
+	}
+	f.Spec.Secrets[0], f.Spec.Secrets[3] = f.Spec.Secrets[3], f.Spec.Secrets[0]
+	volumes, mounts = secretVolumesForRollout(f)
+	for i, mount := range mounts {
+		if volumes[i].Name != names[mount.MountPath] {
+			t.Errorf("expected the volume of %s to keep its name %s, got %s", mount.MountPath, names[mount.MountPath], volumes[i].Name)
+		}
+	}
+}
+
+func TestSecretsChecksumDistinguishesValueBoundaries(t *testing.T) {
+	for name, pair := range map[string][2]map[string]string{
+		"value moved into the key":    {{"A": "BC"}, {"AB": "C"}},
+		"value moved to the next key": {{"A": "B", "C": "D"}, {"A": "BC", "": "D"}},
+		"empty and missing value":     {{"A": ""}, {}},
+		"changed value":               {{"A": "B"}, {"A": "C"}},
+	} {
+		if calculateSecretsChecksum(pair[0]) == calculateSecretsChecksum(pair[1]) {
+			t.Errorf("%s: expected %v and %v to have different checksums", name, pair[0], pair[1])
+		}
+	}
+
+	if calculateSecretsChecksum(map[string]string{"A": "1", "B": "2"}) != calculateSecretsChecksum(map[string]string{"B": "2", "A": "1"}) {
+		t.Error("expected the checksum not to depend on the map order")
+	}
+}
+
+// recordingProvider returns the path it was asked for as the value.
+type recordingProvider struct{}
+
+func (recordingProvider) GetSecret(_ context.Context, path, _ string) ([]byte, error) {
+	return []byte(path), nil
+}
+
+func TestProviderPathsAreScopedToTheNamespace(t *testing.T) {
+	f := testRollout()
+	r := newTestReconciler(t, &writeCounter{})
+	r.SecretProviders = map[string]secretstore.Provider{"vault": recordingProvider{}}
+
+	source := &oneclickiov1alpha1.SecretValueSource{Provider: &oneclickiov1alpha1.SecretProviderReference{Name: "vault", Path: "apps/db"}}
+	value, err := r.resolveSecretValueFrom(context.Background(), f, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "project/apps/db" {
+		t.Fatalf("expected the path below the namespace, got %s", value)
+	}
+
+	source.Provider.Path = "../other/apps/db"
+	if value, err := r.resolveSecretValueFrom(context.Background(), f, source); err == nil {
+		t.Fatalf("expected a path leaving the namespace to be rejected, read %s", value)
+	}
+}
+
+func TestSharedSecretsAreReadOutsideTheCache(t *testing.T) {
+	f := testRollout()
+	r := newTestReconciler(t, &writeCounter{})
+	// The cache only holds the namespaces in scope, e.g. with --watch-namespaces
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if key.Namespace != f.Namespace {
+				return fmt.Errorf("unable to get: %s because of unknown namespace for the cache", key)
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+	r.APIReader = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shared", Annotations: map[string]string{shareWithAnnotation: f.Namespace}},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}).Build()
+
+	source := &oneclickiov1alpha1.SecretValueSource{SecretKeyRef: &oneclickiov1alpha1.SecretKeyReference{Name: "db", Namespace: "shared", Key: "password"}}
+	value, err := r.resolveSecretValueFrom(context.Background(), f, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "secret" {
+		t.Fatalf("expected the value of the shared Secret, got %s", value)
+	}
+}
+
+func TestUnlabelledSecretsAreReadOutsideTheCache(t *testing.T) {
+	ring, err := sealing.NewKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ringData, err := ring.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := testRollout()
+	encrypted, err := sealing.Encrypt(ring.PublicKey(), f.Namespace, f.Name, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Spec.Interfaces[0].Ingress.BasicAuth = &oneclickiov1alpha1.IngressBasicAuth{SecretName: "users"}
+	f.Spec.Secrets = []oneclickiov1alpha1.SecretItem{
+		{Name: "DB_PASSWORD", ValueFrom: &oneclickiov1alpha1.SecretValueSource{SecretKeyRef: &oneclickiov1alpha1.SecretKeyReference{Name: "db", Key: "password"}}},
+		{Name: "API_KEY", EncryptedValue: encrypted},
+	}
+	r := newTestReconciler(t, &writeCounter{}, f,
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "users", Namespace: f.Namespace}, Data: map[string][]byte{"alice": []byte("wonderland")}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: f.Namespace}, Data: map[string][]byte{"password": []byte("secret")}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: sealing.KeySecretName, Namespace: "one-click-system"}, Data: ringData})
+	r.OperatorNamespace = "one-click-system"
+	// The cache only holds the Secrets of Rollouts, e.g. with --cache-by-label
+	r.APIReader = r.Client
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if err := c.Get(ctx, key, obj, opts...); err != nil {
+				return err
+			}
+			if _, ok := obj.(*corev1.Secret); ok && obj.GetLabels()["one-click.dev/deploymentId"] == "" {
+				return errors.NewNotFound(corev1.Resource("secrets"), key.Name)
+			}
+			return nil
+		},
+	})
+
+	reconcileRollout(t, r, f)
+
+	secret := &corev1.Secret{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: naming.Secret(f.Name), Namespace: f.Namespace}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["DB_PASSWORD"]) != "secret" || string(secret.Data["API_KEY"]) != "hunter2" {
+		t.Errorf("expected the referenced and decrypted values, got %v", secret.Data)
+	}
+	auth := &corev1.Secret{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: basicAuthSecretName(f, f.Spec.Interfaces[0]), Namespace: f.Namespace}, auth); err != nil {
+		t.Fatalf("expected the basic auth Secret of the users Secret: %v", err)
+	}
+	if !strings.HasPrefix(string(auth.Data["auth"]), "alice:") {
+		t.Errorf("expected the users to be hashed, got %q", auth.Data["auth"])
+	}
+}
+
+func TestRemovedGeneratedSecretsAreKeptUntilForgotten(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Secrets = []oneclickiov1alpha1.SecretItem{{Name: "DATABASE_PASSWORD", Generate: &oneclickiov1alpha1.SecretGenerator{}}}
+	r := newTestReconciler(t, &writeCounter{}, f)
+
+	generated, _, err := r.reconcileGeneratedSecrets(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := generated["DATABASE_PASSWORD"]
+	if password == "" {
+		t.Fatal("expected a generated password")
+	}
+
+	// Removing and re-adding the secret restores the value
+	secrets := f.Spec.Secrets
+	f.Spec.Secrets = []oneclickiov1alpha1.SecretItem{{Name: "API_TOKEN", Generate: &oneclickiov1alpha1.SecretGenerator{}}}
+	if _, _, err := r.reconcileGeneratedSecrets(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Spec.Secrets = append(f.Spec.Secrets, secrets...)
+	if generated, _, err = r.reconcileGeneratedSecrets(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if generated["DATABASE_PASSWORD"] != password {
+		t.Fatal("expected the value of the re-added secret to be restored")
+	}
+
+	// Forgotten values are dropped, re-adding generates a new one
+	f.Spec.Secrets = f.Spec.Secrets[:1]
+	f.Annotations = map[string]string{forgetSecretsAnnotation: "DATABASE_PASSWORD"}
+	if _, _, err := r.reconcileGeneratedSecrets(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	stored := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.GeneratedSecret(f.Name), Namespace: f.Namespace}, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored.Data["DATABASE_PASSWORD"]; ok {
+		t.Fatal("expected the forgotten value to be dropped")
+	}
+	if _, ok := stored.Data["API_TOKEN"]; !ok {
+		t.Fatal("expected the generated values to be kept")
+	}
+}
+
+func hookTemplate(tag string) *corev1.PodTemplateSpec {
+	return &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"one-click.dev/projectId": "project", "one-click.dev/deploymentId": "app"},
+			Annotations: map[string]string{podTemplateHashAnnotation: tag},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "docker.io/nginx:" + tag}}},
+	}
+}
+
+// finishHookJob marks the hook Job of a pod template as complete or failed.
+func finishHookJob(t *testing.T, r *RolloutReconciler, kind, hash string, condition batchv1.JobConditionType) {
+	t.Helper()
+	ctx := context.Background()
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.HookJob("app", kind, hash), Namespace: "project"}, job); err != nil {
+		t.Fatalf("expected the %s hook Job for %s: %v", kind, hash, err)
+	}
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: condition, Status: corev1.ConditionTrue, Reason: "Test"})
+	if err := r.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertHooksCondition(t *testing.T, f *oneclickiov1alpha1.Rollout, status metav1.ConditionStatus, reason string) *metav1.Condition {
+	t.Helper()
+	condition := meta.FindStatusCondition(f.Status.Conditions, ConditionHooksSucceeded)
+	if condition == nil || condition.Status != status || condition.Reason != reason {
+		t.Fatalf("expected condition %s/%s, got %+v", status, reason, condition)
+	}
+	return condition
+}
+
+func TestPreDeployHookBlocksUntilItSucceeds(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Hooks = &oneclickiov1alpha1.HooksSpec{PreDeploy: &oneclickiov1alpha1.HookSpec{Command: []string{"./migrate"}}}
+	r := newTestReconciler(t, &writeCounter{}, f)
+
+	blocked, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v1"), "v1")
+	if err != nil || !blocked {
+		t.Fatalf("expected a running pre-deploy hook to block, got %v, %v", blocked, err)
+	}
+	assertHooksCondition(t, f, metav1.ConditionUnknown, "PreDeployRunning")
+
+	finishHookJob(t, r, "pre", "v1", batchv1.JobComplete)
+	blocked, err = r.preDeployHookBlocks(ctx, f, hookTemplate("v1"), "v1")
+	if err != nil || blocked {
+		t.Fatalf("expected a succeeded pre-deploy hook to release the update, got %v, %v", blocked, err)
+	}
+	assertHooksCondition(t, f, metav1.ConditionTrue, "Succeeded")
+}
+
+func TestFailedPreDeployHookBlocksUntilTheTemplateChanges(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Hooks = &oneclickiov1alpha1.HooksSpec{PreDeploy: &oneclickiov1alpha1.HookSpec{Command: []string{"./migrate"}}}
+	counter := &writeCounter{}
+	r := newTestReconciler(t, counter, f)
+
+	if _, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v1"), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	finishHookJob(t, r, "pre", "v1", batchv1.JobFailed)
+	counter.reset()
+
+	for i := 0; i < 2; i++ {
+		blocked, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v1"), "v1")
+		if err != nil || !blocked {
+			t.Fatalf("expected a failed pre-deploy hook to block, got %v, %v", blocked, err)
+		}
+		assertHooksCondition(t, f, metav1.ConditionFalse, "PreDeployFailed")
+	}
+	for _, write := range counter.reset() {
+		if write == "create Job "+naming.HookJob("app", "pre", "v1") {
+			t.Fatal("expected the failed hook not to run again")
+		}
+	}
+
+	// A new pod template runs the hook again
+	blocked, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v2"), "v2")
+	if err != nil || !blocked {
+		t.Fatalf("expected the hook of the new pod template to run, got %v, %v", blocked, err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: naming.HookJob("app", "pre", "v2"), Namespace: "project"}, &batchv1.Job{}); err != nil {
+		t.Fatalf("expected a hook Job for the new pod template: %v", err)
+	}
+}
+
+func rolledOutDeployment(hash string) *appsv1.Deployment {
+	labels := map[string]string{"one-click.dev/projectId": "project", "one-click.dev/deploymentId": "app"}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "project", UID: "deployment-uid"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(1)),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: *hookTemplate(hash),
+		},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 10, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	}
+}
+
+func replicaSetOf(deployment *appsv1.Deployment, hash, revision string) *appsv1.ReplicaSet {
+	template := hookTemplate(hash)
+	template.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = hash
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-" + hash,
+			Namespace:   "project",
+			Labels:      deployment.Spec.Selector.MatchLabels,
+			Annotations: map[string]string{"deployment.kubernetes.io/revision": revision},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1", Kind: "Deployment", Name: deployment.Name, UID: deployment.UID, Controller: ptr.To(true),
+			}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Selector: deployment.Spec.Selector, Template: *template},
+	}
+}
+
+func TestFailedPostDeployHookRollsBackOnce(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Hooks = &oneclickiov1alpha1.HooksSpec{PostDeploy: &oneclickiov1alpha1.HookSpec{Command: []string{"./smoke-test"}, Rollback: true}}
+	deployment := rolledOutDeployment("v2")
+	r := newTestReconciler(t, &writeCounter{}, f, deployment, replicaSetOf(deployment, "v1", "1"), replicaSetOf(deployment, "v2", "2"))
+
+	var patches []client.PatchOptions
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if _, ok := obj.(*appsv1.Deployment); ok {
+				patchOpts := client.PatchOptions{}
+				patchOpts.ApplyOptions(opts)
+				patches = append(patches, patchOpts)
+			}
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	})
+
+	if err := r.reconcilePostDeployHook(ctx, f, hookTemplate("v2"), "v2"); err != nil {
+		t.Fatal(err)
+	}
+	assertHooksCondition(t, f, metav1.ConditionUnknown, "PostDeployRunning")
+
+	finishHookJob(t, r, "post", "v2", batchv1.JobFailed)
+	for i := 0; i < 2; i++ {
+		if err := r.reconcilePostDeployHook(ctx, f, hookTemplate("v2"), "v2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	condition := assertHooksCondition(t, f, metav1.ConditionFalse, "PostDeployFailed")
+	if condition.Message != "The post-deploy hook failed, rolled back to revision 1" {
+		t.Errorf("unexpected condition message %q", condition.Message)
+	}
+
+	if len(patches) != 1 || patches[0].FieldManager != fieldManager {
+		t.Fatalf("expected a single rollback patch by %s, got %+v", fieldManager, patches)
+	}
+	current := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(deployment), current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Spec.Template.Annotations[podTemplateHashAnnotation] != "v1" {
+		t.Fatalf("expected the Deployment to be rolled back to v1, got %s", current.Spec.Template.Annotations[podTemplateHashAnnotation])
+	}
+	if _, ok := current.Spec.Template.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok {
+		t.Error("expected the pod-template-hash label of the ReplicaSet to be dropped")
+	}
+
+	// The rolled back pod template is held back until it changes
+	blocked, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v2"), "v2")
+	if err != nil || !blocked {
+		t.Fatalf("expected the rolled back pod template to stay blocked, got %v, %v", blocked, err)
+	}
+	if blocked, err := r.preDeployHookBlocks(ctx, f, hookTemplate("v3"), "v3"); err != nil || blocked {
+		t.Fatalf("expected a new pod template to be deployed, got %v, %v", blocked, err)
+	}
+}
+
+func TestFailedPostDeployHookWithoutPreviousRevision(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Hooks = &oneclickiov1alpha1.HooksSpec{PostDeploy: &oneclickiov1alpha1.HookSpec{Command: []string{"./smoke-test"}, Rollback: true}}
+	deployment := rolledOutDeployment("v1")
+	r := newTestReconciler(t, &writeCounter{}, f, deployment, replicaSetOf(deployment, "v1", "1"))
+
+	if err := r.reconcilePostDeployHook(ctx, f, hookTemplate("v1"), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	finishHookJob(t, r, "post", "v1", batchv1.JobFailed)
+	if err := r.reconcilePostDeployHook(ctx, f, hookTemplate("v1"), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	condition := assertHooksCondition(t, f, metav1.ConditionFalse, "PostDeployFailed")
+	if condition.Message != "The post-deploy hook failed, there is no previous revision to roll back to" {
+		t.Errorf("unexpected condition message %q", condition.Message)
+	}
+}
+
+func TestHookHistoryIsPruned(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	f.Spec.Hooks = &oneclickiov1alpha1.HooksSpec{PreDeploy: &oneclickiov1alpha1.HookSpec{Command: []string{"./migrate"}}}
+	r := newTestReconciler(t, &writeCounter{}, f)
+
+	for i := 1; i <= maxHookHistory+2; i++ {
+		hash := "v" + strconv.Itoa(i)
+		if _, err := r.preDeployHookBlocks(ctx, f, hookTemplate(hash), hash); err != nil {
+			t.Fatal(err)
+		}
+		finishHookJob(t, r, "pre", hash, batchv1.JobComplete)
+		if _, err := r.preDeployHookBlocks(ctx, f, hookTemplate(hash), hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(f.Status.Hooks) != maxHookHistory || f.Status.Hooks[0].Hash != "v12" || f.Status.Hooks[maxHookHistory-1].Hash != "v3" {
+		t.Fatalf("expected the %d newest runs v12 to v3, got %+v", maxHookHistory, f.Status.Hooks)
+	}
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace("project")); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != maxHookHistory {
+		t.Fatalf("expected the Jobs of pruned runs to be deleted, got %d Jobs", len(jobs.Items))
+	}
+	for _, job := range jobs.Items {
+		if job.Name == naming.HookJob("app", "pre", "v1") || job.Name == naming.HookJob("app", "pre", "v2") {
+			t.Fatalf("expected Job %s to be pruned", job.Name)
+		}
+	}
+}
+
+// appliedKeys returns the resources with a remembered applied state.
+func TestStatusCountsOnlyThePodsOfTheDeployment(t *testing.T) {
+	deployment := rolledOutDeployment("v1")
+	replicaSet := replicaSetOf(deployment, "v1", "1")
+	replicaSet.UID = "replicaset-uid"
+	pod := func(name, kind string, uid types.UID) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "project",
+			Labels:          deployment.Spec.Selector.MatchLabels,
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: kind, Name: name, UID: uid, Controller: ptr.To(true)}},
+		}}
+	}
+	r := newTestReconciler(t, &writeCounter{}, deployment, replicaSet,
+		pod("app-v1-abcde", "ReplicaSet", replicaSet.UID),
+		pod("app-cleanup-manual-fghij", "Job", "job-uid"),
+		pod("app-v1-klmno", "ReplicaSet", "foreign-replicaset-uid"))
+
+	pods, err := r.deploymentPods(context.Background(), deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 1 || pods[0].Name != "app-v1-abcde" {
+		t.Fatalf("expected only the pod of the ReplicaSet, got %v", pods)
+	}
+}
+
+func TestPodStatusesSummarizeTheContainers(t *testing.T) {
+	crashing := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "crashing"},
+		Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Image: "docker.io/nginx:1.27"}, {Image: "envoy"}}},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Ready:                true,
+					RestartCount:         1,
+					LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error"}},
+				},
+				{
+					RestartCount:         4,
+					State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+					LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled"}},
+				},
+			},
+		},
+	}
+	unschedulable := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "unschedulable", DeletionTimestamp: &metav1.Time{Time: time.Now()}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodPending,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable"}},
+		},
+	}
+
+	want := []oneclickiov1alpha1.PodStatus{
+		{Name: "crashing", Phase: "Running", Restarts: 5, Reason: "CrashLoopBackOff", LastTerminationReason: "Error", Node: "node-1", Image: "docker.io/nginx:1.27"},
+		{Name: "unschedulable", Phase: "Terminating", Reason: "Unschedulable"},
+	}
+	if got := podStatuses([]corev1.Pod{crashing, unschedulable}); !equality.Semantic.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDeploymentHealth(t *testing.T) {
+	crashing := oneclickiov1alpha1.PodStatus{Name: "app-1", Reason: "CrashLoopBackOff"}
+	oomKilled := oneclickiov1alpha1.PodStatus{Name: "app-1", Restarts: 2, LastTerminationReason: "OOMKilled"}
+	tests := []struct {
+		name   string
+		modify func(*appsv1.Deployment)
+		pods   []oneclickiov1alpha1.PodStatus
+		phase  string
+		reason string
+	}{
+		{name: "healthy", phase: oneclickiov1alpha1.DeploymentHealthy},
+		{name: "paused", modify: func(d *appsv1.Deployment) { d.Spec.Paused = true }, phase: oneclickiov1alpha1.DeploymentSuspended, reason: "Paused"},
+		{name: "scaled to zero", modify: func(d *appsv1.Deployment) { d.Spec.Replicas = ptr.To(int32(0)) }, phase: oneclickiov1alpha1.DeploymentSuspended, reason: "ScaledToZero"},
+		{
+			name: "progress deadline exceeded",
+			modify: func(d *appsv1.Deployment) {
+				d.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded"}}
+			},
+			phase:  oneclickiov1alpha1.DeploymentFailed,
+			reason: "ProgressDeadlineExceeded",
+		},
+		{name: "failing pod and nothing available", modify: func(d *appsv1.Deployment) { d.Status.AvailableReplicas = 0 }, pods: []oneclickiov1alpha1.PodStatus{crashing}, phase: oneclickiov1alpha1.DeploymentFailed, reason: "CrashLoopBackOff"},
+		{name: "failing pod next to available ones", pods: []oneclickiov1alpha1.PodStatus{crashing}, phase: oneclickiov1alpha1.DeploymentDegraded, reason: "CrashLoopBackOff"},
+		{name: "restarting after an OOM kill", pods: []oneclickiov1alpha1.PodStatus{oomKilled}, phase: oneclickiov1alpha1.DeploymentDegraded, reason: "OOMKilled"},
+		{name: "rolling out", modify: func(d *appsv1.Deployment) { d.Status.Replicas, d.Status.UpdatedReplicas = 2, 1 }, phase: oneclickiov1alpha1.DeploymentProgressing, reason: "RollingOut"},
+		{name: "unavailable replicas", modify: func(d *appsv1.Deployment) { d.Status.AvailableReplicas = 0 }, phase: oneclickiov1alpha1.DeploymentDegraded, reason: "ReplicasUnavailable"},
+	}
+	for _, tt := range tests {
+		deployment := rolledOutDeployment("v1")
+		deployment.Generation = 10
+		if tt.modify != nil {
+			tt.modify(deployment)
+		}
+		phase, reason, _ := deploymentHealth(deployment, tt.pods)
+		if phase != tt.phase || reason != tt.reason {
+			t.Errorf("%s: expected %s/%s, got %s/%s", tt.name, tt.phase, tt.reason, phase, reason)
+		}
+	}
+}
+
+func TestPodUpdatesAreWatchedOnHealthChanges(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-v1-abcde", Namespace: "project", Labels: map[string]string{"one-click.dev/deploymentId": "app"}},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastProbeTime: metav1.Now()}},
+			ContainerStatuses: []corev1.ContainerStatus{{Ready: true}},
+		},
+	}
+
+	probed := pod.DeepCopy()
+	probed.Status.Conditions[0].LastProbeTime = metav1.NewTime(time.Now().Add(time.Minute))
+	if podHealthChanged.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: probed}) {
+		t.Error("expected condition timestamps to be ignored")
+	}
+
+	crashed := pod.DeepCopy()
+	crashed.Status.ContainerStatuses[0] = corev1.ContainerStatus{
+		RestartCount: 1,
+		State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	}
+	if !podHealthChanged.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: crashed}) {
+		t.Error("expected a crashing container to be passed")
+	}
+	if !podHealthChanged.Create(event.CreateEvent{Object: pod}) || !podHealthChanged.Delete(event.DeleteEvent{Object: pod}) {
+		t.Error("expected created and deleted pods to be passed")
+	}
+
+	r := newTestReconciler(t, &writeCounter{})
+	requests := r.rolloutForPod(context.Background(), pod)
+	if len(requests) != 1 || requests[0].NamespacedName != (types.NamespacedName{Name: "app", Namespace: "project"}) {
+		t.Errorf("expected the pod to map to its Rollout, got %v", requests)
+	}
+	if requests := r.rolloutForPod(context.Background(), &corev1.Pod{}); len(requests) != 0 {
+		t.Errorf("expected unlabeled pods to map to nothing, got %v", requests)
+	}
+}
+
+func appliedKeys(r *RolloutReconciler, f *oneclickiov1alpha1.Rollout) []string {
+	var keys []string
+	if applied, ok := r.applied.Load(f.UID); ok {
+		applied.(*sync.Map).Range(func(key, _ any) bool {
+			keys = append(keys, key.(string))
+			return true
+		})
+	}
+	return keys
+}
+
+func TestAppliedStatesAreForgottenWithTheirResources(t *testing.T) {
+	ctx := context.Background()
+	f := testRollout()
+	r := newTestReconciler(t, &writeCounter{}, f)
+	reconcileRollout(t, r, f)
+
+	cronJobKey := "batch/v1, Kind=CronJob/project/" + naming.CronJob(f.Name, "cleanup")
+	hasKey := func(key string) bool {
+		for _, k := range appliedKeys(r, f) {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasKey(cronJobKey) {
+		t.Fatalf("expected the applied CronJob to be remembered, got %v", appliedKeys(r, f))
+	}
+
+	// A pruned resource is forgotten
+	if err := r.Get(ctx, client.ObjectKeyFromObject(f), f); err != nil {
+		t.Fatal(err)
+	}
+	f.Spec.CronJobs = nil
+	if err := r.Update(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	reconcileRollout(t, r, f)
+	if hasKey(cronJobKey) {
+		t.Fatal("expected the pruned CronJob to be forgotten")
+	}
+
+	// A deleted Rollout is forgotten altogether
+	if err := r.Delete(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	reconcileRollout(t, r, f)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(f), f); !errors.IsNotFound(err) {
+		t.Fatalf("expected the Rollout to be finalized, got %v", err)
+	}
+	if _, ok := r.applied.Load(f.UID); ok {
+		t.Fatalf("expected the applied states of the deleted Rollout to be dropped, got %v", appliedKeys(r, f))
+	}
+}
+
+// deletingRollout returns a Rollout with a volume and the cleanup finalizer,
+// deleted at deletedAt with the given policy.
+func deletingRollout(policy *oneclickiov1alpha1.DeletionPolicySpec, deletedAt time.Time) *oneclickiov1alpha1.Rollout {
+	f := testRollout()
+	f.Finalizers = []string{cleanupFinalizer}
+	f.DeletionTimestamp = &metav1.Time{Time: deletedAt}
+	f.Spec.DeletionPolicy = policy
+	f.Spec.Volumes = []oneclickiov1alpha1.VolumeSpec{{Name: "data", MountPath: "/data", Size: "1Gi"}}
+	return f
+}
+
+// objectsOfRollout returns the objects a reconcile created for f, ready to
+// seed a client that finalizes a deleted copy of f.
+func objectsOfRollout(t *testing.T, f *oneclickiov1alpha1.Rollout) []client.Object {
+	t.Helper()
+	ctx := context.Background()
+	live := f.DeepCopy()
+	live.DeletionTimestamp = nil
+	live.Finalizers = nil
+	r := newTestReconciler(t, &writeCounter{}, live)
+	reconcileRollout(t, r, live)
+
+	var objs []client.Object
+	for _, list := range []client.ObjectList{
+		&appsv1.DeploymentList{}, &corev1.ServiceList{}, &networkingv1.IngressList{},
+		&corev1.PersistentVolumeClaimList{}, &batchv1.CronJobList{}, &autoscalingv2.HorizontalPodAutoscalerList{},
+	} {
+		if err := r.List(ctx, list, client.InNamespace(f.Namespace)); err != nil {
+			t.Fatal(err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range items {
+			obj := item.(client.Object)
+			obj.SetResourceVersion("")
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+func finalizeOnce(t *testing.T, r *RolloutReconciler, f *oneclickiov1alpha1.Rollout) ctrl.Result {
+	t.Helper()
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(f)})
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	return result
+}
+
+func deletionPhase(t *testing.T, r *RolloutReconciler, f *oneclickiov1alpha1.Rollout) string {
+	t.Helper()
+	current := &oneclickiov1alpha1.Rollout{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(f), current); err != nil {
+		if errors.IsNotFound(err) {
+			return "Gone"
+		}
+		t.Fatal(err)
+	}
+	if current.Status.Deletion == nil {
+		return ""
+	}
+	return current.Status.Deletion.Phase
+}
+
+func countObjects(t *testing.T, r *RolloutReconciler, list client.ObjectList) int {
+	t.Helper()
+	if err := r.List(context.Background(), list, client.InNamespace("project")); err != nil {
+		t.Fatal(err)
+	}
+	return meta.LenList(list)
+}
+
+func TestFinalizerRemovesTrafficBeforeTheWorkloadAndVolumes(t *testing.T) {
+	ctx := context.Background()
+	f := deletingRollout(nil, time.Now())
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "app-pod", Namespace: "project",
+		Labels: map[string]string{"one-click.dev/projectId": "project", "one-click.dev/deploymentId": "app"},
+	}}
+	r := newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f, pod)...)
+
+	// The traffic and workload go first, the volumes wait for the pods
+	if result := finalizeOnce(t, r, f); result.RequeueAfter != deletionRequeueAfter {
+		t.Fatalf("expected to wait for the pods, got %+v", result)
+	}
+	if phase := deletionPhase(t, r, f); phase != oneclickiov1alpha1.DeletionStoppingWorkload {
+		t.Fatalf("expected phase %s, got %s", oneclickiov1alpha1.DeletionStoppingWorkload, phase)
+	}
+	for _, list := range []client.ObjectList{&networkingv1.IngressList{}, &corev1.ServiceList{}, &appsv1.DeploymentList{}, &batchv1.CronJobList{}, &autoscalingv2.HorizontalPodAutoscalerList{}} {
+		if n := countObjects(t, r, list); n != 0 {
+			t.Fatalf("expected the %T to be deleted, %d left", list, n)
+		}
+	}
+	if n := countObjects(t, r, &corev1.PersistentVolumeClaimList{}); n != 1 {
+		t.Fatalf("expected the PVC to be kept while pods run, got %d", n)
+	}
+
+	if err := r.Delete(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	finalizeOnce(t, r, f)
+	if n := countObjects(t, r, &corev1.PersistentVolumeClaimList{}); n != 0 {
+		t.Fatalf("expected the PVC to be deleted, %d left", n)
+	}
+	if phase := deletionPhase(t, r, f); phase != "Gone" {
+		t.Fatalf("expected the finalizer to be removed, got phase %s", phase)
+	}
+}
+
+func TestFinalizerRetainsVolumes(t *testing.T) {
+	ctx := context.Background()
+	f := deletingRollout(&oneclickiov1alpha1.DeletionPolicySpec{Type: oneclickiov1alpha1.DeletionPolicyRetainVolumes}, time.Now())
+	r := newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f)...)
+
+	finalizeOnce(t, r, f)
+	if phase := deletionPhase(t, r, f); phase != "Gone" {
+		t.Fatalf("expected the finalizer to be removed, got phase %s", phase)
+	}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace("project")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pvcs.Items) != 1 {
+		t.Fatalf("expected the PVC to be retained, got %d", len(pvcs.Items))
+	}
+	pvc := pvcs.Items[0]
+	if len(pvc.OwnerReferences) != 0 || pvc.Labels["one-click.dev/retained-from"] != "app" {
+		t.Fatalf("expected the PVC to be released and labeled, got owners %v and labels %v", pvc.OwnerReferences, pvc.Labels)
+	}
+}
+
+func TestFinalizerWaitsForReadySnapshots(t *testing.T) {
+	ctx := context.Background()
+	f := deletingRollout(&oneclickiov1alpha1.DeletionPolicySpec{Type: oneclickiov1alpha1.DeletionPolicySnapshot}, time.Now())
+	r := newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f)...)
+
+	if result := finalizeOnce(t, r, f); result.RequeueAfter != deletionRequeueAfter {
+		t.Fatalf("expected to wait for the snapshot, got %+v", result)
+	}
+	snapshots := &unstructured.UnstructuredList{}
+	snapshots.SetGroupVersionKind(volumeSnapshotGVK.GroupVersion().WithKind("VolumeSnapshotList"))
+	if err := r.List(ctx, snapshots, client.InNamespace("project")); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots.Items) != 1 {
+		t.Fatalf("expected a VolumeSnapshot of the PVC, got %d", len(snapshots.Items))
+	}
+
+	// Not ready yet, the PVC is kept
+	finalizeOnce(t, r, f)
+	if phase := deletionPhase(t, r, f); phase != oneclickiov1alpha1.DeletionSnapshotting {
+		t.Fatalf("expected phase %s, got %s", oneclickiov1alpha1.DeletionSnapshotting, phase)
+	}
+	if n := countObjects(t, r, &corev1.PersistentVolumeClaimList{}); n != 1 {
+		t.Fatalf("expected the PVC to be kept until the snapshot is ready, got %d", n)
+	}
+
+	snapshot := &snapshots.Items[0]
+	if err := unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	finalizeOnce(t, r, f)
+	if n := countObjects(t, r, &corev1.PersistentVolumeClaimList{}); n != 0 {
+		t.Fatalf("expected the PVC to be deleted once the snapshot is ready, got %d", n)
+	}
+	if phase := deletionPhase(t, r, f); phase != "Gone" {
+		t.Fatalf("expected the finalizer to be removed, got phase %s", phase)
+	}
+}
+
+func TestFinalizerKeepsVolumesWithoutSnapshotAPI(t *testing.T) {
+	f := deletingRollout(&oneclickiov1alpha1.DeletionPolicySpec{Type: oneclickiov1alpha1.DeletionPolicySnapshot}, time.Now())
+	r := newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f)...)
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if u, ok := obj.(*unstructured.Unstructured); ok && u.GroupVersionKind() == volumeSnapshotGVK {
+				return &meta.NoKindMatchError{GroupKind: volumeSnapshotGVK.GroupKind(), SearchedVersions: []string{"v1"}}
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if result := finalizeOnce(t, r, f); result.RequeueAfter != snapshotsUnavailableRequeueAfter {
+			t.Fatalf("expected to recheck the snapshot API later, got %+v", result)
+		}
+	}
+	if phase := deletionPhase(t, r, f); phase != oneclickiov1alpha1.DeletionSnapshotsUnavailable {
+		t.Fatalf("expected phase %s, got %s", oneclickiov1alpha1.DeletionSnapshotsUnavailable, phase)
+	}
+	if n := countObjects(t, r, &corev1.PersistentVolumeClaimList{}); n != 1 {
+		t.Fatalf("expected the PVC to be kept, got %d", n)
+	}
+	warnings := 0
+	for len(r.Recorder.(*record.FakeRecorder).Events) > 0 {
+		if event := <-r.Recorder.(*record.FakeRecorder).Events; strings.HasPrefix(event, "Warning SnapshotsUnavailable") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("expected a single SnapshotsUnavailable warning, got %d", warnings)
+	}
+}
+
+func TestFinalizerScalesToZeroUntilTheRetentionExpires(t *testing.T) {
+	ctx := context.Background()
+	policy := &oneclickiov1alpha1.DeletionPolicySpec{Type: oneclickiov1alpha1.DeletionPolicyScaleToZero, RetentionDays: ptr.To(int32(1))}
+
+	// Within the retention everything but the HPA is kept, scaled down
+	f := deletingRollout(policy, time.Now())
+	r := newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f)...)
+	result := finalizeOnce(t, r, f)
+	if result.RequeueAfter <= 23*time.Hour || result.RequeueAfter > 24*time.Hour {
+		t.Fatalf("expected to requeue when the retention expires, got %+v", result)
+	}
+	if phase := deletionPhase(t, r, f); phase != oneclickiov1alpha1.DeletionScaledToZero {
+		t.Fatalf("expected phase %s, got %s", oneclickiov1alpha1.DeletionScaledToZero, phase)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(f), deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 {
+		t.Fatalf("expected the Deployment to be scaled to zero, got %v", deployment.Spec.Replicas)
+	}
+	cronJobs := &batchv1.CronJobList{}
+	if err := r.List(ctx, cronJobs, client.InNamespace("project")); err != nil {
+		t.Fatal(err)
+	}
+	for _, cronJob := range cronJobs.Items {
+		if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+			t.Fatalf("expected CronJob %s to be suspended", cronJob.Name)
+		}
+	}
+	if countObjects(t, r, &autoscalingv2.HorizontalPodAutoscalerList{}) != 0 || countObjects(t, r, &corev1.ServiceList{}) == 0 {
+		t.Fatal("expected the HPA to be deleted and the Services to be kept")
+	}
+
+	// Once the retention expired everything is deleted
+	f = deletingRollout(policy, time.Now().Add(-25*time.Hour))
+	r = newTestReconciler(t, &writeCounter{}, append(objectsOfRollout(t, f), f)...)
+	finalizeOnce(t, r, f)
+	if phase := deletionPhase(t, r, f); phase != "Gone" {
+		t.Fatalf("expected the finalizer to be removed, got phase %s", phase)
+	}
+	for _, list := range []client.ObjectList{&appsv1.DeploymentList{}, &corev1.ServiceList{}, &corev1.PersistentVolumeClaimList{}} {
+		if n := countObjects(t, r, list); n != 0 {
+			t.Fatalf("expected the %T to be deleted, %d left", list, n)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/config"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	"github.com/janlauber/one-click-operator/pkg/scope"
+)
+
+// RolloutRunReconciler runs RolloutRuns as Jobs in the context of their Rollout
+type RolloutRunReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Config holds the settings of the config file, the defaults if nil.
+	Config *config.Store
+	// Scope is the set of namespaces reconciled, all if nil.
+	Scope *scope.Scope
+}
+
+//+kubebuilder:rbac:groups=one-click.dev,resources=rolloutruns,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=one-click.dev,resources=rolloutruns/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=one-click.dev,resources=rolloutruns/finalizers,verbs=update
+
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+func (r *RolloutRunReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// Runs out of scope are left to the replica managing their namespace
+	if inScope, err := r.Scope.Contains(ctx, r.Client, req.Namespace); err != nil || !inScope {
+		return ctrl.Result{}, err
+	}
+
+	// Fetch the RolloutRun instance
+	var run oneclickiov1alpha1.RolloutRun
+	if err := r.Get(ctx, req.NamespacedName, &run); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Failed to get RolloutRun.")
+		return ctrl.Result{}, err
+	}
+
+	// Clean up finished runs after their TTL, the Job is garbage collected with them
+	if finished(&run) && run.Spec.TTLSecondsAfterFinished != nil && run.Status.CompletionTime != nil {
+		expiry := run.Status.CompletionTime.Add(time.Duration(*run.Spec.TTLSecondsAfterFinished) * time.Second)
+		if remaining := time.Until(expiry); remaining > 0 {
+			return ctrl.Result{RequeueAfter: remaining}, nil
+		}
+		if err := r.Delete(ctx, &run, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			r.Recorder.Eventf(&run, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete expired RolloutRun %s", run.Name)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	status := run.Status.DeepCopy()
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: naming.RolloutRunJob(run.Name), Namespace: run.Namespace}, job)
+	switch {
+	case err != nil && !errors.IsNotFound(err):
+		log.Error(err, "Failed to get Job.")
+		return ctrl.Result{}, err
+
+	case err != nil && !finished(&run):
+		// Start the run
+		var rollout oneclickiov1alpha1.Rollout
+		if err := r.Get(ctx, types.NamespacedName{Name: run.Spec.Rollout, Namespace: run.Namespace}, &rollout); err != nil {
+			if !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+			r.Recorder.Eventf(&run, corev1.EventTypeWarning, "RolloutNotFound", "Rollout %s does not exist", run.Spec.Rollout)
+			status.Phase = oneclickiov1alpha1.RolloutRunFailed
+			status.Reason = "RolloutNotFound"
+			status.Message = "Rollout " + run.Spec.Rollout + " does not exist"
+			status.CompletionTime = &metav1.Time{Time: time.Now()}
+			break
+		}
+
+		violations := policyViolations(&rollout, r.Config.Get())
+		if run.Spec.Resources != nil {
+			violations = append(violations, resourceViolations("run resources", *run.Spec.Resources, r.Config.Get())...)
+		}
+		if len(violations) > 0 {
+			message := strings.Join(violations, "; ")
+			r.Recorder.Eventf(&run, corev1.EventTypeWarning, "PolicyViolation", "%s", message)
+			status.Phase = oneclickiov1alpha1.RolloutRunFailed
+			status.Reason = "PolicyViolation"
+			status.Message = message
+			status.CompletionTime = &metav1.Time{Time: time.Now()}
+			break
+		}
+
+		pvcNames, err := pvcNamesForRollout(ctx, r.Client, &rollout)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		job, err = r.jobForRolloutRun(&run, &rollout, pvcNames)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.Create(ctx, job); err != nil {
+			r.Recorder.Eventf(&run, corev1.EventTypeWarning, "CreationFailed", "Failed to create Job %s", job.Name)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(&run, corev1.EventTypeNormal, "Created", "Created Job %s", job.Name)
+		status.Phase = oneclickiov1alpha1.RolloutRunPending
+		status.Image = job.Spec.Template.Spec.Containers[0].Image
+		status.JobName = job.Name
+
+	case err == nil:
+		if err := r.observeJob(ctx, job, status); err != nil {
+			return ctrl.Result{}, err
+		}
+		if !finished(&run) && (status.Phase == oneclickiov1alpha1.RolloutRunSucceeded || status.Phase == oneclickiov1alpha1.RolloutRunFailed) {
+			r.Recorder.Eventf(&run, corev1.EventTypeNormal, "Run"+status.Phase, "Job %s finished: %s", job.Name, status.Phase)
+		}
+	}
+
+	if !reflect.DeepEqual(status, &run.Status) {
+		run.Status = *status
+		if err := r.Status().Update(ctx, &run); err != nil {
+			if errors.IsConflict(err) {
+				return ctrl.Result{Requeue: true}, nil
+			}
+			log.Error(err, "Failed to update RolloutRun status.")
+			return ctrl.Result{}, err
+		}
+		// Requeue to schedule the TTL cleanup of the finished run
+		if finished(&run) && run.Spec.TTLSecondsAfterFinished != nil {
+			return ctrl.Result{Requeue: true}, nil
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// jobForRolloutRun builds the Job of a run with the image, env, secrets,
+// volumes, service account, security context and scheduling of the Rollout.
+// pvcNames are the PVC names by volume.
+func (r *RolloutRunReconciler) jobForRolloutRun(run *oneclickiov1alpha1.RolloutRun, f *oneclickiov1alpha1.Rollout, pvcNames map[string]string) (*batchv1.Job, error) {
+	jobName := naming.RolloutRunJob(run.Name)
+	labels := map[string]string{
+		r.label(projectIDLabel):    f.Namespace,
+		r.label(deploymentIDLabel): f.Name,
+		r.label(rolloutRunLabel):   jobName,
+	}
+
+	command, args := f.Spec.Command, f.Spec.Args
+	if len(run.Spec.Command) > 0 {
+		command = run.Spec.Command
+	}
+	if len(run.Spec.Args) > 0 {
+		args = run.Spec.Args
+	}
+	resources := f.Spec.Resources
+	if run.Spec.Resources != nil {
+		resources = *run.Spec.Resources
+	}
+	backoffLimit := int32(0)
+	if run.Spec.BackoffLimit != nil {
+		backoffLimit = *run.Spec.BackoffLimit
+	}
+
+	var imagePullSecrets []corev1.LocalObjectReference
+	if f.Spec.Image.Username != "" && f.Spec.Image.Password != "" {
+		imagePullSecrets = append(imagePullSecrets, corev1.LocalObjectReference{Name: naming.ImagePullSecret(f.Name)})
+	}
+
+	podSpec := corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:      "run",
+			Command:   command,
+			Args:      args,
+			Env:       getEnvVars(run.Spec.Env),
+			Resources: createResourceRequirements(resources),
+		}},
+		RestartPolicy:    corev1.RestartPolicyNever,
+		ImagePullSecrets: imagePullSecrets,
+	}
+
+	volumes := make([]string, 0, len(f.Spec.Volumes))
+	for _, v := range f.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	inheritFromRollout(f, &oneclickiov1alpha1.CronJobInheritSpec{
+		Image:           true,
+		Env:             true,
+		Secrets:         true,
+		Volumes:         volumes,
+		ServiceAccount:  true,
+		SecurityContext: true,
+		Scheduling:      true,
+	}, &podSpec, pvcNames)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: run.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: run.Spec.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					// Not the projectId label, the Service must not select run pods
+					Labels: map[string]string{
+						r.label(deploymentIDLabel): f.Name,
+						r.label(rolloutRunLabel):   jobName,
+					},
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+
+	if err := ctrl.SetControllerReference(run, job, r.Scheme); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// observeJob derives the phase, pod and exit code of a run from its Job.
+func (r *RolloutRunReconciler) observeJob(ctx context.Context, job *batchv1.Job, status *oneclickiov1alpha1.RolloutRunStatus) error {
+	status.JobName = job.Name
+	status.Image = job.Spec.Template.Spec.Containers[0].Image
+	status.StartTime = job.Status.StartTime
+
+	// The latest pod carries the exit code of the last attempt
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(job.Namespace), client.MatchingLabels{r.label(rolloutRunLabel): job.Name}); err != nil {
+		return err
+	}
+	var latest *corev1.Pod
+	for i := range podList.Items {
+		if latest == nil || latest.CreationTimestamp.Before(&podList.Items[i].CreationTimestamp) {
+			latest = &podList.Items[i]
+		}
+	}
+	if latest != nil {
+		status.PodName = latest.Name
+		for _, containerStatus := range latest.Status.ContainerStatuses {
+			if terminated := containerStatus.State.Terminated; terminated != nil {
+				exitCode := terminated.ExitCode
+				status.ExitCode = &exitCode
+			}
+		}
+	}
+
+	status.Phase = oneclickiov1alpha1.RolloutRunPending
+	if latest != nil && latest.Status.Phase == corev1.PodRunning {
+		status.Phase = oneclickiov1alpha1.RolloutRunRunning
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			status.Phase = oneclickiov1alpha1.RolloutRunSucceeded
+			status.CompletionTime = condition.LastTransitionTime.DeepCopy()
+		case batchv1.JobFailed:
+			status.Phase = oneclickiov1alpha1.RolloutRunFailed
+			status.Reason = condition.Reason
+			status.Message = condition.Message
+			status.CompletionTime = condition.LastTransitionTime.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// finished reports whether a run succeeded or failed.
+func finished(run *oneclickiov1alpha1.RolloutRun) bool {
+	return run.Status.Phase == oneclickiov1alpha1.RolloutRunSucceeded || run.Status.Phase == oneclickiov1alpha1.RolloutRunFailed
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RolloutRunReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&oneclickiov1alpha1.RolloutRun{}).
+		Owns(&batchv1.Job{}).
+		WithEventFilter(r.Scope.Predicate(mgr.GetClient())).
+		Complete(r)
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+)
+
+func testRolloutRun(name string) *oneclickiov1alpha1.RolloutRun {
+	return &oneclickiov1alpha1.RolloutRun{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "project", UID: "run-uid"},
+		Spec: oneclickiov1alpha1.RolloutRunSpec{
+			Rollout: "app",
+			Command: []string{"./migrate"},
+		},
+	}
+}
+
+func newTestRunReconciler(t *testing.T, objs ...client.Object) *RolloutRunReconciler {
+	scheme := testScheme(t)
+	return &RolloutRunReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(objs...).
+			WithStatusSubresource(&oneclickiov1alpha1.RolloutRun{}).
+			Build(),
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+// reconcileRun reconciles the run and reads it back, nil once it is deleted.
+func reconcileRun(t *testing.T, r *RolloutRunReconciler, run *oneclickiov1alpha1.RolloutRun) (*oneclickiov1alpha1.RolloutRun, ctrl.Result) {
+	t.Helper()
+	ctx := context.Background()
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(run)})
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	latest := &oneclickiov1alpha1.RolloutRun{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(run), latest); errors.IsNotFound(err) {
+		return nil, result
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return latest, result
+}
+
+func TestRolloutRunJobsAreNamedAsLabelValues(t *testing.T) {
+	run := testRolloutRun("migrate-" + strings.Repeat("database-", 7))
+	r := newTestRunReconciler(t, testRollout(), run)
+
+	run, _ = reconcileRun(t, r, run)
+
+	jobName := naming.RolloutRunJob(run.Name)
+	if len(run.Name) <= naming.MaxLength || len(jobName) > naming.MaxLength {
+		t.Fatalf("expected the Job name of %s to be truncated, got %s", run.Name, jobName)
+	}
+	job := &batchv1.Job{}
+	if err := r.Get(context.Background(), client.ObjectKey{Name: jobName, Namespace: run.Namespace}, job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Labels["one-click.dev/rolloutRun"] != jobName || job.Spec.Template.Labels["one-click.dev/rolloutRun"] != jobName {
+		t.Errorf("expected the runs to be labeled with the Job name, got %v and %v", job.Labels, job.Spec.Template.Labels)
+	}
+	if run.Status.Phase != oneclickiov1alpha1.RolloutRunPending || run.Status.JobName != jobName {
+		t.Errorf("expected the pending Job in the status, got %+v", run.Status)
+	}
+
+	// The next reconcile finds the Job again
+	run, _ = reconcileRun(t, r, run)
+	jobs := &batchv1.JobList{}
+	if err := r.List(context.Background(), jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 || run.Status.JobName != jobName {
+		t.Errorf("expected the one Job to be observed, got %d Jobs and %+v", len(jobs.Items), run.Status)
+	}
+}
+
+func TestRolloutRunPhasesFollowTheJob(t *testing.T) {
+	run := testRolloutRun("migrate")
+	r := newTestRunReconciler(t, testRollout(), run)
+	ctx := context.Background()
+
+	run, _ = reconcileRun(t, r, run)
+	if run.Status.Phase != oneclickiov1alpha1.RolloutRunPending || run.Status.Image != "docker.io/nginx:1.27" {
+		t.Fatalf("expected a pending run of the Rollout image, got %+v", run.Status)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "migrate-x7k2p",
+			Namespace: run.Namespace,
+			Labels:    map[string]string{"one-click.dev/rolloutRun": run.Status.JobName},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if err := r.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	run, _ = reconcileRun(t, r, run)
+	if run.Status.Phase != oneclickiov1alpha1.RolloutRunRunning || run.Status.PodName != pod.Name {
+		t.Fatalf("expected the run to be running in %s, got %+v", pod.Name, run.Status)
+	}
+
+	pod.Status = corev1.PodStatus{
+		Phase: corev1.PodFailed,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "run",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 3}},
+		}},
+	}
+	if err := r.Status().Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	job := &batchv1.Job{}
+	if err := r.Get(ctx, client.ObjectKey{Name: run.Status.JobName, Namespace: run.Namespace}, job); err != nil {
+		t.Fatal(err)
+	}
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:               batchv1.JobFailed,
+		Status:             corev1.ConditionTrue,
+		Reason:             "BackoffLimitExceeded",
+		Message:            "Job has reached the specified backoff limit",
+		LastTransitionTime: metav1.Now(),
+	}}
+	if err := r.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	run, _ = reconcileRun(t, r, run)
+	if run.Status.Phase != oneclickiov1alpha1.RolloutRunFailed || run.Status.Reason != "BackoffLimitExceeded" || run.Status.CompletionTime == nil {
+		t.Fatalf("expected the run to fail with the Job, got %+v", run.Status)
+	}
+	if run.Status.ExitCode == nil || *run.Status.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %v", run.Status.ExitCode)
+	}
+}
+
+func TestRolloutRunsOfMissingRolloutsFail(t *testing.T) {
+	run := testRolloutRun("migrate")
+	r := newTestRunReconciler(t, run)
+
+	run, _ = reconcileRun(t, r, run)
+	if run.Status.Phase != oneclickiov1alpha1.RolloutRunFailed || run.Status.Reason != "RolloutNotFound" {
+		t.Fatalf("expected the run to fail, got %+v", run.Status)
+	}
+	jobs := &batchv1.JobList{}
+	if err := r.List(context.Background(), jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("expected no Job, got %d", len(jobs.Items))
+	}
+}
+
+func TestFinishedRolloutRunsAreDeletedAfterTheirTTL(t *testing.T) {
+	run := testRolloutRun("migrate")
+	run.Spec.TTLSecondsAfterFinished = ptr.To(int32(60))
+	run.Status = oneclickiov1alpha1.RolloutRunStatus{
+		Phase:          oneclickiov1alpha1.RolloutRunSucceeded,
+		CompletionTime: &metav1.Time{Time: time.Now().Add(-30 * time.Second)},
+	}
+	r := newTestRunReconciler(t, run)
+
+	kept, result := reconcileRun(t, r, run)
+	if kept == nil || result.RequeueAfter <= 0 || result.RequeueAfter > 30*time.Second {
+		t.Fatalf("expected the run to be kept until its TTL, requeued after %v", result.RequeueAfter)
+	}
+
+	kept.Status.CompletionTime = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	if err := r.Status().Update(context.Background(), kept); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, _ := reconcileRun(t, r, kept); deleted != nil {
+		t.Fatalf("expected the expired run to be deleted, got %+v", deleted.Status)
+	}
+}
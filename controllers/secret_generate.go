@@ -0,0 +1,381 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// rotateSecretsAnnotation on a Rollout rotates all generated secrets
+	// whenever its value changes, e.g. set it to the current date.
+	rotateSecretsAnnotation = "one-click.dev/rotate-secrets"
+	// rotationTokenAnnotation records the last handled rotate-secrets value.
+	rotationTokenAnnotation = "one-click.dev/rotation-token"
+	// generatedAtAnnotation records when each generated secret was generated.
+	generatedAtAnnotation = "one-click.dev/generated-at"
+	// forgetSecretsAnnotation on a Rollout lists the removed generated secrets
+	// (or "*") whose values are dropped. Values of removed secrets are kept
+	// otherwise, so re-adding a secret restores its value.
+	forgetSecretsAnnotation = "one-click.dev/forget-generated-secrets"
+)
+
+// passwordCharsets are the characters generated passwords are drawn from.
+var passwordCharsets = map[string]string{
+	"alphanumeric": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"symbols":      "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#%+-.:=?@^_~",
+	"numeric":      "0123456789",
+	"hex":          "0123456789abcdef",
+}
+
+// reconcileGeneratedSecrets keeps the generated secret values in the
+// <rollout>-generated-secrets Secret, so they survive changes to the
+// <rollout>-secrets Secret. Values are only generated when missing or due for
+// rotation. Values of secrets removed from the spec are kept until they are
+// listed in the forget-generated-secrets annotation. It returns the values by
+// secret key and the time until the next scheduled rotation, zero if none is
+// scheduled.
+func (r *RolloutReconciler) reconcileGeneratedSecrets(ctx context.Context, f *oneclickiov1alpha1.Rollout) (map[string]string, time.Duration, error) {
+	forget := f.Annotations[forgetSecretsAnnotation]
+	if !hasGeneratedSecrets(f) && forget == "" {
+		return nil, 0, nil
+	}
+	secretName := naming.GeneratedSecret(f.Name)
+
+	foundSecret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: f.Namespace}, foundSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Secret %s", secretName)
+		return nil, 0, err
+	}
+	exists := err == nil
+	if !exists && !hasGeneratedSecrets(f) {
+		return nil, 0, nil
+	}
+
+	data := map[string][]byte{}
+	generatedAt := map[string]time.Time{}
+	if exists {
+		for key, value := range foundSecret.Data {
+			data[key] = value
+		}
+		if raw := foundSecret.Annotations[generatedAtAnnotation]; raw != "" {
+			if err := json.Unmarshal([]byte(raw), &generatedAt); err != nil {
+				return nil, 0, fmt.Errorf("invalid %s annotation on Secret %s: %w", generatedAtAnnotation, secretName, err)
+			}
+		}
+	}
+
+	// A new rotate-secrets value rotates everything once
+	token := f.Annotations[rotateSecretsAnnotation]
+	rotateAll := exists && token != "" && token != foundSecret.Annotations[rotationTokenAnnotation]
+	changed := !exists || token != foundSecret.Annotations[rotationTokenAnnotation]
+
+	now := time.Now()
+	values := map[string]string{}
+	generatedKeys := map[string]bool{}
+	var rotateAfter time.Duration
+	for _, secretItem := range f.Spec.Secrets {
+		if secretItem.Generate == nil {
+			continue
+		}
+		name := strings.TrimSpace(secretItem.Name)
+		keys := generatedSecretKeys(name, secretItem.Generate)
+
+		complete := true
+		for _, key := range keys {
+			if _, ok := data[key]; !ok {
+				complete = false
+			}
+		}
+		if _, ok := generatedAt[name]; complete && !ok {
+			// adopt values without a recorded generation time instead of rotating them
+			generatedAt[name] = now
+			changed = true
+		}
+		interval := time.Duration(0)
+		if secretItem.Generate.RotationInterval != nil {
+			interval = secretItem.Generate.RotationInterval.Duration
+		}
+		due := interval > 0 && !now.Before(generatedAt[name].Add(interval))
+
+		if !complete || due || rotateAll {
+			generated, err := generateSecret(f, name, secretItem.Generate)
+			if err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "GenerationFailed", "Failed to generate secret %s: %v", name, err)
+				return nil, 0, err
+			}
+			for key, value := range generated {
+				data[key] = []byte(value)
+			}
+			generatedAt[name] = now
+			changed = true
+			if complete {
+				r.Recorder.Eventf(f, corev1.EventTypeNormal, "Rotated", "Rotated generated secret %s", name)
+			}
+		}
+
+		if interval > 0 {
+			if remaining := generatedAt[name].Add(interval).Sub(now); rotateAfter == 0 || remaining < rotateAfter {
+				rotateAfter = remaining
+			}
+		}
+		for _, key := range keys {
+			generatedKeys[key] = true
+			values[key] = string(data[key])
+		}
+	}
+
+	// Values no longer generated are kept, so removing a secret by accident
+	// doesn't lose it, unless they are explicitly forgotten
+	for _, name := range strings.Split(forget, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for key := range data {
+			if generatedKeys[key] {
+				continue
+			}
+			if name == "*" || key == name || key == name+"_PUB" || key == name+"_KEY" {
+				delete(data, key)
+				delete(generatedAt, key)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return values, rotateAfter, nil
+	}
+
+	rawGeneratedAt, err := json.Marshal(generatedAt)
+	if err != nil {
+		return nil, 0, err
+	}
+	annotations := map[string]string{
+		generatedAtAnnotation:   string(rawGeneratedAt),
+		rotationTokenAnnotation: token,
+	}
+
+	if !exists {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        secretName,
+				Namespace:   f.Namespace,
+				Labels:      r.rolloutLabels(f),
+				Annotations: annotations,
+			},
+			Data: data,
+		}
+		if err := controllerutil.SetControllerReference(f, secret, r.Scheme); err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to construct Secret %s", secretName)
+			return nil, 0, err
+		}
+		// Creating fails if a stale cache missed the Secret, so existing values
+		// are never replaced
+		if err := r.Create(ctx, secret); err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Secret %s", secretName)
+			return nil, 0, err
+		}
+		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created Secret %s", secretName)
+		return values, rotateAfter, nil
+	}
+
+	foundSecret.Data = data
+	if foundSecret.Annotations == nil {
+		foundSecret.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		foundSecret.Annotations[key] = value
+	}
+	if err := r.Update(ctx, foundSecret); err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update Secret %s", secretName)
+		return nil, 0, err
+	}
+	return values, rotateAfter, nil
+}
+
+// hasGeneratedSecrets reports whether any secret value is generated.
+func hasGeneratedSecrets(f *oneclickiov1alpha1.Rollout) bool {
+	for _, secretItem := range f.Spec.Secrets {
+		if secretItem.Generate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedSecretKeys returns the secret keys a generator produces.
+func generatedSecretKeys(name string, g *oneclickiov1alpha1.SecretGenerator) []string {
+	switch g.Type {
+	case oneclickiov1alpha1.SecretGenerateRSA, oneclickiov1alpha1.SecretGenerateEd25519:
+		return []string{name, name + "_PUB"}
+	case oneclickiov1alpha1.SecretGenerateCertificate:
+		return []string{name, name + "_KEY"}
+	default:
+		return []string{name}
+	}
+}
+
+// generateSecret generates fresh values for all keys of a generator.
+func generateSecret(f *oneclickiov1alpha1.Rollout, name string, g *oneclickiov1alpha1.SecretGenerator) (map[string]string, error) {
+	length := g.Length
+	if length == 0 {
+		length = 32
+	}
+
+	switch g.Type {
+	case "", oneclickiov1alpha1.SecretGeneratePassword:
+		charset := g.Charset
+		if charset == "" {
+			charset = "alphanumeric"
+		}
+		chars, ok := passwordCharsets[charset]
+		if !ok {
+			return nil, fmt.Errorf("unknown charset %q", charset)
+		}
+		password, err := randomString(chars, length)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name: password}, nil
+
+	case oneclickiov1alpha1.SecretGenerateBytes:
+		b := make([]byte, length)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		return map[string]string{name: base64.StdEncoding.EncodeToString(b)}, nil
+
+	case oneclickiov1alpha1.SecretGenerateUUID:
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name: id.String()}, nil
+
+	case oneclickiov1alpha1.SecretGenerateRSA:
+		bits := g.Bits
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, err
+		}
+		return keyPairValues(name, key, &key.PublicKey)
+
+	case oneclickiov1alpha1.SecretGenerateEd25519:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return keyPairValues(name, key, pub)
+
+	case oneclickiov1alpha1.SecretGenerateCertificate:
+		cert, key, err := selfSignedCertificate(f, g)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name: cert, name + "_KEY": key}, nil
+	}
+
+	return nil, fmt.Errorf("unknown secret type %q", g.Type)
+}
+
+// randomString draws length characters uniformly from chars.
+func randomString(chars string, length int) (string, error) {
+	max := big.NewInt(int64(len(chars)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// keyPairValues encodes the private key as PKCS #8 and the public key as PKIX PEM.
+func keyPairValues(name string, key, pub interface{}) (map[string]string, error) {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		name:          string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		name + "_PUB": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+	}, nil
+}
+
+// selfSignedCertificate returns a PEM encoded self-signed server certificate
+// and its ECDSA P-256 private key.
+func selfSignedCertificate(f *oneclickiov1alpha1.Rollout, g *oneclickiov1alpha1.SecretGenerator) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	commonName := g.CommonName
+	if commonName == "" {
+		commonName = f.Name
+	}
+	validityDays := g.ValidityDays
+	if validityDays == 0 {
+		validityDays = 365
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              g.DNSNames,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(0, 0, validityDays),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})), nil
+}
@@ -3,125 +3,291 @@ package controllers
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"sort"
 	"strings"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
+	"github.com/janlauber/one-click-operator/pkg/sealing"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
-func (r *RolloutReconciler) reconcileSecret(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
-	// Get the desired state of the Secret from the helper function
-	desiredSecret, err := r.secretForRollout(f)
-	if err != nil {
-		r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to construct Secret %s", f.Name+"-secrets")
-		return err
-	}
+// shareWithAnnotation lists the namespaces (or "*") whose Rollouts may read a
+// Secret through secrets[].valueFrom.secretKeyRef.
+const shareWithAnnotation = "one-click.dev/share-with"
+
+// secretsChecksumAnnotation holds the checksum of the secret values on both the
+// <rollout>-secrets Secret and the pod template, so changed values roll the pods.
+const secretsChecksumAnnotation = "one-click.dev/secrets-checksum"
+
+// reconcileSecret applies or deletes the <rollout>-secrets Secret and
+// returns the checksum of its values, empty if the Rollout has no secrets.
+// generated holds the values of generated secrets by key.
+func (r *RolloutReconciler) reconcileSecret(ctx context.Context, f *oneclickiov1alpha1.Rollout, generated map[string]string) (string, error) {
+	secretName := naming.Secret(f.Name)
 
 	// Check if the Secret already exists
 	foundSecret := &corev1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{Name: desiredSecret.Name, Namespace: f.Namespace}, foundSecret)
-	if err != nil && errors.IsNotFound(err) {
-		// Create the Secret
-		err = r.Create(ctx, desiredSecret)
-		if err != nil {
-			r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Secret %s", f.Name+"-secrets")
-			return err
-		}
-		r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created Secret %s", f.Name)
-	} else if err != nil {
-		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Secret %s", f.Name)
-		return err
-	} else {
-		// Secret exists - check if it needs an update
-		if needsSecretUpdate(foundSecret, f) {
-			updateSecret(foundSecret, f)
-			err = r.Update(ctx, foundSecret)
-			if err != nil {
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update Secret %s", foundSecret.Name+"-secrets")
-				return err
+	err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: f.Namespace}, foundSecret)
+	if err != nil && !errors.IsNotFound(err) {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Secret %s", secretName)
+		return "", err
+	}
+	exists := err == nil
+
+	// Remove the Secret once the last secret is gone from the spec
+	if len(f.Spec.Secrets) == 0 {
+		if exists && metav1.IsControlledBy(foundSecret, f) {
+			if err := r.Delete(ctx, foundSecret); err != nil && !errors.IsNotFound(err) {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Secret %s", secretName)
+				return "", err
 			}
+			r.forgetApplied(f, foundSecret)
+			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Secret %s", secretName)
 		}
+		return "", nil
 	}
 
-	return nil
-}
-
-func needsSecretUpdate(foundSecret *corev1.Secret, f *oneclickiov1alpha1.Rollout) bool {
-	// If no secrets are specified in the Rollout spec and the found secret is not empty, it needs to be deleted
-	if len(f.Spec.Secrets) == 0 && len(foundSecret.Data) > 0 {
-		return true
+	// Resolve the plaintext values, decrypting the encrypted ones
+	values, err := r.resolveSecretValues(ctx, f, generated)
+	if err != nil {
+		return "", err
 	}
+	checksum := calculateSecretsChecksum(values)
 
-	// If the number of keys in the secret doesn't match the number of specified secrets, update is needed
-	if len(foundSecret.Data) != len(f.Spec.Secrets) {
-		return true
+	desiredSecret, err := r.secretForRollout(f, values, checksum)
+	if err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to construct Secret %s", secretName)
+		return "", err
+	}
+	if err := r.applyForRollout(ctx, f, desiredSecret); err != nil {
+		return "", err
 	}
 
-	// Check if the content of the secret matches the Rollout spec
+	return checksum, nil
+}
+
+// resolveSecretValues returns the plaintext value of every secret item keyed by
+// its trimmed name. Encrypted values are opened with the operator key ring,
+// external references are read from their Secret or secret store and generated
+// values, including the additional keys of key pairs, are taken from generated.
+func (r *RolloutReconciler) resolveSecretValues(ctx context.Context, f *oneclickiov1alpha1.Rollout, generated map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(f.Spec.Secrets))
+
+	var ring *sealing.KeyRing
 	for _, secretItem := range f.Spec.Secrets {
 		key := strings.TrimSpace(secretItem.Name)
-		if string(foundSecret.Data[key]) != secretItem.Value {
-			return true
+		if secretItem.Generate != nil {
+			for _, generatedKey := range generatedSecretKeys(key, secretItem.Generate) {
+				values[generatedKey] = generated[generatedKey]
+			}
+			continue
+		}
+		if secretItem.ValueFrom != nil {
+			value, err := r.resolveSecretValueFrom(ctx, f, secretItem.ValueFrom)
+			if err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "SecretResolutionFailed", "Failed to resolve secret %s: %v", key, err)
+				return nil, err
+			}
+			values[key] = string(value)
+			continue
+		}
+		if secretItem.EncryptedValue == "" {
+			values[key] = secretItem.Value
+			continue
+		}
+
+		if ring == nil {
+			// The key Secret has no Rollout labels, it is read from the API server
+			reader := client.Reader(r.Client)
+			if r.APIReader != nil {
+				reader = r.APIReader
+			}
+			var err error
+			if ring, err = sealing.LoadKeyRingFromCluster(ctx, reader, r.OperatorNamespace); err != nil {
+				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DecryptionFailed", "Failed to load the sealing keys: %v", err)
+				return nil, err
+			}
 		}
-	}
 
-	// Check if the secrets checksum annotation needs an update
-	secretsChecksum := calculateSecretsChecksum(f.Spec.Secrets)
-	currentChecksum, exists := foundSecret.Annotations["oneclick.io/secrets-checksum"]
-	if !exists || currentChecksum != secretsChecksum {
-		return true
+		plaintext, err := ring.Decrypt(secretItem.EncryptedValue, f.Namespace, f.Name)
+		if stderrors.Is(err, sealing.ErrUnscoped) && r.AllowUnscopedEncryptedValues {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "UnscopedSecret", "Secret %s is not bound to a namespace, seal it again with manager encrypt --namespace %s", key, f.Namespace)
+			plaintext, err = ring.DecryptUnscoped(secretItem.EncryptedValue)
+		}
+		if err != nil {
+			r.Recorder.Eventf(f, corev1.EventTypeWarning, "DecryptionFailed", "Failed to decrypt secret %s: %v", key, err)
+			return nil, err
+		}
+		values[key] = string(plaintext)
 	}
 
-	// No update needed
-	return false
+	return values, nil
 }
 
-func calculateSecretsChecksum(secrets []oneclickiov1alpha1.SecretItem) string {
-	hash := sha256.New()
-	for _, secret := range secrets {
-		data := secret.Name + "=" + secret.Value
-		hash.Write([]byte(data))
+// resolveSecretValueFrom reads a value referenced by secrets[].valueFrom.
+func (r *RolloutReconciler) resolveSecretValueFrom(ctx context.Context, f *oneclickiov1alpha1.Rollout, source *oneclickiov1alpha1.SecretValueSource) ([]byte, error) {
+	if ref := source.SecretKeyRef; ref != nil {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = f.Namespace
+		}
+
+		// Other namespaces may be out of the cache, e.g. with --watch-namespaces,
+		// and Secrets the operator doesn't own with --cache-by-label
+		key := types.NamespacedName{Name: ref.Name, Namespace: namespace}
+		secret := &corev1.Secret{}
+		var err error
+		if namespace != f.Namespace && r.APIReader != nil {
+			err = r.APIReader.Get(ctx, key, secret)
+		} else {
+			err = r.getUncached(ctx, key, secret)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if namespace != f.Namespace && !sharedWithNamespace(secret, f.Namespace) {
+			return nil, fmt.Errorf("secret %s/%s is not shared with namespace %s", namespace, ref.Name, f.Namespace)
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no key %s", namespace, ref.Name, ref.Key)
+		}
+		return value, nil
 	}
-	return hex.EncodeToString(hash.Sum(nil))
+
+	if ref := source.Provider; ref != nil {
+		provider, ok := r.SecretProviders[ref.Name]
+		if !ok {
+			return nil, fmt.Errorf("secret provider %s is not configured", ref.Name)
+		}
+		// Rollouts may only read the paths of their own namespace
+		path, err := r.SecretPathTemplate.Path(f.Namespace, ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return provider.GetSecret(ctx, path, ref.Key)
+	}
+
+	return nil, fmt.Errorf("valueFrom sets neither secretKeyRef nor provider")
 }
 
-func updateSecret(foundSecret *corev1.Secret, f *oneclickiov1alpha1.Rollout) {
-	if len(f.Spec.Secrets) == 0 {
-		// Clear the secret data if no secrets are specified
-		foundSecret.Data = make(map[string][]byte)
-		return
+// sharedWithNamespace reports whether a Secret opted in to be read by Rollouts
+// in the given namespace through its share-with annotation.
+func sharedWithNamespace(secret *corev1.Secret, namespace string) bool {
+	for _, allowed := range strings.Split(secret.Annotations[shareWithAnnotation], ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == namespace {
+			return true
+		}
 	}
+	return false
+}
 
-	// Update or add new data to the secret
-	foundSecret.Data = make(map[string][]byte)
+// hasExternalSecrets reports whether any secret value is read from outside of
+// the Rollout and therefore has to be resynced periodically.
+func hasExternalSecrets(f *oneclickiov1alpha1.Rollout) bool {
 	for _, secretItem := range f.Spec.Secrets {
-		key := strings.TrimSpace(secretItem.Name)
-		foundSecret.Data[key] = []byte(secretItem.Value)
+		if secretItem.ValueFrom != nil {
+			return true
+		}
 	}
+	return false
 }
 
-func (r *RolloutReconciler) secretForRollout(f *oneclickiov1alpha1.Rollout) (*corev1.Secret, error) {
-	secretData := make(map[string]string)
+// secretVolumesForRollout returns one volume of the <rollout>-secrets Secret per
+// directory secrets are mounted into, projecting only the mounted keys.
+func secretVolumesForRollout(f *oneclickiov1alpha1.Rollout) ([]corev1.Volume, []corev1.VolumeMount) {
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	volumeIndex := map[string]int{}
 	for _, secretItem := range f.Spec.Secrets {
+		if secretItem.Mount == nil {
+			continue
+		}
 		key := strings.TrimSpace(secretItem.Name)
-		secretData[key] = secretItem.Value
+		fileName := secretItem.Mount.FileName
+		if fileName == "" {
+			fileName = key
+		}
+
+		i, ok := volumeIndex[secretItem.Mount.MountPath]
+		if !ok {
+			// name the volume after its directory so it is stable across reorders
+			sum := sha256.Sum256([]byte(secretItem.Mount.MountPath))
+			name := "secrets-" + hex.EncodeToString(sum[:4])
+			i = len(volumes)
+			volumeIndex[secretItem.Mount.MountPath] = i
+			volumes = append(volumes, corev1.Volume{
+				Name: name,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: naming.Secret(f.Name),
+						// set the API server default, so the volumes compare equal
+						DefaultMode: ptr.To(corev1.SecretVolumeSourceDefaultMode),
+					},
+				},
+			})
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      name,
+				MountPath: secretItem.Mount.MountPath,
+				ReadOnly:  true,
+			})
+		}
+		volumes[i].Secret.Items = append(volumes[i].Secret.Items, corev1.KeyToPath{
+			Key:  key,
+			Path: fileName,
+			Mode: secretItem.Mount.Mode,
+		})
+	}
+	return volumes, volumeMounts
+}
+
+// calculateSecretsChecksum hashes the values in key order. Keys and values are
+// length prefixed, so no two different sets of values share an encoding.
+func calculateSecretsChecksum(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		for _, field := range []string{key, values[key]} {
+			_ = binary.Write(hash, binary.BigEndian, uint64(len(field)))
+			hash.Write([]byte(field))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (r *RolloutReconciler) secretForRollout(f *oneclickiov1alpha1.Rollout, values map[string]string, checksum string) (*corev1.Secret, error) {
+	secretData := make(map[string][]byte, len(values))
+	for key, value := range values {
+		secretData[key] = []byte(value)
 	}
 
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      f.Name + "-secrets", // Naming the secret based on the Rollout name
+			Name:      naming.Secret(f.Name),
 			Namespace: f.Namespace,
-			Labels: map[string]string{
-				"one-click.dev/projectId":    f.Namespace,
-				"one-click.dev/deploymentId": f.Name,
+			Labels:    r.rolloutLabels(f),
+			Annotations: map[string]string{
+				secretsChecksumAnnotation: checksum,
 			},
 		},
-		StringData: secretData,
+		Data: secretData,
 	}
 
 	// Set the owner reference
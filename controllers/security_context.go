@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"reflect"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+// tmpVolumeName is the emptyDir mounted at /tmp when the root filesystem is read-only.
+const tmpVolumeName = "tmp"
+
+// securityContextsForRollout expands the security profile of the Rollout and
+// applies the explicitly set securityContext fields on top of it. A nil
+// context is returned when nothing is configured, so the cluster defaults apply.
+func securityContextsForRollout(f *oneclickiov1alpha1.Rollout) (*corev1.PodSecurityContext, *corev1.SecurityContext) {
+	spec := f.Spec.SecurityContext
+	podContext := &corev1.PodSecurityContext{}
+	containerContext := &corev1.SecurityContext{}
+
+	switch f.Spec.SecurityProfile {
+	case oneclickiov1alpha1.SecurityProfileRestricted:
+		podContext.RunAsNonRoot = ptr.To(true)
+		podContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		containerContext.RunAsNonRoot = ptr.To(true)
+		containerContext.Privileged = ptr.To(false)
+		containerContext.AllowPrivilegeEscalation = ptr.To(false)
+		containerContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		containerContext.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+	case oneclickiov1alpha1.SecurityProfileBaseline:
+		podContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		containerContext.Privileged = ptr.To(false)
+		containerContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+
+	// Explicit values always take precedence over the profile
+	if spec.FsGroup != nil {
+		podContext.FSGroup = spec.FsGroup
+	}
+	if spec.RunAsUser != nil {
+		podContext.RunAsUser = spec.RunAsUser
+	}
+	if spec.RunAsGroup != nil {
+		podContext.RunAsGroup = spec.RunAsGroup
+	}
+	if len(spec.SupplementalGroups) > 0 {
+		podContext.SupplementalGroups = spec.SupplementalGroups
+	}
+	if spec.FsGroupChangePolicy != nil {
+		podContext.FSGroupChangePolicy = spec.FsGroupChangePolicy
+	}
+	if len(spec.Sysctls) > 0 {
+		podContext.Sysctls = spec.Sysctls
+	}
+	// Seccomp and AppArmor profiles are set on the pod, the container inherits them
+	if spec.SeccompProfile != nil {
+		podContext.SeccompProfile = spec.SeccompProfile
+		containerContext.SeccompProfile = nil
+	}
+	if spec.AppArmorProfile != nil {
+		podContext.AppArmorProfile = spec.AppArmorProfile
+		containerContext.AppArmorProfile = nil
+	}
+	if spec.RunAsNonRoot != nil {
+		if podContext.RunAsNonRoot != nil {
+			podContext.RunAsNonRoot = spec.RunAsNonRoot
+		}
+		containerContext.RunAsNonRoot = spec.RunAsNonRoot
+	}
+	if spec.Privileged != nil {
+		containerContext.Privileged = spec.Privileged
+	}
+	if spec.AllowPrivilegeEscalation != nil {
+		containerContext.AllowPrivilegeEscalation = spec.AllowPrivilegeEscalation
+	}
+	if spec.ReadOnlyRootFilesystem != nil {
+		containerContext.ReadOnlyRootFilesystem = spec.ReadOnlyRootFilesystem
+	}
+
+	if len(spec.Capabilities.Add) > 0 || len(spec.Capabilities.Drop) > 0 {
+		if containerContext.Capabilities == nil {
+			containerContext.Capabilities = &corev1.Capabilities{}
+		}
+		for _, c := range spec.Capabilities.Add {
+			containerContext.Capabilities.Add = appendCapability(containerContext.Capabilities.Add, corev1.Capability(c))
+		}
+		for _, c := range spec.Capabilities.Drop {
+			containerContext.Capabilities.Drop = appendCapability(containerContext.Capabilities.Drop, corev1.Capability(c))
+		}
+	}
+
+	if reflect.DeepEqual(*podContext, corev1.PodSecurityContext{}) {
+		podContext = nil
+	}
+	if reflect.DeepEqual(*containerContext, corev1.SecurityContext{}) {
+		containerContext = nil
+	}
+
+	return podContext, containerContext
+}
+
+func appendCapability(capabilities []corev1.Capability, capability corev1.Capability) []corev1.Capability {
+	for _, c := range capabilities {
+		if c == capability {
+			return capabilities
+		}
+	}
+	return append(capabilities, capability)
+}
+
+// needsTmpVolume reports whether a writable /tmp has to be provided because the
+// root filesystem is read-only and no user volume is mounted there already.
+func needsTmpVolume(f *oneclickiov1alpha1.Rollout) bool {
+	if f.Spec.SecurityContext.ReadOnlyRootFilesystem == nil || !*f.Spec.SecurityContext.ReadOnlyRootFilesystem {
+		return false
+	}
+	for _, v := range f.Spec.Volumes {
+		if v.MountPath == "/tmp" {
+			return false
+		}
+	}
+	return true
+}
@@ -2,9 +2,9 @@ package controllers
 
 import (
 	"context"
-	"reflect"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -20,28 +20,31 @@ func (r *RolloutReconciler) reconcileService(ctx context.Context, f *oneclickiov
 
 	expectedServices := make(map[string]bool)
 	for _, intf := range f.Spec.Interfaces {
-		serviceName := intf.Name + "-" + f.Name + "-svc"
-		expectedServices[serviceName] = true
-
 		service := r.serviceForRollout(f, intf)
-		foundService := &corev1.Service{}
-		err := r.Get(ctx, types.NamespacedName{Name: serviceName, Namespace: f.Namespace}, foundService)
-		if err != nil && errors.IsNotFound(err) {
-			if err := r.Create(ctx, service); err != nil {
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create Service %s", serviceName)
-				return err
-			}
-			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created Service %s", serviceName)
-		} else if err != nil {
-			r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get Service %s", serviceName)
+		expectedServices[service.Name] = true
+		if err := r.applyForRollout(ctx, f, service); err != nil {
 			return err
-		} else if !reflect.DeepEqual(foundService.Spec.Ports, getServicePorts(intf)) {
-			foundService.Spec.Ports = getServicePorts(intf)
-			if err := r.Update(ctx, foundService); err != nil {
-				r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to update Service %s", serviceName)
-				return err
+		}
+
+		// Keep a Service of the former name as an alias, clients may still
+		// use it
+		legacyName := naming.LegacyService(f.Name, intf.Name)
+		legacy := &corev1.Service{}
+		if err := r.Get(ctx, types.NamespacedName{Name: legacyName, Namespace: f.Namespace}, legacy); err != nil {
+			if errors.IsNotFound(err) {
+				continue
 			}
-			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated Service %s", serviceName)
+			return err
+		}
+		if !metav1.IsControlledBy(legacy, f) {
+			continue
+		}
+		expectedServices[legacyName] = true
+		alias := r.serviceForRollout(f, intf)
+		alias.Name = legacyName
+		alias.Labels[r.label(legacyNameLabel)] = "true"
+		if err := r.applyForRollout(ctx, f, alias); err != nil {
+			return err
 		}
 	}
 
@@ -53,11 +56,12 @@ func (r *RolloutReconciler) reconcileService(ctx context.Context, f *oneclickiov
 	}
 
 	for _, service := range serviceList.Items {
-		if _, exists := expectedServices[service.Name]; !exists && service.Labels["one-click.dev/projectId"] == f.Namespace && service.Labels["one-click.dev/deploymentId"] == f.Name {
+		if _, exists := expectedServices[service.Name]; !exists && metav1.IsControlledBy(&service, f) {
 			if err := r.Delete(ctx, &service); err != nil {
 				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete Service %s", service.Name)
 				return err
 			}
+			r.forgetApplied(f, &service)
 			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted Service %s", service.Name)
 		}
 	}
@@ -66,15 +70,13 @@ func (r *RolloutReconciler) reconcileService(ctx context.Context, f *oneclickiov
 }
 
 func (r *RolloutReconciler) serviceForRollout(f *oneclickiov1alpha1.Rollout, intf oneclickiov1alpha1.InterfaceSpec) *corev1.Service {
-	labels := map[string]string{
-		"one-click.dev/projectId":    f.Namespace,
-		"one-click.dev/deploymentId": f.Name,
-	}
+	labels := r.rolloutLabels(f)
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      intf.Name + "-" + f.Name + "-svc",
-			Namespace: f.Namespace,
-			Labels:    labels,
+			Name:        naming.Service(f.Name, intf.Name),
+			Namespace:   f.Namespace,
+			Labels:      r.rolloutLabels(f),
+			Annotations: r.serviceAnnotationsForInterface(intf),
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: labels,
@@ -92,8 +94,8 @@ func getServicePorts(intf oneclickiov1alpha1.InterfaceSpec) []corev1.ServicePort
 		{
 			Name:       intf.Name,
 			Port:       intf.Port,
-			TargetPort: intstr.FromInt(int(intf.Port)),
-			Protocol:   corev1.ProtocolTCP,
+			TargetPort: intstr.FromString(containerPortName(intf)),
+			Protocol:   interfaceProtocol(intf),
 		},
 	}
 }
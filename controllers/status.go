@@ -7,9 +7,9 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -26,36 +26,25 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 		return err
 	}
 
-	// get the deployment replica count
-	replicas, err := r.getDeploymentReplicas(ctx, f)
-	if err != nil {
-		log.Error(err, "Failed to get Deployment replica count")
-		return err
-	}
-
 	// Get the Deployment
-	// TODO: fix status at first run
 	var requestSumCpu, requestSumMemory, limitSumCpu, limitSumMemory resource.Quantity
 
 	deployment := &appsv1.Deployment{}
-	err = r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment)
-	if err != nil {
+	podList := &corev1.PodList{}
+	err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, deployment)
+	if err != nil && !errors.IsNotFound(err) {
 		log.Error(err, "Failed to get Deployment", "Rollout.Namespace", f.Namespace, "Rollout.Name", f.Name)
 		return err
 	}
-
-	// List the Pods that are controlled by this Deployment
-	podList := &corev1.PodList{}
-	labelSelector := labels.SelectorFromSet(deployment.Spec.Selector.MatchLabels)
-	listOpts := []client.ListOption{
-		client.InNamespace(f.Namespace),
-		client.MatchingLabelsSelector{Selector: labelSelector},
-	}
-
-	err = r.List(ctx, podList, listOpts...)
-	if err != nil {
-		log.Error(err, "Failed to list pods", "Rollout.Namespace", f.Namespace, "Rollout.Name", f.Name)
-		return err
+	deploymentFound := err == nil
+
+	if deploymentFound {
+		// List the Pods that are controlled by this Deployment
+		podList.Items, err = r.deploymentPods(ctx, deployment)
+		if err != nil {
+			log.Error(err, "Failed to list pods", "Rollout.Namespace", f.Namespace, "Rollout.Name", f.Name)
+			return err
+		}
 	}
 
 	// Collect the names of the Pods
@@ -64,19 +53,11 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 		podNames = append(podNames, pod.Name)
 	}
 
-	// Get the Deployment status if there are any pods pending or not ready
-	deploymentStatus := "OK"
-	for _, pod := range podList.Items {
-		if pod.Status.Phase == corev1.PodPending {
-			deploymentStatus = "Pending"
-		}
-		if pod.Status.Phase == corev1.PodRunning {
-			for _, containerStatus := range pod.Status.ContainerStatuses {
-				if !containerStatus.Ready {
-					deploymentStatus = "NotReady"
-				}
-			}
-		}
+	// Derive the health from the Deployment conditions and the container states
+	pods := podStatuses(podList.Items)
+	phase, reason, message := oneclickiov1alpha1.DeploymentProgressing, "DeploymentPending", "The Deployment is not created yet"
+	if deploymentFound {
+		phase, reason, message = deploymentHealth(deployment, pods)
 	}
 
 	for _, pod := range podList.Items {
@@ -99,10 +80,15 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 		}
 	}
 
-	// add some test data to the status
-	f.Status.Deployment.Replicas = replicas
+	f.Status.Deployment.Replicas = deployment.Status.Replicas
+	f.Status.Deployment.UpdatedReplicas = deployment.Status.UpdatedReplicas
+	f.Status.Deployment.ReadyReplicas = deployment.Status.ReadyReplicas
+	f.Status.Deployment.AvailableReplicas = deployment.Status.AvailableReplicas
 	f.Status.Deployment.PodNames = podNames
-	f.Status.Deployment.Status = deploymentStatus
+	f.Status.Deployment.Pods = pods
+	f.Status.Deployment.Status = phase
+	f.Status.Deployment.Reason = reason
+	f.Status.Deployment.Message = message
 	// Update the Rollout status with resource information
 	f.Status.Deployment.Resources = oneclickiov1alpha1.DeploymentResources{
 		RequestSum: oneclickiov1alpha1.Resources{
@@ -117,8 +103,8 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 
 	// List the Ingresses
 	ingressList := &networkingv1.IngressList{}
-	listOpts = []client.ListOption{
-		client.MatchingLabels{"one-click.dev/deploymentId": f.Name},
+	listOpts := []client.ListOption{
+		client.MatchingLabels{r.label(deploymentIDLabel): f.Name},
 	}
 
 	err = r.List(ctx, ingressList, listOpts...)
@@ -141,7 +127,9 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 
 		if len(hosts) > 0 { // Only add if there are hosts
 			ingressStatus := oneclickiov1alpha1.IngressStatus{
+				Name:   ingress.Name,
 				Hosts:  hosts,
+				URLs:   ingressURLs(ingress),
 				Status: determineIngressStatus(ingress), // Implement this function based on your logic
 			}
 			ingressStatuses = append(ingressStatuses, ingressStatus)
@@ -154,8 +142,8 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 	serviceList := &corev1.ServiceList{}
 	listOpts = []client.ListOption{
 		// client.InNamespace(f.Namespace),
-		// Use label selectors to only select services with one-click.dev/deploymentId=f.Name
-		client.MatchingLabels{"one-click.dev/deploymentId": f.Name},
+		// Use label selectors to only select services with the deploymentId label of f
+		client.MatchingLabels{r.label(deploymentIDLabel): f.Name},
 	}
 
 	err = r.List(ctx, serviceList, listOpts...)
@@ -190,8 +178,8 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 	pvcList := &corev1.PersistentVolumeClaimList{}
 	listOpts = []client.ListOption{
 		client.InNamespace(f.Namespace),
-		// Use label selectors to only select PVCs with one-click.dev/deploymentId=f.Name
-		client.MatchingLabels{"one-click.dev/deploymentId": f.Name},
+		// Use label selectors to only select PVCs with the deploymentId label of f
+		client.MatchingLabels{r.label(deploymentIDLabel): f.Name},
 	}
 
 	err = r.List(ctx, pvcList, listOpts...)
@@ -223,8 +211,31 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 	// Update the Rollout status
 	f.Status.Volumes = volumeStatuses
 
-	// Attempt to update the Rollout status
-	err = r.Status().Update(ctx, f)
+	// Collect the runs of the CronJobs
+	cronJobStatuses, err := r.cronJobStatuses(ctx, f)
+	if err != nil {
+		log.Error(err, "Failed to get CronJob statuses", "Rollout.Namespace", f.Namespace, "Rollout.Name", f.Name)
+		return err
+	}
+	f.Status.CronJobs = cronJobStatuses
+
+	// Report the HPA replicas and metrics
+	autoscalerStatus, err := r.autoscalerStatus(ctx, f)
+	if err != nil {
+		log.Error(err, "Failed to get HPA status", "Rollout.Namespace", f.Namespace, "Rollout.Name", f.Name)
+		return err
+	}
+	f.Status.Autoscaler = autoscalerStatus
+
+	// Only write the status if it changed, against the latest Rollout so a
+	// stale resource version does not cause a conflict
+	if equality.Semantic.DeepEqual(latestF.Status, f.Status) {
+		statusWrites.WithLabelValues(statusWriteSkipped).Inc()
+		return nil
+	}
+	patched := latestF.DeepCopy()
+	patched.Status = f.Status
+	err = r.Status().Patch(ctx, patched, client.MergeFrom(latestF))
 	if err != nil {
 		if errors.IsConflict(err) {
 			// Log conflict errors at a lower severity level and without a stack trace
@@ -235,24 +246,11 @@ func (r *RolloutReconciler) updateStatus(ctx context.Context, f *oneclickiov1alp
 		}
 		return err
 	}
+	statusWrites.WithLabelValues(statusWritePerformed).Inc()
 
 	return nil
 }
 
-func (r *RolloutReconciler) getDeploymentReplicas(ctx context.Context, f *oneclickiov1alpha1.Rollout) (int32, error) {
-	log := log.FromContext(ctx)
-
-	// Get the deployment
-	dep := &appsv1.Deployment{}
-	err := r.Get(ctx, types.NamespacedName{Name: f.Name, Namespace: f.Namespace}, dep)
-	if err != nil {
-		log.Error(err, "Failed to get Deployment")
-		return 0, err
-	}
-
-	return dep.Status.Replicas, nil
-}
-
 func determineIngressStatus(ingress networkingv1.Ingress) string {
 	// Check if the ingress has been assigned a load balancer IP or hostname
 	if len(ingress.Status.LoadBalancer.Ingress) > 0 {
@@ -4,61 +4,76 @@ import (
 	"context"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	"github.com/janlauber/one-click-operator/pkg/naming"
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-func (r *RolloutReconciler) reconcilePVCs(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
+// reconcilePVCs creates and expands the PVCs of the volumes and returns their
+// names by volume.
+func (r *RolloutReconciler) reconcilePVCs(ctx context.Context, f *oneclickiov1alpha1.Rollout) (map[string]string, error) {
 	log := log.FromContext(ctx)
 
 	if len(f.Spec.Volumes) == 0 {
-		return r.deleteAllPVCsForRollout(ctx, f)
+		return nil, r.deleteAllPVCsForRollout(ctx, f)
+	}
+
+	pvcNames, err := pvcNamesForRollout(ctx, r.Client, f)
+	if err != nil {
+		return nil, err
 	}
 
 	expectedPVCs := make(map[string]struct{})
 	for _, volSpec := range f.Spec.Volumes {
-		pvcName := volSpec.Name + "-" + f.Name
+		pvcName := pvcNames[volSpec.Name]
 		expectedPVCs[pvcName] = struct{}{}
 
-		desiredPVC := r.constructPVCForRollout(f, volSpec)
+		desiredPVC := r.constructPVCForRollout(f, volSpec, pvcName)
 		foundPVC := &corev1.PersistentVolumeClaim{}
-		err := r.Get(ctx, types.NamespacedName{Name: pvcName, Namespace: f.Namespace}, foundPVC)
+		err = r.getUncached(ctx, types.NamespacedName{Name: pvcName, Namespace: f.Namespace}, foundPVC)
 		if err != nil && errors.IsNotFound(err) {
 			if err := r.Create(ctx, desiredPVC); err != nil {
 				r.Recorder.Eventf(f, corev1.EventTypeWarning, "CreationFailed", "Failed to create PVC %s", pvcName)
-				return err
+				return nil, err
 			}
 			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Created", "Created PVC %s", pvcName)
 		} else if err != nil {
 			r.Recorder.Eventf(f, corev1.EventTypeWarning, "GetFailed", "Failed to get PVC %s", pvcName)
-			return err
+			return nil, err
+		} else if !r.claimForRollout(f, foundPVC, "PersistentVolumeClaim") {
+			continue
+		} else if !metav1.IsControlledBy(foundPVC, f) {
+			if err := r.adoptPVC(ctx, f, foundPVC); err != nil {
+				return nil, err
+			}
 		} else if currentSize, desiredSize := foundPVC.Spec.Resources.Requests[corev1.ResourceStorage], resource.MustParse(volSpec.Size); desiredSize.Cmp(currentSize) > 0 {
 			if foundPVC.Spec.VolumeMode == nil || *foundPVC.Spec.VolumeMode != corev1.PersistentVolumeFilesystem {
 				log.Info("PVC resizing is only supported for filesystem volume mode")
-				return nil
+				return pvcNames, nil
 			}
 
 			storageClass := &storagev1.StorageClass{}
 			if err := r.Get(ctx, types.NamespacedName{Name: *foundPVC.Spec.StorageClassName}, storageClass); err != nil {
 				log.Error(err, "Failed to get the storage class of the PVC", "StorageClass", *foundPVC.Spec.StorageClassName)
-				return err
+				return nil, err
 			}
 
 			if !allowsVolumeExpansion(storageClass) {
 				log.Info("StorageClass does not allow volume expansion", "StorageClass", storageClass.Name)
-				return nil
+				return pvcNames, nil
 			}
 
 			foundPVC.Spec.Resources.Requests[corev1.ResourceStorage] = desiredSize
 			if err := r.Update(ctx, foundPVC); err != nil {
 				log.Error(err, "Failed to update PVC size", "PVC.Namespace", foundPVC.Namespace, "PVC.Name", pvcName)
-				return err
+				return nil, err
 			}
 			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Updated", "Updated PVC %s", pvcName)
 		}
@@ -67,19 +82,40 @@ func (r *RolloutReconciler) reconcilePVCs(ctx context.Context, f *oneclickiov1al
 	pvcList := &corev1.PersistentVolumeClaimList{}
 	if err := r.List(ctx, pvcList, client.InNamespace(f.Namespace)); err != nil {
 		log.Error(err, "Failed to list PVCs", "Rollout.Namespace", f.Namespace)
-		return err
+		return nil, err
 	}
 
 	for _, pvc := range pvcList.Items {
-		if _, exists := expectedPVCs[pvc.Name]; !exists && isOwnedByRollout(&pvc, f) {
+		if _, exists := expectedPVCs[pvc.Name]; !exists && metav1.IsControlledBy(&pvc, f) {
 			if err := r.Delete(ctx, &pvc); err != nil {
 				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete PVC %s", pvc.Name)
-				return err
+				return nil, err
 			}
+			r.forgetApplied(f, &pvc)
 			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted PVC %s", pvc.Name)
 		}
 	}
 
+	return pvcNames, nil
+}
+
+// adoptPVC makes the Rollout the controller of an existing PVC, e.g. one
+// retained from a deleted Rollout, and labels it like the PVCs it creates.
+func (r *RolloutReconciler) adoptPVC(ctx context.Context, f *oneclickiov1alpha1.Rollout, pvc *corev1.PersistentVolumeClaim) error {
+	original := pvc.DeepCopy()
+	if err := ctrl.SetControllerReference(f, pvc, r.Scheme); err != nil {
+		return err
+	}
+	delete(pvc.Labels, r.label(retainedFromLabel))
+	if pvc.Labels == nil {
+		pvc.Labels = map[string]string{}
+	}
+	pvc.Labels[r.label(projectIDLabel)] = f.Namespace
+	pvc.Labels[r.label(deploymentIDLabel)] = f.Name
+	if err := r.Patch(ctx, pvc, client.MergeFrom(original)); err != nil {
+		r.Recorder.Eventf(f, corev1.EventTypeWarning, "UpdateFailed", "Failed to adopt PVC %s", pvc.Name)
+		return err
+	}
 	return nil
 }
 
@@ -87,15 +123,38 @@ func allowsVolumeExpansion(sc *storagev1.StorageClass) bool {
 	return sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion
 }
 
-func (r *RolloutReconciler) constructPVCForRollout(f *oneclickiov1alpha1.Rollout, volSpec oneclickiov1alpha1.VolumeSpec) *corev1.PersistentVolumeClaim {
-	labels := map[string]string{
-		"one-click.dev/projectId":    f.Namespace,
-		"one-click.dev/deploymentId": f.Name,
+// pvcNamesForRollout returns the PVC names by volume. PVCs created before the
+// naming scheme keep their names, their data can't be moved. So do PVCs that
+// could be adopted, e.g. ones retained from a deleted Rollout.
+func pvcNamesForRollout(ctx context.Context, c client.Reader, f *oneclickiov1alpha1.Rollout) (map[string]string, error) {
+	names := make(map[string]string, len(f.Spec.Volumes))
+	for _, v := range f.Spec.Volumes {
+		names[v.Name] = naming.PersistentVolumeClaim(f.Name, v.Name)
+
+		legacyName := naming.LegacyPersistentVolumeClaim(f.Name, v.Name)
+		legacy := &corev1.PersistentVolumeClaim{}
+		err := c.Get(ctx, types.NamespacedName{Name: legacyName, Namespace: f.Namespace}, legacy)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil && (metav1.IsControlledBy(legacy, f) || metav1.GetControllerOf(legacy) == nil) {
+			names[v.Name] = legacyName
+		}
+	}
+	return names, nil
+}
+
+func (r *RolloutReconciler) constructPVCForRollout(f *oneclickiov1alpha1.Rollout, volSpec oneclickiov1alpha1.VolumeSpec, name string) *corev1.PersistentVolumeClaim {
+	storageClass := volSpec.StorageClass
+	if storageClass == "" {
+		storageClass = r.Config.Get().Defaults.StorageClass
 	}
 
+	labels := r.rolloutLabels(f)
+
 	return &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      volSpec.Name + "-" + f.Name,
+			Name:      name,
 			Namespace: f.Namespace,
 			Labels:    labels,
 			OwnerReferences: []metav1.OwnerReference{
@@ -105,20 +164,11 @@ func (r *RolloutReconciler) constructPVCForRollout(f *oneclickiov1alpha1.Rollout
 		Spec: corev1.PersistentVolumeClaimSpec{
 			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
 			Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(volSpec.Size)}},
-			StorageClassName: &volSpec.StorageClass,
+			StorageClassName: &storageClass,
 		},
 	}
 }
 
-func isOwnedByRollout(pvc *corev1.PersistentVolumeClaim, f *oneclickiov1alpha1.Rollout) bool {
-	for _, ref := range pvc.GetOwnerReferences() {
-		if ref.Kind == "Rollout" && ref.Name == f.Name {
-			return true
-		}
-	}
-	return false
-}
-
 func (r *RolloutReconciler) deleteAllPVCsForRollout(ctx context.Context, f *oneclickiov1alpha1.Rollout) error {
 	log := log.FromContext(ctx)
 
@@ -129,11 +179,12 @@ func (r *RolloutReconciler) deleteAllPVCsForRollout(ctx context.Context, f *onec
 	}
 
 	for _, pvc := range pvcList.Items {
-		if isOwnedByRollout(&pvc, f) {
+		if metav1.IsControlledBy(&pvc, f) {
 			if err := r.Delete(ctx, &pvc); err != nil {
 				r.Recorder.Eventf(f, corev1.EventTypeWarning, "DeletionFailed", "Failed to delete PVC %s", pvc.Name)
 				return err
 			}
+			r.forgetApplied(f, &pvc)
 			r.Recorder.Eventf(f, corev1.EventTypeNormal, "Deleted", "Deleted PVC %s", pvc.Name)
 		}
 	}
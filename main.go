@@ -17,23 +17,33 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
 	"github.com/janlauber/one-click-operator/controllers"
+	"github.com/janlauber/one-click-operator/pkg/config"
+	"github.com/janlauber/one-click-operator/pkg/scope"
+	"github.com/janlauber/one-click-operator/pkg/sealing"
+	"github.com/janlauber/one-click-operator/pkg/secretstore"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	//+kubebuilder:scaffold:imports
 )
@@ -53,14 +63,83 @@ func init() {
 }
 
 func main() {
+	// Secret sealing subcommands, e.g. "manager encrypt VALUE"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var ingressController string
+	var nginxAllowlistAnnotation bool
+	var defaultDomain string
+	var hostTemplate string
+	var operatorNamespace string
+	var allowUnscopedEncryptedValues bool
+	var vaultConfig secretstore.VaultConfig
+	var fileSecretsDir string
+	var secretPathTemplate string
+	var secretResyncInterval time.Duration
+	var statusResyncInterval time.Duration
+	var configFile string
+	var configReloadInterval time.Duration
+	var watchNamespaces string
+	var namespaceSelector string
+	var cacheByLabel bool
+	var shardCount int
+	var shardIndex int
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&ingressController, "ingress-controller", controllers.IngressControllerNginx,
+		"The ingress controller flavour typed ingress features are translated for (nginx, traefik or haproxy).")
+	flag.BoolVar(&nginxAllowlistAnnotation, "nginx-allowlist-annotation", false,
+		"Use the allowlist-source-range annotation of ingress-nginx 1.9 and later instead of whitelist-source-range.")
+	flag.StringVar(&defaultDomain, "default-domain", "",
+		"The base domain used to generate hosts for interfaces with ingress.autoHost enabled.")
+	flag.StringVar(&hostTemplate, "host-template", controllers.DefaultHostTemplate,
+		"The Go template generated hosts are rendered from. Available fields: .Interface, .Rollout, .Namespace and .Domain.")
+	flag.StringVar(&operatorNamespace, "operator-namespace", defaultOperatorNamespace,
+		"The namespace holding the sealing key Secret used to decrypt encrypted secret values.")
+	flag.BoolVar(&allowUnscopedEncryptedValues, "allow-unscoped-encrypted-values", false,
+		"Decrypt values sealed before they were bound to a namespace, which any Rollout can use. Only meant for migrating.")
+	flag.StringVar(&vaultConfig.Address, "vault-address", "",
+		"The address of the Vault server for secrets[].valueFrom.provider \"vault\". The token is read from VAULT_TOKEN, "+
+			"without it the Kubernetes auth method is used with --vault-role.")
+	flag.StringVar(&vaultConfig.Mount, "vault-mount", "secret", "The path the Vault KV version 2 engine is mounted at.")
+	flag.StringVar(&vaultConfig.Role, "vault-role", "", "The Vault role for the Kubernetes auth method.")
+	flag.StringVar(&vaultConfig.AuthMount, "vault-auth-mount", "kubernetes", "The path the Vault Kubernetes auth method is mounted at.")
+	flag.StringVar(&fileSecretsDir, "file-secrets-dir", "",
+		"The directory secrets[].valueFrom.provider \"file\" reads from, e.g. a mounted Secret or CSI volume.")
+	flag.StringVar(&secretPathTemplate, "secret-path-template", secretstore.DefaultPathTemplate,
+		"The Go template provider paths of Rollouts are mapped to. It has to contain .Namespace, so Rollouts only read "+
+			"the paths of their namespace. Available fields: .Namespace and .Path.")
+	flag.DurationVar(&secretResyncInterval, "secret-resync-interval", 5*time.Minute,
+		"How often secret values referenced with valueFrom are resynced.")
+	flag.DurationVar(&statusResyncInterval, "status-resync-interval", 0,
+		"How often the status of every Rollout is refreshed in addition to watch events, disabled if 0.")
+	flag.StringVar(&configFile, "config", "",
+		"The operator config file, e.g. a mounted ConfigMap. The defaults are used without one.")
+	flag.DurationVar(&configReloadInterval, "config-reload-interval", 10*time.Second,
+		"How often the config file is checked for changes.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated namespaces the operator manages, all if empty. Overrides watchNamespaces of the config file.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of the namespaces the operator manages, e.g. one-click.dev/project.")
+	flag.BoolVar(&cacheByLabel, "cache-by-label", false,
+		"Only cache the Deployments, Services, Secrets, Ingresses, PVCs, Pods, Jobs and other objects of Rollouts, "+
+			"recognized by the deploymentId label of the label domain.")
+	flag.IntVar(&shardCount, "shard-count", 1,
+		"The number of operator deployments sharing the namespaces by hash.")
+	flag.IntVar(&shardIndex, "shard-index", 0,
+		"The shard of the namespaces this operator manages, from 0 to --shard-count - 1.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -69,10 +148,71 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	switch ingressController {
+	case controllers.IngressControllerNginx, controllers.IngressControllerTraefik, controllers.IngressControllerHAProxy:
+	default:
+		setupLog.Error(fmt.Errorf("unknown ingress controller %q", ingressController), "invalid flag value")
+		os.Exit(1)
+	}
+
+	parsedHostTemplate, err := template.New("host").Parse(hostTemplate)
+	if err != nil {
+		setupLog.Error(err, "invalid host template")
+		os.Exit(1)
+	}
+
+	operatorConfig := config.Default()
+	if configFile != "" {
+		if operatorConfig, err = config.Load(configFile); err != nil {
+			setupLog.Error(err, "invalid config file", "path", configFile)
+			os.Exit(1)
+		}
+	}
+	configStore := config.NewStore(operatorConfig)
+
+	operatorScope := &scope.Scope{Namespaces: operatorConfig.WatchNamespaces, Shards: shardCount, Shard: shardIndex}
+	if watchNamespaces != "" {
+		operatorScope.Namespaces = nil
+		for _, ns := range strings.Split(watchNamespaces, ",") {
+			operatorScope.Namespaces = append(operatorScope.Namespaces, strings.TrimSpace(ns))
+		}
+	}
+	if namespaceSelector != "" {
+		if operatorScope.NamespaceSelector, err = labels.Parse(namespaceSelector); err != nil {
+			setupLog.Error(err, "invalid namespace selector")
+			os.Exit(1)
+		}
+	}
+	if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+		setupLog.Error(fmt.Errorf("shard %d of %d", shardIndex, shardCount), "invalid flag value")
+		os.Exit(1)
+	}
+
+	secretProviders := map[string]secretstore.Provider{}
+	if vaultConfig.Address != "" {
+		vaultConfig.Token = os.Getenv("VAULT_TOKEN")
+		secretProviders["vault"] = secretstore.NewVaultProvider(vaultConfig)
+	}
+	if fileSecretsDir != "" {
+		secretProviders["file"] = secretstore.NewFileProvider(fileSecretsDir)
+	}
+
+	parsedSecretPathTemplate, err := secretstore.ParsePathTemplate(secretPathTemplate)
+	if err != nil {
+		setupLog.Error(err, "invalid secret path template")
+		os.Exit(1)
+	}
+
 	leaderElectionId := fmt.Sprintf("%s-%s", controllerName, "leader-election")
+	if shardCount > 1 {
+		// Every shard elects its own leader
+		leaderElectionId = fmt.Sprintf("%s-shard-%d", leaderElectionId, shardIndex)
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		// The operator namespace holds the sealing key
+		Cache: scope.CacheOptions(operatorScope.Namespaces, []string{operatorNamespace}, cacheByLabel, operatorConfig.LabelDomain),
 		Metrics: metricsserver.Options{
 			BindAddress: metricsAddr,
 		},
@@ -96,19 +236,75 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The objects of existing Rollouts can't be found under another label domain
+	if err := config.EnsureLabelDomain(context.Background(), mgr.GetAPIReader(), mgr.GetClient(), operatorNamespace, operatorConfig.LabelDomain); err != nil {
+		setupLog.Error(err, "unable to use the label domain", "labelDomain", operatorConfig.LabelDomain)
+		os.Exit(1)
+	}
+
 	// Initialize the event recorder
-	eventRecorder := mgr.GetEventRecorderFor("framework-controller")
+	eventRecorder := mgr.GetEventRecorderFor(operatorConfig.RecorderName)
 
 	if err = (&controllers.RolloutReconciler{
 		Client:   mgr.GetClient(),
 		Scheme:   mgr.GetScheme(),
 		Recorder: eventRecorder,
+
+		IngressController:        ingressController,
+		NginxAllowlistAnnotation: nginxAllowlistAnnotation,
+		DefaultDomain:            defaultDomain,
+		HostTemplate:             parsedHostTemplate,
+		OperatorNamespace:        operatorNamespace,
+
+		AllowUnscopedEncryptedValues: allowUnscopedEncryptedValues,
+
+		SecretProviders:      secretProviders,
+		SecretPathTemplate:   parsedSecretPathTemplate,
+		SecretResyncInterval: secretResyncInterval,
+		StatusResyncInterval: statusResyncInterval,
+		Config:               configStore,
+		Scope:                operatorScope,
+		// Objects the cache is restricted from are read from the API server
+		APIReader: mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Rollout")
 		os.Exit(1)
 	}
+	if err = (&controllers.RolloutRunReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: eventRecorder,
+		Config:   configStore,
+		Scope:    operatorScope,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "RolloutRun")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
+	// Make sure a sealing key exists so values can be encrypted right away
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if _, err := sealing.EnsureKeyRing(ctx, mgr.GetAPIReader(), mgr.GetClient(), operatorNamespace); err != nil {
+			setupLog.Error(err, "unable to ensure sealing key", "namespace", operatorNamespace)
+		}
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to set up sealing key")
+		os.Exit(1)
+	}
+
+	if configFile != "" {
+		if err := mgr.Add(&config.Watcher{
+			Path:     configFile,
+			Interval: configReloadInterval,
+			Store:    configStore,
+			Log:      ctrl.Log.WithName("config"),
+		}); err != nil {
+			setupLog.Error(err, "unable to set up config reload")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
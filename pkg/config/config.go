@@ -0,0 +1,234 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config holds the operator settings read from the config file.
+//
+// Settings that only shape the manager, i.e. the event recorder name and the
+// watched namespaces, take effect on start. The label domain is fixed once an
+// install used it. All others are reloaded while the operator runs.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultLabelDomain prefixes the labels of installs that don't configure a
+// label domain, and of all installs that predate the setting.
+const DefaultLabelDomain = "one-click.dev"
+
+// Config is the content of the config file.
+type Config struct {
+	// RecorderName is the source of the events of the operator.
+	RecorderName string `json:"recorderName,omitempty"`
+	// WatchNamespaces restricts the operator to the namespaces, all if empty.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// LabelDomain prefixes the labels the operator sets on the objects of
+	// Rollouts. It can't be changed once the install used it.
+	LabelDomain string `json:"labelDomain,omitempty"`
+
+	// Defaults apply where a Rollout does not set a value.
+	Defaults Defaults `json:"defaults,omitempty"`
+	// AllowedRegistries are the registries, optionally followed by a
+	// repository prefix, images may be pulled from. Any if empty.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// ResourceCeilings are the most a Rollout may request.
+	ResourceCeilings ResourceCeilings `json:"resourceCeilings,omitempty"`
+	// Features turn parts of the Rollout spec on and off.
+	Features Features `json:"features,omitempty"`
+}
+
+type Defaults struct {
+	// StorageClass of volumes without one, no class if empty.
+	StorageClass string `json:"storageClass,omitempty"`
+	// IngressPathType of the ingress rules.
+	IngressPathType networkingv1.PathType `json:"ingressPathType,omitempty"`
+	// HPABehavior is the scaling behavior of the HorizontalPodAutoscaler.
+	HPABehavior *autoscalingv2.HorizontalPodAutoscalerBehavior `json:"hpaBehavior,omitempty"`
+}
+
+// ResourceCeilings limit the resources of a Rollout, unlimited if unset.
+type ResourceCeilings struct {
+	// MaxReplicas of the HorizontalPodAutoscaler.
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+	// CPU requested or limited per container.
+	CPU *resource.Quantity `json:"cpu,omitempty"`
+	// Memory requested or limited per container.
+	Memory *resource.Quantity `json:"memory,omitempty"`
+	// VolumeSize per volume.
+	VolumeSize *resource.Quantity `json:"volumeSize,omitempty"`
+}
+
+// Features are all enabled by default. A Rollout using a disabled feature is
+// not reconciled, except for adoption which is ignored.
+type Features struct {
+	Ingress         bool `json:"ingress"`
+	CronJobs        bool `json:"cronJobs"`
+	Hooks           bool `json:"hooks"`
+	ExternalSecrets bool `json:"externalSecrets"`
+	Adoption        bool `json:"adoption"`
+}
+
+// Default returns the settings used without a config file.
+func Default() *Config {
+	return &Config{
+		RecorderName: "framework-controller",
+		LabelDomain:  DefaultLabelDomain,
+		Defaults: Defaults{
+			IngressPathType: networkingv1.PathTypeImplementationSpecific,
+			HPABehavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{
+				ScaleUp: &autoscalingv2.HPAScalingRules{
+					StabilizationWindowSeconds: ptr.To(int32(0)),
+					Policies: []autoscalingv2.HPAScalingPolicy{
+						{Type: autoscalingv2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+					},
+				},
+				ScaleDown: &autoscalingv2.HPAScalingRules{
+					StabilizationWindowSeconds: ptr.To(int32(300)),
+					Policies: []autoscalingv2.HPAScalingPolicy{
+						{Type: autoscalingv2.PercentScalingPolicy, Value: 100, PeriodSeconds: 60},
+					},
+				},
+			},
+		},
+		Features: Features{
+			Ingress:         true,
+			CronJobs:        true,
+			Hooks:           true,
+			ExternalSecrets: true,
+			Adoption:        true,
+		},
+	}
+}
+
+// Load reads and validates the config file. Settings missing from the file
+// keep their defaults, unknown settings are an error.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates the content of a config file.
+func Parse(data []byte) (*Config, error) {
+	c := Default()
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate reports all invalid settings.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.RecorderName == "" {
+		errs = append(errs, errors.New("recorderName must not be empty"))
+	}
+	for _, ns := range c.WatchNamespaces {
+		if msgs := validation.IsDNS1123Label(ns); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("watchNamespaces: %q: %s", ns, strings.Join(msgs, ", ")))
+		}
+	}
+	if msgs := validation.IsDNS1123Subdomain(c.LabelDomain); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("labelDomain: %q: %s", c.LabelDomain, strings.Join(msgs, ", ")))
+	}
+
+	switch c.Defaults.IngressPathType {
+	case networkingv1.PathTypeExact, networkingv1.PathTypePrefix, networkingv1.PathTypeImplementationSpecific:
+	default:
+		errs = append(errs, fmt.Errorf("defaults.ingressPathType: unknown path type %q", c.Defaults.IngressPathType))
+	}
+	if behavior := c.Defaults.HPABehavior; behavior != nil {
+		errs = append(errs, validateScalingRules("defaults.hpaBehavior.scaleUp", behavior.ScaleUp)...)
+		errs = append(errs, validateScalingRules("defaults.hpaBehavior.scaleDown", behavior.ScaleDown)...)
+	}
+
+	for _, registry := range c.AllowedRegistries {
+		if registry == "" || strings.Contains(registry, "://") || strings.HasSuffix(registry, "/") {
+			errs = append(errs, fmt.Errorf("allowedRegistries: %q must be a registry host, optionally followed by a repository prefix", registry))
+		}
+	}
+
+	if c.ResourceCeilings.MaxReplicas < 0 {
+		errs = append(errs, errors.New("resourceCeilings.maxReplicas must not be negative"))
+	}
+	for name, quantity := range map[string]*resource.Quantity{
+		"cpu":        c.ResourceCeilings.CPU,
+		"memory":     c.ResourceCeilings.Memory,
+		"volumeSize": c.ResourceCeilings.VolumeSize,
+	} {
+		if quantity != nil && quantity.Sign() <= 0 {
+			errs = append(errs, fmt.Errorf("resourceCeilings.%s must be positive", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateScalingRules(field string, rules *autoscalingv2.HPAScalingRules) []error {
+	if rules == nil {
+		return nil
+	}
+	var errs []error
+	if w := rules.StabilizationWindowSeconds; w != nil && (*w < 0 || *w > 3600) {
+		errs = append(errs, fmt.Errorf("%s.stabilizationWindowSeconds must be between 0 and 3600", field))
+	}
+	for i, policy := range rules.Policies {
+		switch policy.Type {
+		case autoscalingv2.PodsScalingPolicy, autoscalingv2.PercentScalingPolicy:
+		default:
+			errs = append(errs, fmt.Errorf("%s.policies[%d].type: unknown policy type %q", field, i, policy.Type))
+		}
+		if policy.Value <= 0 {
+			errs = append(errs, fmt.Errorf("%s.policies[%d].value must be positive", field, i))
+		}
+		if policy.PeriodSeconds <= 0 || policy.PeriodSeconds > 1800 {
+			errs = append(errs, fmt.Errorf("%s.policies[%d].periodSeconds must be between 1 and 1800", field, i))
+		}
+	}
+	return errs
+}
+
+// Allows reports whether an image of the registry and repository may be
+// pulled. An allowed entry matches the registry, or a repository prefix of it
+// at a path boundary.
+func (c *Config) Allows(registry, repository string) bool {
+	if len(c.AllowedRegistries) == 0 {
+		return true
+	}
+	image := registry + "/" + repository
+	for _, allowed := range c.AllowedRegistries {
+		if image == allowed || strings.HasPrefix(image, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
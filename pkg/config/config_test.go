@@ -0,0 +1,85 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+func TestParseKeepsDefaultsOfMissingSettings(t *testing.T) {
+	c, err := Parse([]byte("features:\n  hooks: false\ndefaults:\n  storageClass: fast\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Features.Hooks || !c.Features.Ingress {
+		t.Fatalf("expected only hooks to be disabled, got %+v", c.Features)
+	}
+	if c.Defaults.StorageClass != "fast" || c.Defaults.IngressPathType != networkingv1.PathTypeImplementationSpecific || c.Defaults.HPABehavior == nil {
+		t.Fatalf("expected the storage class to be set and the other defaults kept, got %+v", c.Defaults)
+	}
+	if c.RecorderName != Default().RecorderName {
+		t.Fatalf("expected the default recorder name, got %q", c.RecorderName)
+	}
+	if c.LabelDomain != DefaultLabelDomain {
+		t.Fatalf("expected the default label domain, got %q", c.LabelDomain)
+	}
+}
+
+func TestParseLabelDomain(t *testing.T) {
+	c, err := Parse([]byte("labelDomain: apps.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LabelDomain != "apps.example.com" {
+		t.Fatalf("expected the configured label domain, got %q", c.LabelDomain)
+	}
+}
+
+func TestParseRejectsInvalidSettings(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown setting": "labelPrefix: example.com\n",
+		"label domain":    "labelDomain: Example_Com\n",
+		"path type":       "defaults:\n  ingressPathType: Regex\n",
+		"hpa policy":      "defaults:\n  hpaBehavior:\n    scaleUp:\n      policies: [{type: Percent, value: 0, periodSeconds: 15}]\n",
+		"registry":        "allowedRegistries: [\"https://ghcr.io\"]\n",
+		"ceiling":         "resourceCeilings:\n  cpu: \"0\"\n",
+		"namespace":       "watchNamespaces: [Team_A]\n",
+	} {
+		if _, err := Parse([]byte(content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAllowsMatchesRegistriesAtPathBoundaries(t *testing.T) {
+	c := &Config{AllowedRegistries: []string{"docker.io", "ghcr.io/acme"}}
+	for image, allowed := range map[string]bool{
+		"docker.io/nginx":          true,
+		"ghcr.io/acme/app":         true,
+		"ghcr.io/acme-evil/app":    false,
+		"docker.io.evil.com/app":   false,
+		"registry.example.com/app": false,
+	} {
+		registry, repository, _ := strings.Cut(image, "/")
+		if got := c.Allows(registry, repository); got != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", image, allowed, got)
+		}
+	}
+}
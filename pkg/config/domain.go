@@ -0,0 +1,90 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LabelDomainConfigMapName is the ConfigMap in the operator namespace recording
+// the label domain the install uses.
+const LabelDomainConfigMapName = "one-click-operator-label-domain"
+
+// labelDomainField names the ConfigMap key holding the label domain.
+const labelDomainField = "labelDomain"
+
+// rolloutListKind lists Rollouts without depending on the API types.
+var rolloutListKind = schema.GroupVersionKind{Group: "one-click.dev", Version: "v1alpha1", Kind: "RolloutList"}
+
+// EnsureLabelDomain records the label domain on first use and fails if the
+// install already used another one, as the objects of existing Rollouts would
+// no longer be found. Installs with Rollouts but no record predate the setting
+// and use the default domain. Reads go through r, so it can run before the
+// cache is started.
+func EnsureLabelDomain(ctx context.Context, r client.Reader, c client.Client, namespace, domain string) error {
+	recorded, err := recordedLabelDomain(ctx, r, namespace)
+	if err != nil {
+		return err
+	}
+
+	if recorded == "" {
+		rollouts := &metav1.PartialObjectMetadataList{}
+		rollouts.SetGroupVersionKind(rolloutListKind)
+		if err := r.List(ctx, rollouts, client.Limit(1)); err != nil {
+			return err
+		}
+		recorded = domain
+		if len(rollouts.Items) > 0 {
+			recorded = DefaultLabelDomain
+		}
+
+		if err := c.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: LabelDomainConfigMapName, Namespace: namespace},
+			Data:       map[string]string{labelDomainField: recorded},
+		}); errors.IsAlreadyExists(err) {
+			// another replica recorded the domain first
+			if recorded, err = recordedLabelDomain(ctx, r, namespace); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if recorded != domain {
+		return fmt.Errorf("labelDomain %q differs from %q used by the install so far", domain, recorded)
+	}
+	return nil
+}
+
+// recordedLabelDomain returns the recorded label domain, empty if there is no
+// record yet.
+func recordedLabelDomain(ctx context.Context, r client.Reader, namespace string) (string, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Name: LabelDomainConfigMapName, Namespace: namespace}, configMap); err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	return configMap.Data[labelDomainField], nil
+}
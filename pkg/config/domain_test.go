@@ -0,0 +1,76 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+
+	oneclickiov1alpha1 "github.com/janlauber/one-click-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestEnsureLabelDomain(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := oneclickiov1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	rollout := &oneclickiov1alpha1.Rollout{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "project"}}
+	recorded := func(domain string) client.Object {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: LabelDomainConfigMapName, Namespace: "one-click-system"},
+			Data:       map[string]string{labelDomainField: domain},
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		objects  []client.Object
+		domain   string
+		wantErr  bool
+		recorded string
+	}{
+		"new install":                         {domain: "example.com", recorded: "example.com"},
+		"new install with the default":        {domain: DefaultLabelDomain, recorded: DefaultLabelDomain},
+		"install predating the record":        {objects: []client.Object{rollout}, domain: DefaultLabelDomain, recorded: DefaultLabelDomain},
+		"other domain on an existing install": {objects: []client.Object{rollout}, domain: "example.com", wantErr: true, recorded: DefaultLabelDomain},
+		"recorded domain":                     {objects: []client.Object{recorded("example.com"), rollout}, domain: "example.com", recorded: "example.com"},
+		"changed domain":                      {objects: []client.Object{recorded("example.com")}, domain: DefaultLabelDomain, wantErr: true, recorded: "example.com"},
+	} {
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tc.objects...).Build()
+		err := EnsureLabelDomain(context.Background(), c, c, "one-click-system", tc.domain)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error %v, got %v", name, tc.wantErr, err)
+		}
+
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(context.Background(), types.NamespacedName{Name: LabelDomainConfigMapName, Namespace: "one-click-system"}, configMap); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := configMap.Data[labelDomainField]; got != tc.recorded {
+			t.Errorf("%s: expected %q to be recorded, got %q", name, tc.recorded, got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Store holds the current settings and tells subscribers about changes.
+type Store struct {
+	current atomic.Pointer[Config]
+
+	mu          sync.Mutex
+	subscribers []func()
+}
+
+// NewStore returns a store holding the settings.
+func NewStore(c *Config) *Store {
+	s := &Store{}
+	s.current.Store(c)
+	return s
+}
+
+// Get returns the current settings, the defaults on a nil store. The settings
+// must not be modified.
+func (s *Store) Get() *Config {
+	if s == nil {
+		return Default()
+	}
+	return s.current.Load()
+}
+
+// Set replaces the settings and calls the subscribers.
+func (s *Store) Set(c *Config) {
+	s.current.Store(c)
+
+	s.mu.Lock()
+	subscribers := slices.Clone(s.subscribers)
+	s.mu.Unlock()
+	for _, fn := range subscribers {
+		fn()
+	}
+}
+
+// Subscribe registers fn to be called after the settings changed.
+func (s *Store) Subscribe(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Watcher reloads the config file into the store when its content changes.
+// The file is polled as mounted ConfigMaps are replaced through symlinks,
+// which file system notifications don't follow reliably.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+	Store    *Store
+	Log      logr.Logger
+}
+
+// Start polls the file until the context is done. Invalid content is logged
+// and the previous settings are kept.
+func (w *Watcher) Start(ctx context.Context) error {
+	last, _ := os.ReadFile(w.Path)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(w.Path)
+		if err != nil {
+			w.Log.Error(err, "unable to read config file", "path", w.Path)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		c, err := Parse(data)
+		if err != nil {
+			w.Log.Error(err, "invalid config file, keeping the previous settings", "path", w.Path)
+			continue
+		}
+		previous := w.Store.Get()
+		if c.LabelDomain != previous.LabelDomain {
+			w.Log.Error(nil, "labelDomain can't be changed, keeping the previous settings", "path", w.Path, "labelDomain", previous.LabelDomain)
+			continue
+		}
+		if c.RecorderName != previous.RecorderName || !slices.Equal(c.WatchNamespaces, previous.WatchNamespaces) {
+			w.Log.Info("recorderName and watchNamespaces take effect on restart", "path", w.Path)
+		}
+		w.Store.Set(c)
+		w.Log.Info("reloaded config file", "path", w.Path)
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica
+// keeps its settings current.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+// The names used before the naming scheme. Existing resources with these
+// names are migrated to the new names, see the Rollout reconciler.
+
+// LegacyService is the former name of the Service of an interface.
+func LegacyService(rollout, intf string) string {
+	return intf + "-" + rollout + "-svc"
+}
+
+// LegacyIngress is the former name of the Ingress of an interface.
+func LegacyIngress(rollout, intf string) string {
+	return intf + "-" + rollout + "-ingress"
+}
+
+// LegacyTLSSecret is the former name of the certificate Secret of an interface.
+func LegacyTLSSecret(rollout, intf string) string {
+	return intf + "-" + rollout + "-tls-secret"
+}
+
+// LegacyPersistentVolumeClaim is the former name of the PVC of a volume.
+func LegacyPersistentVolumeClaim(rollout, volume string) string {
+	return volume + "-" + rollout
+}
+
+// LegacyCronJobImagePullSecret is the former name of the pull secret of a
+// cron job image.
+func LegacyCronJobImagePullSecret(cronJob string) string {
+	return cronJob + "-imagepullsecret"
+}
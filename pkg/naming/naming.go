@@ -0,0 +1,161 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package naming generates the names of the resources of a Rollout.
+//
+// Resources belonging to an item of the Rollout spec, e.g. an interface or a
+// cron job, are named <rollout>-<item>[-<purpose>]-<hash>. The hash covers the
+// unjoined parts, so two Rollouts never share a name even if their joined parts
+// do, e.g. Rollout "app" with cron job "x-backup" and Rollout "app-x" with cron
+// job "backup". Names too long for their kind are truncated before the hash.
+//
+// Resources of the Rollout as a whole keep the documented <rollout>-<suffix>
+// names, other Rollouts and tools refer to them.
+package naming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxLength is the length of a DNS label. Services, pod volumes and
+	// everything used as a label value, e.g. Job names, must not exceed it.
+	MaxLength = 63
+
+	// MaxCronJobLength leaves room for the 11 characters the CronJob
+	// controller appends to the names of its Jobs.
+	MaxCronJobLength = 52
+
+	hashLength = 8
+)
+
+// Generate joins the parts with "-", truncated to maxLength including the hash
+// of the parts.
+func Generate(maxLength int, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "/")))
+	hash := hex.EncodeToString(sum[:])[:hashLength]
+
+	name := strings.Join(parts, "-")
+	if limit := maxLength - 1 - hashLength; len(name) > limit {
+		name = strings.TrimRight(name[:limit], "-.")
+	}
+	return name + "-" + hash
+}
+
+// Service is the name of the Service of an interface.
+func Service(rollout, intf string) string {
+	return Generate(MaxLength, rollout, intf)
+}
+
+// Ingress is the name of the Ingress of an interface.
+func Ingress(rollout, intf string) string {
+	return Generate(MaxLength, rollout, intf)
+}
+
+// TLSSecret is the name of the certificate Secret of an interface without an
+// explicit tlsSecretName.
+func TLSSecret(rollout, intf string) string {
+	return Generate(MaxLength, rollout, intf, "tls")
+}
+
+// BasicAuthSecret is the name of the htpasswd Secret of an interface.
+func BasicAuthSecret(rollout, intf string) string {
+	return Generate(MaxLength, rollout, intf, "basic-auth")
+}
+
+// Middleware is the name of the Traefik Middleware of an ingress feature.
+func Middleware(rollout, intf, feature string) string {
+	return Generate(MaxLength, rollout, intf, feature)
+}
+
+// PersistentVolumeClaim is the name of the PVC of a volume.
+func PersistentVolumeClaim(rollout, volume string) string {
+	return Generate(MaxLength, rollout, volume)
+}
+
+// Volume is the name of the pod volume of a PVC volume.
+func Volume(volume string) string {
+	return Generate(MaxLength, "pvc", volume)
+}
+
+// CronJob is the name of the CronJob of a cron job.
+func CronJob(rollout, cronJob string) string {
+	return Generate(MaxCronJobLength, rollout, cronJob)
+}
+
+// CronJobImagePullSecret is the name of the pull secret of a cron job image.
+func CronJobImagePullSecret(rollout, cronJob string) string {
+	return Generate(MaxLength, rollout, cronJob, "imagepullsecret")
+}
+
+// Secret is the name of the Secret with the secret values of the Rollout.
+func Secret(rollout string) string {
+	return rollout + "-secrets"
+}
+
+// GeneratedSecret is the name of the Secret keeping the generated values.
+func GeneratedSecret(rollout string) string {
+	return rollout + "-generated-secrets"
+}
+
+// ImagePullSecret is the name of the pull secret of the Rollout image.
+func ImagePullSecret(rollout string) string {
+	return rollout + "-imagepullsecret"
+}
+
+// ServiceAccount is the name of the ServiceAccount created if the Rollout
+// does not name one.
+func ServiceAccount(rollout string) string {
+	return rollout + "-sa"
+}
+
+// HookJob is the name of the Job of a deploy hook ("pre" or "post") for a pod
+// template hash. The Rollout name leaves room for "-post-" and a 10 character
+// hash.
+func HookJob(rollout, kind, hash string) string {
+	return Truncate(rollout, 47) + "-" + kind + "-" + hash
+}
+
+// ManualJob is the name of a Job run from a CronJob on request. The CronJob
+// name leaves room for "-manual-" and the Unix time.
+func ManualJob(cronJob string, unix int64) string {
+	return Truncate(cronJob, 41) + "-manual-" + strconv.FormatInt(unix, 10)
+}
+
+// RolloutRunJob is the name of the Job of a RolloutRun. Run names that fit a
+// label value are kept, longer ones are truncated before a hash.
+func RolloutRunJob(run string) string {
+	if len(run) <= MaxLength {
+		return run
+	}
+	return Generate(MaxLength, run)
+}
+
+// VolumeSnapshot is the name of the snapshot of a PVC taken at timestamp.
+func VolumeSnapshot(pvc, timestamp string) string {
+	return Truncate(pvc, 253-len(timestamp)-1) + "-" + timestamp
+}
+
+// Truncate shortens name to maxLength characters without a trailing "-" or ".".
+func Truncate(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+	return strings.TrimRight(name[:maxLength], "-.")
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestNamesOfDifferentRolloutsDoNotCollide(t *testing.T) {
+	if a, b := CronJob("app", "x-backup"), CronJob("app-x", "backup"); a == b {
+		t.Fatalf("expected different names, both are %s", a)
+	}
+	if a, b := CronJobImagePullSecret("app", "web"), CronJobImagePullSecret("app", "web"); a != b {
+		t.Fatalf("expected the same name for the same parts, got %s and %s", a, b)
+	}
+}
+
+func TestNamesAreTruncatedToValidLabels(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	names := map[string]int{
+		Service(long, "http"):                          MaxLength,
+		Ingress(long, "http"):                          MaxLength,
+		TLSSecret(long, "http"):                        MaxLength,
+		BasicAuthSecret(long, "http"):                  MaxLength,
+		Middleware(long, "http", "redirect"):           MaxLength,
+		PersistentVolumeClaim(long, "data"):            MaxLength,
+		Volume(long):                                   MaxLength,
+		CronJob(long, "backup"):                        MaxCronJobLength,
+		HookJob(long, "post", "0123456789"):            MaxLength,
+		ManualJob(CronJob(long, "backup"), 1700000000): MaxLength,
+		RolloutRunJob(long + "-migrate-database"):      MaxLength,
+	}
+	for name, maxLength := range names {
+		if len(name) > maxLength {
+			t.Errorf("%s is longer than %d characters", name, maxLength)
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			t.Errorf("%s is no valid label: %v", name, errs)
+		}
+	}
+
+	// Truncated names of different parts stay apart
+	if a, b := Service(long, "http"), Service(long, "https"); a == b {
+		t.Fatalf("expected different names, both are %s", a)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scope decides which namespaces an operator replica manages and which
+// objects its cache holds.
+package scope
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Scope is the set of namespaces an operator replica manages. A nil scope
+// contains every namespace.
+type Scope struct {
+	// Namespaces in scope, all if empty.
+	Namespaces []string
+	// NamespaceSelector selects the namespaces in scope by their labels, all
+	// if nil.
+	NamespaceSelector labels.Selector
+	// Shards is the number of replicas sharing the namespaces by hash, Shard
+	// the index of this replica. Sharding is off below two shards.
+	Shards int
+	Shard  int
+}
+
+// Contains reports whether the namespace is in scope. The namespace is read
+// through c if a namespace selector is set.
+func (s *Scope) Contains(ctx context.Context, c client.Reader, namespace string) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	if len(s.Namespaces) > 0 && !slices.Contains(s.Namespaces, namespace) {
+		return false, nil
+	}
+	if !s.InShard(namespace) {
+		return false, nil
+	}
+	if s.NamespaceSelector != nil && !s.NamespaceSelector.Empty() {
+		ns := &corev1.Namespace{}
+		if err := c.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		return s.NamespaceSelector.Matches(labels.Set(ns.Labels)), nil
+	}
+	return true, nil
+}
+
+// InShard reports whether the namespace falls to this replica by its hash,
+// whether it is in scope otherwise or not.
+func (s *Scope) InShard(namespace string) bool {
+	return s == nil || s.Shards <= 1 || ShardOf(namespace, s.Shards) == s.Shard
+}
+
+// Predicate passes events of objects in scope. Namespaces are in scope if they
+// are contained themselves. Namespaces that can't be read are out of scope
+// until their next event.
+func (s *Scope) Predicate(c client.Reader) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		namespace := obj.GetNamespace()
+		if _, ok := obj.(*corev1.Namespace); ok {
+			namespace = obj.GetName()
+		}
+		contained, err := s.Contains(context.Background(), c, namespace)
+		return err == nil && contained
+	})
+}
+
+// ShardOf returns the shard of a namespace.
+func ShardOf(namespace string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// CacheOptions restricts the cache to the namespaces, all if empty, plus the
+// extra namespaces, e.g. the one of the operator. With byLabel, the informers
+// of the objects the operator creates for Rollouts only hold objects with the
+// deploymentId label of the label domain. Secrets are selected as well, the
+// ones Rollouts reference but don't own are read from the API server.
+func CacheOptions(namespaces []string, extra []string, byLabel bool, labelDomain string) cache.Options {
+	var options cache.Options
+	if len(namespaces) > 0 {
+		options.DefaultNamespaces = map[string]cache.Config{}
+		for _, ns := range slices.Concat(namespaces, extra) {
+			options.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
+
+	if byLabel {
+		requirement, err := labels.NewRequirement(labelDomain+"/deploymentId", selection.Exists, nil)
+		if err != nil {
+			panic(err)
+		}
+		selected := cache.ByObject{Label: labels.NewSelector().Add(*requirement)}
+		options.ByObject = map[client.Object]cache.ByObject{
+			&appsv1.Deployment{}:                     selected,
+			&appsv1.ReplicaSet{}:                     selected,
+			&corev1.Service{}:                        selected,
+			&corev1.ServiceAccount{}:                 selected,
+			&corev1.PersistentVolumeClaim{}:          selected,
+			&corev1.Secret{}:                         selected,
+			&corev1.Pod{}:                            selected,
+			&networkingv1.Ingress{}:                  selected,
+			&autoscalingv2.HorizontalPodAutoscaler{}: selected,
+			&batchv1.CronJob{}:                       selected,
+			&batchv1.Job{}:                           selected,
+		}
+	}
+	return options
+}
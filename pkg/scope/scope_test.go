@@ -0,0 +1,106 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scope
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestContainsOnlyNamespacesInScope(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"one-click.dev/project": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+	).Build()
+	selector, err := labels.Parse("one-click.dev/project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		scope     *Scope
+		namespace string
+		contained bool
+	}{
+		"nil scope":                {nil, "team-b", true},
+		"listed namespace":         {&Scope{Namespaces: []string{"team-a"}}, "team-a", true},
+		"unlisted namespace":       {&Scope{Namespaces: []string{"team-a"}}, "team-b", false},
+		"labeled namespace":        {&Scope{NamespaceSelector: selector}, "team-a", true},
+		"unlabeled namespace":      {&Scope{NamespaceSelector: selector}, "team-b", false},
+		"missing namespace":        {&Scope{NamespaceSelector: selector}, "team-c", false},
+		"namespace of this shard":  {&Scope{Shards: 3, Shard: ShardOf("team-a", 3)}, "team-a", true},
+		"namespace of other shard": {&Scope{Shards: 3, Shard: (ShardOf("team-a", 3) + 1) % 3}, "team-a", false},
+	} {
+		contained, err := tc.scope.Contains(context.Background(), c, tc.namespace)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if contained != tc.contained {
+			t.Errorf("%s: expected contained %v, got %v", name, tc.contained, contained)
+		}
+	}
+}
+
+func TestPredicateDropsEventsOutOfScope(t *testing.T) {
+	s := &Scope{Namespaces: []string{"team-a"}}
+	p := s.Predicate(fake.NewClientBuilder().Build())
+
+	if !p.Generic(event.GenericEvent{Object: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}}) {
+		t.Error("expected the event of a pod in scope to pass")
+	}
+	if p.Generic(event.GenericEvent{Object: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-b"}}}) {
+		t.Error("expected the event of a pod out of scope to be dropped")
+	}
+	if !p.Generic(event.GenericEvent{Object: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}}) {
+		t.Error("expected the event of a namespace in scope to pass")
+	}
+}
+
+func TestCacheOptionsSelectLabeledObjects(t *testing.T) {
+	options := CacheOptions([]string{"team-a"}, []string{"one-click-system"}, true, "example.com")
+	if _, ok := options.DefaultNamespaces["one-click-system"]; !ok || len(options.DefaultNamespaces) != 2 {
+		t.Fatalf("expected the namespaces and the extra namespace, got %v", options.DefaultNamespaces)
+	}
+
+	for obj, byObject := range options.ByObject {
+		if !byObject.Label.Matches(labels.Set{"example.com/deploymentId": "app"}) {
+			t.Errorf("%T: expected objects of a Rollout to be cached", obj)
+		}
+		if byObject.Label.Matches(labels.Set{"app": "other"}) || byObject.Label.Matches(labels.Set{"one-click.dev/deploymentId": "app"}) {
+			t.Errorf("%T: expected objects without the deploymentId label of the domain not to be cached", obj)
+		}
+	}
+	secretsSelected := false
+	for obj := range options.ByObject {
+		if _, ok := obj.(*corev1.Secret); ok {
+			secretsSelected = true
+		}
+	}
+	if !secretsSelected {
+		t.Error("expected Secrets to be selected by label")
+	}
+
+	if options := CacheOptions(nil, []string{"one-click-system"}, false, "example.com"); options.DefaultNamespaces != nil || options.ByObject != nil {
+		t.Fatalf("expected the whole cluster to be cached, got %+v", options)
+	}
+}
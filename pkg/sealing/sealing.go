@@ -0,0 +1,321 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sealing encrypts Rollout secret values against a key held by the
+// operator. Values are encrypted with a random AES-256-GCM key, which in turn is
+// wrapped with RSA-OAEP (SHA-256) for one of the operator's key pairs.
+//
+// An encrypted value has the form
+// "v2:<key id>:<scope>:<wrapped key>:<ciphertext>", with both binary parts
+// base64 encoded, so it can be decrypted by any key ring still holding the key
+// it was sealed for. The scope is the namespace, or namespace/name, of the
+// Rollouts the value may be used by. It is authenticated with the ciphertext,
+// so a value copied to a Rollout out of its scope can't be decrypted.
+//
+// Values of the former form "v1:<key id>:<wrapped key>:<ciphertext>" are not
+// bound to a scope and are only decrypted with DecryptUnscoped.
+package sealing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// KeySecretName is the Secret in the operator namespace holding the key ring.
+	KeySecretName = "one-click-operator-sealing-keys"
+	// PublicKeyConfigMapName is the ConfigMap in the operator namespace holding
+	// the active public key, so values can be sealed without access to the
+	// private keys.
+	PublicKeyConfigMapName = "one-click-operator-sealing-public-key"
+
+	// activeKeyField names the data key holding the id of the active key.
+	activeKeyField = "active"
+	// publicKeyField names the ConfigMap key holding the active public key.
+	publicKeyField   = "publicKey"
+	privateKeySuffix = ".key"
+	publicKeySuffix  = ".pub"
+
+	formatVersion         = "v2"
+	unscopedFormatVersion = "v1"
+)
+
+// rsaKeyBits is the size of generated keys.
+var rsaKeyBits = 4096
+
+// ErrUnscoped is returned for values sealed without a scope.
+var ErrUnscoped = errors.New("value is not bound to a namespace, seal it again with --namespace")
+
+// KeyRing holds the operator key pairs. New values are sealed for the active
+// key, all keys remain available for decryption until they are removed.
+type KeyRing struct {
+	keys   map[string]*rsa.PrivateKey
+	active string
+}
+
+// NewKeyRing returns a key ring with a freshly generated active key.
+func NewKeyRing() (*KeyRing, error) {
+	k := &KeyRing{keys: map[string]*rsa.PrivateKey{}}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadKeyRing parses the key ring stored in the data of the key Secret.
+func LoadKeyRing(data map[string][]byte) (*KeyRing, error) {
+	k := &KeyRing{keys: map[string]*rsa.PrivateKey{}, active: string(data[activeKeyField])}
+	for name, value := range data {
+		if !strings.HasSuffix(name, privateKeySuffix) {
+			continue
+		}
+		key, err := parsePrivateKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", name, err)
+		}
+		k.keys[KeyID(&key.PublicKey)] = key
+	}
+	if _, ok := k.keys[k.active]; !ok {
+		return nil, fmt.Errorf("active key %q not found in key ring", k.active)
+	}
+	return k, nil
+}
+
+// Data serializes the key ring into Secret data.
+func (k *KeyRing) Data() (map[string][]byte, error) {
+	data := map[string][]byte{activeKeyField: []byte(k.active)}
+	for id, key := range k.keys {
+		data[id+privateKeySuffix] = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		public, err := EncodePublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		data[id+publicKeySuffix] = public
+	}
+	return data, nil
+}
+
+// Rotate generates a new key and makes it the active one. Previous keys are
+// kept so values sealed for them can still be decrypted.
+func (k *KeyRing) Rotate() error {
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return err
+	}
+	id := KeyID(&key.PublicKey)
+	k.keys[id] = key
+	k.active = id
+	return nil
+}
+
+// Prune removes all keys except the active one.
+func (k *KeyRing) Prune() {
+	for id := range k.keys {
+		if id != k.active {
+			delete(k.keys, id)
+		}
+	}
+}
+
+// KeyIDs returns the ids of all keys in the ring.
+func (k *KeyRing) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ActiveKeyID returns the id of the key new values are sealed for.
+func (k *KeyRing) ActiveKeyID() string {
+	return k.active
+}
+
+// PublicKey returns the public key of the active key.
+func (k *KeyRing) PublicKey() *rsa.PublicKey {
+	return &k.keys[k.active].PublicKey
+}
+
+// Decrypt opens a value sealed for any key of the ring, if the Rollout
+// namespace/name is in the scope of the value.
+func (k *KeyRing) Decrypt(value, namespace, name string) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) == 4 && parts[0] == unscopedFormatVersion {
+		return nil, ErrUnscoped
+	}
+	if len(parts) != 5 || parts[0] != formatVersion {
+		return nil, errors.New("malformed encrypted value")
+	}
+
+	scope := parts[2]
+	scopeNamespace, scopeName, named := strings.Cut(scope, "/")
+	if scopeNamespace != namespace || (named && scopeName != name) {
+		return nil, fmt.Errorf("value is sealed for %s, not for Rollout %s/%s", scope, namespace, name)
+	}
+	return k.open(parts[1], parts[3], parts[4], additionalData(parts[1], scope))
+}
+
+// DecryptUnscoped opens a value of the former form, which is not bound to a
+// scope. Any Rollout can use such a value, so it should be sealed again.
+func (k *KeyRing) DecryptUnscoped(value string) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 4 || parts[0] != unscopedFormatVersion {
+		return nil, errors.New("malformed encrypted value")
+	}
+	return k.open(parts[1], parts[2], parts[3], []byte(parts[1]))
+}
+
+// open unwraps the data key and decrypts the ciphertext, both authenticated
+// with the additional data.
+func (k *KeyRing) open(id, encodedKey, encodedCiphertext string, ad []byte) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("value is sealed for unknown key %s", id)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed wrapped key: %w", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encodedCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ciphertext: %w", err)
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, wrappedKey, ad)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// Encrypt seals plaintext for the given public key. The value can only be
+// used by Rollouts in the namespace, and only by the named one if name is set.
+func Encrypt(pub *rsa.PublicKey, namespace, name string, plaintext []byte) (string, error) {
+	if namespace == "" {
+		return "", errors.New("a namespace is required")
+	}
+	if strings.ContainsAny(namespace+name, ":/") {
+		return "", fmt.Errorf("invalid scope %s/%s", namespace, name)
+	}
+	id := KeyID(pub)
+	scope := namespace
+	if name != "" {
+		scope += "/" + name
+	}
+	ad := additionalData(id, scope)
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, ad)
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dataKey, ad)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		formatVersion,
+		id,
+		scope,
+		base64.StdEncoding.EncodeToString(wrappedKey),
+		base64.StdEncoding.EncodeToString(sealed),
+	}, ":"), nil
+}
+
+// additionalData binds a value to its format, key and scope.
+func additionalData(id, scope string) []byte {
+	return []byte(formatVersion + ":" + id + ":" + scope)
+}
+
+// KeyID returns the id of a public key, the first 8 bytes of the SHA-256 of its
+// DER encoding.
+func KeyID(pub *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return hex.EncodeToString(sum[:8])
+}
+
+// EncodePublicKey returns the PEM encoding of a public key.
+func EncodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePublicKey parses a PEM encoded RSA public key.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaPub, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sealing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestMain(m *testing.M) {
+	// small keys keep the tests fast, the format doesn't depend on the size
+	rsaKeyBits = 1024
+	os.Exit(m.Run())
+}
+
+func newTestKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	ring, err := NewKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ring := newTestKeyRing(t)
+
+	for _, tc := range []struct {
+		name               string
+		sealedFor          [2]string
+		namespace, rollout string
+		wantErr            bool
+	}{
+		{name: "namespace", sealedFor: [2]string{"project", ""}, namespace: "project", rollout: "app"},
+		{name: "rollout", sealedFor: [2]string{"project", "app"}, namespace: "project", rollout: "app"},
+		{name: "other namespace", sealedFor: [2]string{"project", ""}, namespace: "other", rollout: "app", wantErr: true},
+		{name: "other rollout", sealedFor: [2]string{"project", "app"}, namespace: "project", rollout: "other", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := Encrypt(ring.PublicKey(), tc.sealedFor[0], tc.sealedFor[1], []byte("s3cr3t"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := ring.Decrypt(value, tc.namespace, tc.rollout)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected %s to be rejected for %s/%s", value, tc.namespace, tc.rollout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "s3cr3t" {
+				t.Errorf("expected s3cr3t, got %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestScopeCannotBeRewritten(t *testing.T) {
+	ring := newTestKeyRing(t)
+	value, err := Encrypt(ring.PublicKey(), "project", "", []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := strings.Replace(value, ":project:", ":other:", 1)
+	if _, err := ring.Decrypt(rewritten, "other", "app"); err == nil {
+		t.Fatal("expected a value with a rewritten scope to fail authentication")
+	}
+}
+
+func TestDecryptWithRotatedAndPrunedKeys(t *testing.T) {
+	ring := newTestKeyRing(t)
+	old, err := Encrypt(ring.PublicKey(), "project", "", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	current, err := Encrypt(ring.PublicKey(), "project", "", []byte("current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.KeyIDs()) != 2 {
+		t.Fatalf("expected two keys after rotation, got %v", ring.KeyIDs())
+	}
+
+	// the rotated ring survives a round trip through the Secret
+	data, err := ring.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = LoadKeyRing(data); err != nil {
+		t.Fatal(err)
+	}
+	for value, want := range map[string]string{old: "old", current: "current"} {
+		plaintext, err := ring.Decrypt(value, "project", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != want {
+			t.Errorf("expected %q, got %q", want, plaintext)
+		}
+	}
+
+	ring.Prune()
+	if _, err := ring.Decrypt(old, "project", "app"); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("expected the value of the pruned key to be rejected, got %v", err)
+	}
+	if _, err := ring.Decrypt(current, "project", "app"); err != nil {
+		t.Errorf("expected the value of the active key to still decrypt, got %v", err)
+	}
+}
+
+func TestDecryptRejectsInvalidValues(t *testing.T) {
+	ring := newTestKeyRing(t)
+	value, err := Encrypt(ring.PublicKey(), "project", "", []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(value, ":")
+
+	other := newTestKeyRing(t)
+	foreign, err := Encrypt(other.PublicKey(), "project", "", []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit of the ciphertext
+	ciphertext := []byte(parts[4])
+	if ciphertext[10] == 'A' {
+		ciphertext[10] = 'B'
+	} else {
+		ciphertext[10] = 'A'
+	}
+
+	for name, value := range map[string]string{
+		"wrong key id":       strings.Join([]string{parts[0], KeyID(other.PublicKey()), parts[2], parts[3], parts[4]}, ":"),
+		"foreign key":        foreign,
+		"tampered":           strings.Join([]string{parts[0], parts[1], parts[2], parts[3], string(ciphertext)}, ":"),
+		"swapped key id":     strings.Join([]string{parts[0], parts[1], parts[2], strings.Split(foreign, ":")[3], parts[4]}, ":"),
+		"truncated":          strings.Join(parts[:4], ":"),
+		"unknown version":    strings.Join(append([]string{"v9"}, parts[1:]...), ":"),
+		"invalid base64":     strings.Join([]string{parts[0], parts[1], parts[2], "%%%", parts[4]}, ":"),
+		"short ciphertext":   strings.Join([]string{parts[0], parts[1], parts[2], parts[3], "AAAA"}, ":"),
+		"empty":              "",
+		"unscoped format v1": strings.Join([]string{"v1", parts[1], parts[3], parts[4]}, ":"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ring.Decrypt(value, "project", "app"); err == nil {
+				t.Errorf("expected %q to be rejected", value)
+			}
+		})
+	}
+}
+
+func TestUnscopedValuesAreOnlyDecryptedExplicitly(t *testing.T) {
+	ring := newTestKeyRing(t)
+	value, err := Encrypt(ring.PublicKey(), "project", "", []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(value, ":")
+	unscoped := strings.Join([]string{unscopedFormatVersion, parts[1], parts[3], parts[4]}, ":")
+
+	if _, err := ring.Decrypt(unscoped, "project", "app"); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("expected ErrUnscoped, got %v", err)
+	}
+	// the data key is bound to the v2 additional data, so it doesn't open as v1
+	if _, err := ring.DecryptUnscoped(unscoped); err == nil {
+		t.Error("expected a v2 value relabelled as v1 to fail authentication")
+	}
+	if _, err := ring.DecryptUnscoped(value); err == nil {
+		t.Error("expected DecryptUnscoped to reject v2 values")
+	}
+}
+
+func TestEncryptRequiresNamespace(t *testing.T) {
+	ring := newTestKeyRing(t)
+	for _, scope := range [][2]string{{"", ""}, {"", "app"}, {"pro:ject", ""}, {"project", "a/pp"}} {
+		if _, err := Encrypt(ring.PublicKey(), scope[0], scope[1], []byte("s3cr3t")); err == nil {
+			t.Errorf("expected scope %q to be rejected", scope)
+		}
+	}
+}
+
+func newTestClient(t *testing.T, funcs interceptor.Funcs, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).WithInterceptorFuncs(funcs).Build()
+}
+
+func assertPublished(t *testing.T, c client.Client, ring *KeyRing) {
+	t.Helper()
+	pub, err := LoadPublicKeyFromCluster(context.Background(), c, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyID(pub) != ring.ActiveKeyID() {
+		t.Errorf("expected the public key of %s to be published, got %s", ring.ActiveKeyID(), KeyID(pub))
+	}
+}
+
+func TestEnsureKeyRing(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, interceptor.Funcs{})
+
+	created, err := EnsureKeyRing(ctx, c, c, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPublished(t, c, created)
+
+	loaded, err := EnsureKeyRing(ctx, c, c, "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ActiveKeyID() != created.ActiveKeyID() {
+		t.Errorf("expected the existing key ring to be loaded, got key %s instead of %s", loaded.ActiveKeyID(), created.ActiveKeyID())
+	}
+
+	if err := loaded.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeyRing(ctx, c, "operator", loaded); err != nil {
+		t.Fatal(err)
+	}
+	assertPublished(t, c, loaded)
+}
+
+func TestEnsureKeyRingLosesCreateRace(t *testing.T) {
+	ctx := context.Background()
+
+	// another replica created the key ring between our Get and Create
+	winner := newTestKeyRing(t)
+	data, err := winner.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: KeySecretName, Namespace: "operator"}, Data: data}
+
+	missed := false
+	c := newTestClient(t, interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if _, ok := obj.(*corev1.Secret); ok && !missed {
+				missed = true
+				return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	}, secret)
+
+	ring, err := EnsureKeyRing(ctx, c, c, "operator")
+	if err != nil {
+		t.Fatalf("expected the key ring of the other replica to be loaded, got %v", err)
+	}
+	if ring.ActiveKeyID() != winner.ActiveKeyID() {
+		t.Errorf("expected key %s of the other replica, got %s", winner.ActiveKeyID(), ring.ActiveKeyID())
+	}
+	assertPublished(t, c, winner)
+
+	stored := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: KeySecretName, Namespace: "operator"}, stored); err != nil {
+		t.Fatal(err)
+	}
+	if string(stored.Data[activeKeyField]) != winner.ActiveKeyID() {
+		t.Errorf("expected the key ring of the other replica to be kept")
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sealing
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LoadKeyRingFromCluster reads the key ring from the key Secret in namespace.
+func LoadKeyRingFromCluster(ctx context.Context, c client.Reader, namespace string) (*KeyRing, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: KeySecretName, Namespace: namespace}, secret); err != nil {
+		return nil, err
+	}
+	return LoadKeyRing(secret.Data)
+}
+
+// LoadPublicKeyFromCluster reads the active public key from the public key
+// ConfigMap in namespace.
+func LoadPublicKeyFromCluster(ctx context.Context, c client.Reader, namespace string) (*rsa.PublicKey, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Name: PublicKeyConfigMapName, Namespace: namespace}, configMap); err != nil {
+		return nil, err
+	}
+	return ParsePublicKey([]byte(configMap.Data[publicKeyField]))
+}
+
+// EnsureKeyRing loads the key ring from the cluster and creates the key Secret
+// with a new key when it does not exist yet. The active public key is
+// published in the public key ConfigMap. Reads go through r, the key Secret is
+// missing from caches restricted to labelled Secrets.
+func EnsureKeyRing(ctx context.Context, r client.Reader, c client.Client, namespace string) (*KeyRing, error) {
+	ring, err := LoadKeyRingFromCluster(ctx, r, namespace)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if errors.IsNotFound(err) {
+		if ring, err = createKeyRing(ctx, c, namespace); errors.IsAlreadyExists(err) {
+			// another replica created the key ring first
+			ring, err = LoadKeyRingFromCluster(ctx, r, namespace)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := PublishPublicKey(ctx, c, namespace, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func createKeyRing(ctx context.Context, c client.Client, namespace string) (*KeyRing, error) {
+	ring, err := NewKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ring.Data()
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KeySecretName,
+			Namespace: namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	if err := c.Create(ctx, secret); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// SaveKeyRing writes the key ring back to the key Secret and publishes its
+// active public key.
+func SaveKeyRing(ctx context.Context, c client.Client, namespace string, ring *KeyRing) error {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: KeySecretName, Namespace: namespace}, secret); err != nil {
+		return err
+	}
+	data, err := ring.Data()
+	if err != nil {
+		return err
+	}
+	secret.Data = data
+	if err := c.Update(ctx, secret); err != nil {
+		return err
+	}
+	return PublishPublicKey(ctx, c, namespace, ring)
+}
+
+// PublishPublicKey writes the active public key of the ring to the public key
+// ConfigMap. The ConfigMap is patched blindly, so the operator doesn't need to
+// watch ConfigMaps.
+func PublishPublicKey(ctx context.Context, c client.Client, namespace string, ring *KeyRing) error {
+	pem, err := EncodePublicKey(ring.PublicKey())
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		activeKeyField: ring.ActiveKeyID(),
+		publicKeyField: string(pem),
+	}
+
+	patch, err := json.Marshal(map[string]any{"data": data})
+	if err != nil {
+		return err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PublicKeyConfigMapName,
+			Namespace: namespace,
+		},
+	}
+	err = c.Patch(ctx, configMap, client.RawPatch(types.MergePatchType, patch))
+	if !errors.IsNotFound(err) {
+		return err
+	}
+
+	configMap.Data = data
+	if err := c.Create(ctx, configMap); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
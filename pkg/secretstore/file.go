@@ -0,0 +1,70 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileProvider reads secrets from files below a root directory, e.g. a mounted
+// Secret or a directory populated by a CSI driver. Without a key the whole file
+// is the value, with a key the file is parsed as a flat JSON object.
+type FileProvider struct {
+	Root string
+}
+
+// NewFileProvider returns a provider reading below root.
+func NewFileProvider(root string) *FileProvider {
+	return &FileProvider{Root: root}
+}
+
+// GetSecret implements Provider.
+func (p *FileProvider) GetSecret(_ context.Context, path, key string) ([]byte, error) {
+	if err := ValidatePath(path); err != nil {
+		return nil, err
+	}
+	// Clean the path as if it was absolute so it can never leave the root
+	file := filepath.Join(p.Root, filepath.Clean("/"+path))
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return []byte(strings.TrimSuffix(string(data), "\n")), nil
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return nil, fmt.Errorf("%s#%s: %w", path, key, ErrNotFound)
+	}
+	return []byte(value), nil
+}
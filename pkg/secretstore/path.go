@@ -0,0 +1,99 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretstore
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// DefaultPathTemplate confines the Rollouts of a namespace to the paths below a
+// directory of the same name.
+const DefaultPathTemplate = "{{.Namespace}}/{{.Path}}"
+
+// PathTemplateData is passed to the path template.
+type PathTemplateData struct {
+	Namespace string
+	Path      string
+}
+
+// PathTemplate maps the path referenced by a Rollout to the path in the secret
+// store, so Rollouts can only read the paths of their own namespace.
+type PathTemplate struct {
+	tmpl *template.Template
+}
+
+// ParsePathTemplate parses a path template. The template has to depend on the
+// namespace, otherwise every Rollout could read the paths of all namespaces.
+func ParsePathTemplate(text string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &PathTemplate{tmpl: tmpl}
+
+	first, err := t.Path("namespace-a", "path")
+	if err != nil {
+		return nil, err
+	}
+	second, err := t.Path("namespace-b", "path")
+	if err != nil {
+		return nil, err
+	}
+	if first == second {
+		return nil, fmt.Errorf("path template %q does not contain the namespace", text)
+	}
+	return t, nil
+}
+
+// Path returns the path in the secret store for a path referenced by a Rollout
+// in namespace. Paths with ".." segments are rejected, as they could leave the
+// directory of the namespace.
+func (t *PathTemplate) Path(namespace, path string) (string, error) {
+	if err := ValidatePath(path); err != nil {
+		return "", err
+	}
+	if t == nil {
+		t = defaultPathTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, PathTemplateData{
+		Namespace: namespace,
+		Path:      strings.TrimPrefix(path, "/"),
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var defaultPathTemplate = &PathTemplate{tmpl: template.Must(template.New("path").Parse(DefaultPathTemplate))}
+
+// ValidatePath rejects empty paths and paths with "." or ".." segments.
+func ValidatePath(path string) error {
+	if strings.Trim(path, "/") == "" {
+		return fmt.Errorf("path is empty")
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." || segment == "." {
+			return fmt.Errorf("path %q must not contain %q segments", path, segment)
+		}
+	}
+	return nil
+}
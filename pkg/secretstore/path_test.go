@@ -0,0 +1,88 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathTemplate(t *testing.T) {
+	var defaultTemplate *PathTemplate
+	path, err := defaultTemplate.Path("project", "/apps/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "project/apps/db" {
+		t.Errorf("expected project/apps/db, got %s", path)
+	}
+
+	custom, err := ParsePathTemplate("one-click/{{.Namespace}}/{{.Path}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := custom.Path("project", "apps/db"); path != "one-click/project/apps/db" {
+		t.Errorf("expected one-click/project/apps/db, got %s", path)
+	}
+
+	for _, text := range []string{"{{.Path}}", "shared/{{.Path}}", "{{.Namespace", "{{.Tenant}}/{{.Path}}"} {
+		if _, err := ParsePathTemplate(text); err == nil {
+			t.Errorf("expected template %q to be rejected", text)
+		}
+	}
+}
+
+func TestPathsLeavingTheNamespaceAreRejected(t *testing.T) {
+	var defaultTemplate *PathTemplate
+	for _, path := range []string{"../other/db", "apps/../../other/db", "apps/..", "./db", "", "/"} {
+		if _, err := defaultTemplate.Path("project", path); err == nil {
+			t.Errorf("expected path %q to be rejected", path)
+		}
+	}
+}
+
+func TestFileProviderRejectsDotDotPaths(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "project"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "project", "db"), []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "config.json"), []byte(`{"password":"other"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewFileProvider(root)
+	value, err := provider.GetSecret(context.Background(), "project/db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "s3cr3t" {
+		t.Errorf("expected s3cr3t, got %q", value)
+	}
+
+	if _, err := provider.GetSecret(context.Background(), "project/../config.json", "password"); err == nil {
+		t.Error("expected a path with .. to be rejected")
+	}
+	if _, err := provider.GetSecret(context.Background(), "project/missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
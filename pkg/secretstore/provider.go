@@ -0,0 +1,33 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package secretstore resolves Rollout secret values from external stores.
+package secretstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned by providers when the path or key does not exist.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider reads secret values from an external store.
+type Provider interface {
+	// GetSecret returns the value stored under key at path. Providers storing a
+	// single value per path return it when key is empty.
+	GetSecret(ctx context.Context, path, key string) ([]byte, error)
+}
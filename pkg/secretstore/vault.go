@@ -0,0 +1,182 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountTokenFile is the projected token used for Vault's Kubernetes auth.
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultConfig configures the Vault KV version 2 provider.
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200.
+	Address string
+	// Mount is the path the KV v2 engine is mounted at, "secret" if empty.
+	Mount string
+	// Token authenticates directly. If empty, Role is used for Kubernetes auth.
+	Token string
+	// Role is the Vault role for the Kubernetes auth method.
+	Role string
+	// AuthMount is the path the Kubernetes auth method is mounted at, "kubernetes" if empty.
+	AuthMount string
+	// TokenFile holds the service account token for Kubernetes auth.
+	TokenFile string
+}
+
+// VaultProvider reads secrets from a Vault KV version 2 engine over the HTTP API.
+type VaultProvider struct {
+	config VaultConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewVaultProvider returns a provider for the given configuration.
+func NewVaultProvider(config VaultConfig) *VaultProvider {
+	if config.Mount == "" {
+		config.Mount = "secret"
+	}
+	if config.AuthMount == "" {
+		config.AuthMount = "kubernetes"
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = serviceAccountTokenFile
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+
+	return &VaultProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// GetSecret implements Provider.
+func (p *VaultProvider) GetSecret(ctx context.Context, path, key string) ([]byte, error) {
+	if err := ValidatePath(path); err != nil {
+		return nil, err
+	}
+	token, err := p.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/v1/%s/data/%s", p.config.Address, p.config.Mount, strings.TrimPrefix(path, "/"))
+	if err := p.do(ctx, http.MethodGet, url, token, nil, &response); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if key == "" {
+		// a path with a single value can be referenced without key
+		if len(response.Data.Data) != 1 {
+			return nil, fmt.Errorf("%s holds %d keys, a key is required", path, len(response.Data.Data))
+		}
+		for k := range response.Data.Data {
+			key = k
+		}
+	}
+
+	value, ok := response.Data.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("%s#%s: %w", path, key, ErrNotFound)
+	}
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(value)
+}
+
+// authToken returns the static token or a (cached) token from Kubernetes auth.
+func (p *VaultProvider) authToken(ctx context.Context) (string, error) {
+	if p.config.Token != "" {
+		return p.config.Token, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	jwt, err := os.ReadFile(p.config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"role": p.config.Role, "jwt": string(jwt)})
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	url := fmt.Sprintf("%s/v1/auth/%s/login", p.config.Address, p.config.AuthMount)
+	if err := p.do(ctx, http.MethodPost, url, "", body, &response); err != nil {
+		return "", fmt.Errorf("vault login: %w", err)
+	}
+
+	p.token = response.Auth.ClientToken
+	// renew halfway through the lease
+	p.tokenExpiry = time.Now().Add(time.Duration(response.Auth.LeaseDuration) * time.Second / 2)
+	return p.token, nil
+}
+
+func (p *VaultProvider) do(ctx context.Context, method, url, token string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secretstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newVaultDevServer is a stand-in for `vault server -dev` serving a KV v2 engine
+// at "secret" and the Kubernetes auth login endpoint.
+func newVaultDevServer(t *testing.T, data map[string]map[string]interface{}) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		var login map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role"] != "one-click" || login["jwt"] != "sa-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "k8s-token", "lease_duration": 3600},
+		})
+	})
+	mux.HandleFunc("/v1/secret/data/", func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "k8s-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		values, ok := data[r.URL.Path[len("/v1/secret/data/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": values},
+		})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVaultProviderGetSecret(t *testing.T) {
+	server := newVaultDevServer(t, map[string]map[string]interface{}{
+		"apps/db":    {"password": "s3cr3t", "port": 5432},
+		"apps/token": {"value": "single"},
+	})
+	provider := NewVaultProvider(VaultConfig{Address: server.URL, Token: "root"})
+	ctx := context.Background()
+
+	tests := []struct {
+		path, key string
+		want      string
+		wantErr   error
+	}{
+		{path: "apps/db", key: "password", want: "s3cr3t"},
+		{path: "apps/db", key: "port", want: "5432"},
+		{path: "apps/token", want: "single"},
+		{path: "apps/db", key: "missing", wantErr: ErrNotFound},
+		{path: "apps/missing", key: "password", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := provider.GetSecret(ctx, tt.path, tt.key)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetSecret(%q, %q) error = %v, want %v", tt.path, tt.key, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("GetSecret(%q, %q) = %q, %v, want %q", tt.path, tt.key, got, err, tt.want)
+		}
+	}
+
+	if _, err := provider.GetSecret(ctx, "apps/db", ""); err == nil {
+		t.Error("GetSecret without key on a multi-key path succeeded, want error")
+	}
+}
+
+func TestVaultProviderKubernetesAuth(t *testing.T) {
+	server := newVaultDevServer(t, map[string]map[string]interface{}{
+		"apps/db": {"password": "s3cr3t"},
+	})
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewVaultProvider(VaultConfig{Address: server.URL, Role: "one-click", TokenFile: tokenFile})
+	got, err := provider.GetSecret(context.Background(), "apps/db", "password")
+	if err != nil || string(got) != "s3cr3t" {
+		t.Fatalf("GetSecret() = %q, %v, want %q", got, err, "s3cr3t")
+	}
+
+	provider = NewVaultProvider(VaultConfig{Address: server.URL, Role: "other", TokenFile: tokenFile})
+	if _, err := provider.GetSecret(context.Background(), "apps/db", "password"); err == nil {
+		t.Fatal("GetSecret() with a denied role succeeded, want error")
+	}
+}
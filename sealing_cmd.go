@@ -0,0 +1,149 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/janlauber/one-click-operator/pkg/sealing"
+)
+
+// defaultOperatorNamespace is the namespace the operator is deployed to by config/default.
+const defaultOperatorNamespace = "one-click-operator"
+
+// runCommand runs one of the secret sealing subcommands:
+//
+//	encrypt --namespace NS [--name ROLLOUT] [--public-key FILE] [VALUE]
+//	                                     seal VALUE (or stdin) for the Rollouts in NS
+//	public-key                           print the active public key
+//	rotate-key [--prune]                 generate a new active key
+func runCommand(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	namespace := fs.String("operator-namespace", defaultOperatorNamespace, "The namespace holding the sealing key Secret and public key ConfigMap.")
+
+	switch command {
+	case "encrypt":
+		publicKeyFile := fs.String("public-key", "", "Encrypt against this PEM public key instead of fetching it from the cluster.")
+		rolloutNamespace := fs.String("namespace", "", "The namespace of the Rollouts that may use the value.")
+		rolloutName := fs.String("name", "", "The Rollout that may use the value, any Rollout of the namespace if empty.")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *rolloutNamespace == "" {
+			return fmt.Errorf("--namespace is required, values can only be used by Rollouts of the namespace they are sealed for")
+		}
+
+		var pub *rsa.PublicKey
+		if *publicKeyFile != "" {
+			data, err := os.ReadFile(*publicKeyFile)
+			if err != nil {
+				return err
+			}
+			if pub, err = sealing.ParsePublicKey(data); err != nil {
+				return err
+			}
+		} else {
+			var err error
+			if pub, err = loadPublicKey(*namespace); err != nil {
+				return err
+			}
+		}
+
+		var value []byte
+		if fs.NArg() > 0 && fs.Arg(0) != "-" {
+			value = []byte(fs.Arg(0))
+		} else {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			value = []byte(strings.TrimSuffix(string(data), "\n"))
+		}
+
+		encrypted, err := sealing.Encrypt(pub, *rolloutNamespace, *rolloutName, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(encrypted)
+		return nil
+
+	case "public-key":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		pub, err := loadPublicKey(*namespace)
+		if err != nil {
+			return err
+		}
+		pem, err := sealing.EncodePublicKey(pub)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(pem))
+		return nil
+
+	case "rotate-key":
+		prune := fs.Bool("prune", false, "Remove all previous keys. Values sealed for them can no longer be decrypted.")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		c, err := clusterClient()
+		if err != nil {
+			return err
+		}
+		ring, err := sealing.LoadKeyRingFromCluster(context.Background(), c, *namespace)
+		if err != nil {
+			return err
+		}
+		if err := ring.Rotate(); err != nil {
+			return err
+		}
+		if *prune {
+			ring.Prune()
+		}
+		if err := sealing.SaveKeyRing(context.Background(), c, *namespace, ring); err != nil {
+			return err
+		}
+		fmt.Printf("active key: %s\nkeys: %s\n", ring.ActiveKeyID(), strings.Join(ring.KeyIDs(), ", "))
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q, expected one of encrypt, public-key or rotate-key", command)
+}
+
+func clusterClient() (client.Client, error) {
+	return client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+}
+
+// loadPublicKey reads the published public key, so sealing values doesn't
+// require access to the private keys.
+func loadPublicKey(namespace string) (*rsa.PublicKey, error) {
+	c, err := clusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return sealing.LoadPublicKeyFromCluster(context.Background(), c, namespace)
+}